@@ -103,6 +103,9 @@ var (
 	// MAccessEvaluationCount is a metric gauge for total number of evaluation requests
 	MAccessEvaluationCount prometheus.Counter
 
+	// MAccessPluginPermissionsRejectedCount is a metric counter for plugin permissions rejected by validation labelled by plugin
+	MAccessPluginPermissionsRejectedCount *prometheus.CounterVec
+
 	// MPublicDashboardRequestCount is a metric counter for public dashboards requests
 	MPublicDashboardRequestCount prometheus.Counter
 
@@ -546,6 +549,12 @@ func init() {
 		Namespace: ExporterName,
 	})
 
+	MAccessPluginPermissionsRejectedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:      "access_plugin_permissions_rejected_total",
+		Help:      "number of plugin permissions rejected by validation",
+		Namespace: ExporterName,
+	}, []string{"plugin_id"})
+
 	StatsTotalLibraryPanels = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name:      "stat_totals_library_panels",
 		Help:      "total amount of library panels in the database",
@@ -674,6 +683,7 @@ func initMetricVars() {
 		StatsTotalDashboardVersions,
 		StatsTotalAnnotations,
 		MAccessEvaluationCount,
+		MAccessPluginPermissionsRejectedCount,
 		StatsTotalLibraryPanels,
 		StatsTotalLibraryVariables,
 		StatsTotalDataKeys,
@@ -88,7 +88,7 @@ func TestIntegrationPluginManager(t *testing.T) {
 	hcp := httpclient.NewProvider()
 	am := azuremonitor.ProvideService(cfg, hcp, tracer)
 	cw := cloudwatch.ProvideService(cfg, hcp, features)
-	cm := cloudmonitoring.ProvideService(hcp, tracer)
+	cm := cloudmonitoring.ProvideService(cfg, hcp, tracer)
 	es := elasticsearch.ProvideService(hcp)
 	grap := graphite.ProvideService(hcp, tracer)
 	idb := influxdb.ProvideService(hcp)
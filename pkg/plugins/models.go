@@ -281,6 +281,8 @@ type Role struct {
 	Name        string       `json:"name"`
 	DisplayName string       `json:"displayName"`
 	Description string       `json:"description"`
+	Version     int64        `json:"version"`
+	Hidden      bool         `json:"hidden"`
 	Permissions []Permission `json:"permissions"`
 }
 
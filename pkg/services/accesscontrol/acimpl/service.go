@@ -220,16 +220,15 @@ func (s *Service) DeclarePluginRoles(_ context.Context, ID, name string, regs []
 		return nil
 	}
 
-	acRegs := pluginutils.ToRegistrations(name, regs)
-	for _, r := range acRegs {
-		if err := pluginutils.ValidatePluginRole(ID, r.Role); err != nil {
-			return err
-		}
-
-		if err := accesscontrol.ValidateBuiltInRoles(r.Grants); err != nil {
-			return err
-		}
+	if err := pluginutils.ValidatePluginRoles(ID, regs); err != nil {
+		return err
+	}
 
+	acRegs, err := pluginutils.ToRegistrations(ID, name, regs)
+	if err != nil {
+		return err
+	}
+	for _, r := range acRegs {
 		s.log.Debug("Registering plugin role", "role", r.Role.Name)
 		s.registrations.Append(r)
 	}
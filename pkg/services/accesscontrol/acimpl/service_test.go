@@ -175,7 +175,7 @@ func TestService_DeclarePluginRoles(t *testing.T) {
 			pluginID: "test-app",
 			registrations: []plugins.RoleRegistration{
 				{
-					Role:   plugins.Role{Name: "plugins:test-app:test"},
+					Role:   plugins.Role{Name: "plugins:test-app:test", DisplayName: "Test"},
 					Grants: []string{"Admin"},
 				},
 			},
@@ -199,7 +199,8 @@ func TestService_DeclarePluginRoles(t *testing.T) {
 			registrations: []plugins.RoleRegistration{
 				{
 					Role: plugins.Role{
-						Name: "plugins:test-app:test",
+						Name:        "plugins:test-app:test",
+						DisplayName: "Test",
 						Permissions: []plugins.Permission{
 							{Action: "plugins.app:access"},
 							{Action: "test-app:read"},
@@ -217,7 +218,8 @@ func TestService_DeclarePluginRoles(t *testing.T) {
 			registrations: []plugins.RoleRegistration{
 				{
 					Role: plugins.Role{
-						Name: "plugins:test-app:test",
+						Name:        "plugins:test-app:test",
+						DisplayName: "Test",
 						Permissions: []plugins.Permission{
 							{Action: "invalid.test-app.resource:read"},
 						},
@@ -233,7 +235,7 @@ func TestService_DeclarePluginRoles(t *testing.T) {
 			pluginID: "test-app",
 			registrations: []plugins.RoleRegistration{
 				{
-					Role:   plugins.Role{Name: "plugins:test-app:test"},
+					Role:   plugins.Role{Name: "plugins:test-app:test", DisplayName: "Test"},
 					Grants: []string{"WrongAdmin"},
 				},
 			},
@@ -245,11 +247,11 @@ func TestService_DeclarePluginRoles(t *testing.T) {
 			pluginID: "test-app",
 			registrations: []plugins.RoleRegistration{
 				{
-					Role:   plugins.Role{Name: "plugins:test-app:test"},
+					Role:   plugins.Role{Name: "plugins:test-app:test", DisplayName: "Test"},
 					Grants: []string{"Admin"},
 				},
 				{
-					Role:   plugins.Role{Name: "plugins:test-app:test2"},
+					Role:   plugins.Role{Name: "plugins:test-app:test2", DisplayName: "Test 2"},
 					Grants: []string{"Admin"},
 				},
 			},
@@ -3,6 +3,7 @@ package accesscontrol
 import (
 	"errors"
 	"fmt"
+	"strings"
 )
 
 var (
@@ -11,6 +12,7 @@ var (
 	ErrInvalidScope           = errors.New("invalid scope")
 	ErrResolverNotFound       = errors.New("no resolver found")
 	ErrPluginIDRequired       = errors.New("plugin ID is required")
+	ErrEmptyAction            = errors.New("permission action is empty")
 )
 
 type ErrorInvalidRole struct{}
@@ -32,6 +34,32 @@ func (e *ErrorRolePrefixMissing) Unwrap() error {
 	return &ErrorInvalidRole{}
 }
 
+type ErrorInvalidRoleVersion struct {
+	Role    string
+	Version int64
+}
+
+func (e *ErrorInvalidRoleVersion) Error() string {
+	return fmt.Sprintf("invalid version %d for role '%s'", e.Version, e.Role)
+}
+
+func (e *ErrorInvalidRoleVersion) Unwrap() error {
+	return &ErrorInvalidRole{}
+}
+
+type ErrorInvalidDisplayName struct {
+	Role   string
+	Reason string
+}
+
+func (e *ErrorInvalidDisplayName) Error() string {
+	return fmt.Sprintf("invalid display name for role '%s': %s", e.Role, e.Reason)
+}
+
+func (e *ErrorInvalidDisplayName) Unwrap() error {
+	return &ErrorInvalidRole{}
+}
+
 type ErrorActionPrefixMissing struct {
 	Action   string
 	Prefixes []string
@@ -44,3 +72,105 @@ func (e *ErrorActionPrefixMissing) Error() string {
 func (e *ErrorActionPrefixMissing) Unwrap() error {
 	return &ErrorInvalidRole{}
 }
+
+type ErrorMalformedWildcardAction struct {
+	Action string
+}
+
+func (e *ErrorMalformedWildcardAction) Error() string {
+	return fmt.Sprintf("expected wildcard action '%s' to end with a single ':*', like 'plugin-id:*' or 'plugin-id.resource:*'", e.Action)
+}
+
+func (e *ErrorMalformedWildcardAction) Unwrap() error {
+	return &ErrorInvalidRole{}
+}
+
+type ErrorScopePrefixMissing struct {
+	Scope    string
+	Prefixes []string
+}
+
+func (e *ErrorScopePrefixMissing) Error() string {
+	return fmt.Sprintf("expected scope '%s' to be prefixed with any of '%v'", e.Scope, e.Prefixes)
+}
+
+func (e *ErrorScopePrefixMissing) Unwrap() error {
+	return &ErrorInvalidRole{}
+}
+
+// ErrorInvalidPermissions reports all the invalid permissions of a role at once,
+// errors.Is and errors.As match any of the wrapped errors
+type ErrorInvalidPermissions struct {
+	Errs []error
+}
+
+func (e *ErrorInvalidPermissions) Error() string {
+	return fmt.Sprintf("%d invalid permissions: %s", len(e.Errs), joinErrors(e.Errs))
+}
+
+func (e *ErrorInvalidPermissions) Is(target error) bool {
+	return anyErrorIs(e.Errs, target)
+}
+
+func (e *ErrorInvalidPermissions) As(target interface{}) bool {
+	return anyErrorAs(e.Errs, target)
+}
+
+// ErrorRoleAtIndex tells which of the registered roles failed validation
+type ErrorRoleAtIndex struct {
+	Index int
+	Role  string
+	Err   error
+}
+
+func (e *ErrorRoleAtIndex) Error() string {
+	return fmt.Sprintf("role %d '%s': %v", e.Index, e.Role, e.Err)
+}
+
+func (e *ErrorRoleAtIndex) Unwrap() error {
+	return e.Err
+}
+
+// ErrorInvalidRoles reports all the invalid roles of a registration at once,
+// errors.Is and errors.As match any of the wrapped errors
+type ErrorInvalidRoles struct {
+	Errs []error
+}
+
+func (e *ErrorInvalidRoles) Error() string {
+	return fmt.Sprintf("%d invalid roles: %s", len(e.Errs), joinErrors(e.Errs))
+}
+
+func (e *ErrorInvalidRoles) Is(target error) bool {
+	return anyErrorIs(e.Errs, target)
+}
+
+func (e *ErrorInvalidRoles) As(target interface{}) bool {
+	return anyErrorAs(e.Errs, target)
+}
+
+func joinErrors(errs []error) string {
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func anyErrorIs(errs []error, target error) bool {
+	for _, err := range errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func anyErrorAs(errs []error, target interface{}) bool {
+	for _, err := range errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,28 +1,144 @@
 package pluginutils
 
 import (
+	"fmt"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/grafana/grafana/pkg/infra/metrics"
 	"github.com/grafana/grafana/pkg/plugins"
 	ac "github.com/grafana/grafana/pkg/services/accesscontrol"
 )
 
-// ValidatePluginPermissions errors when a permission does not match expected pattern for plugins
-func ValidatePluginPermissions(pluginID string, permissions []ac.Permission) error {
+// maxDisplayNameLength matches the size of the role display_name column
+const maxDisplayNameLength = 190
+
+// pluginIDScopeToken is replaced by the plugin ID in the scopes of plugin permissions
+const pluginIDScopeToken = "{{.PluginID}}"
+
+// globalScopes are the scopes plugins can use even though they aren't prefixed with the plugin ID
+var globalScopes = map[string]bool{"*": true}
+
+// ValidatePluginPermissions errors when a permission does not match expected pattern for plugins.
+// The extraActions are allowed as well, even though they aren't prefixed with the plugin ID.
+// All invalid permissions are reported together in an ac.ErrorInvalidPermissions.
+func ValidatePluginPermissions(pluginID string, permissions []ac.Permission, extraActions ...string) error {
+	return ValidatePluginPermissionsWithAliases(pluginID, nil, permissions, extraActions...)
+}
+
+// ValidatePluginPermissionsWithAliases works like ValidatePluginPermissions but also accepts actions
+// and scopes prefixed with any of the aliases, so renamed plugins can keep using their former IDs.
+func ValidatePluginPermissionsWithAliases(pluginID string, aliases []string, permissions []ac.Permission, extraActions ...string) error {
+	return ValidatePluginPermissionsWithOptions(pluginID, permissions, ValidationOptions{
+		Aliases:      aliases,
+		ExtraActions: extraActions,
+	})
+}
+
+// ValidationOptions tune how plugin permissions are validated
+type ValidationOptions struct {
+	// Aliases are former IDs of the plugin its actions and scopes can be prefixed with
+	Aliases []string
+	// ExtraActions are allowed even though they aren't prefixed with the plugin ID,
+	// their scopes aren't required to reference the plugin either
+	ExtraActions []string
+	// CaseInsensitiveID matches the plugin ID prefix of actions regardless of case,
+	// the rest of the action is still compared as is
+	CaseInsensitiveID bool
+}
+
+// ValidatePluginPermissionsWithOptions errors when a permission does not match expected pattern for plugins,
+// as tuned by the options.
+func ValidatePluginPermissionsWithOptions(pluginID string, permissions []ac.Permission, opts ValidationOptions) error {
+	ids := append([]string{pluginID}, opts.Aliases...)
+	idPrefixes := make([]string, 0, 2*len(ids))
+	for _, id := range ids {
+		idPrefixes = append(idPrefixes, id+":", id+".")
+	}
+
+	var errs []error
 	for i := range permissions {
-		if permissions[i].Action != plugins.ActionAppAccess &&
-			!strings.HasPrefix(permissions[i].Action, pluginID+":") &&
-			!strings.HasPrefix(permissions[i].Action, pluginID+".") {
-			return &ac.ErrorActionPrefixMissing{Action: permissions[i].Action,
-				Prefixes: []string{plugins.ActionAppAccess, pluginID + ":", pluginID + "."}}
+		action := strings.TrimSpace(permissions[i].Action)
+		if action == "" {
+			errs = append(errs, ac.ErrEmptyAction)
+			continue
+		}
+		extraAction := containsAction(opts.ExtraActions, action)
+		if action != plugins.ActionAppAccess &&
+			!hasAnyPrefix(action, idPrefixes, opts.CaseInsensitiveID) &&
+			!extraAction {
+			errs = append(errs, &ac.ErrorActionPrefixMissing{Action: action,
+				Prefixes: append([]string{plugins.ActionAppAccess}, idPrefixes...)})
+			continue
+		}
+		if !validWildcardAction(action) {
+			errs = append(errs, &ac.ErrorMalformedWildcardAction{Action: action})
+			continue
+		}
+		// extra actions act on core resources, their scopes can't be scoped to the plugin
+		if extraAction {
+			continue
+		}
+		if err := validatePluginScope(ids, idPrefixes, permissions[i].Scope); err != nil {
+			errs = append(errs, err)
 		}
 	}
 
+	if len(errs) > 0 {
+		metrics.MAccessPluginPermissionsRejectedCount.WithLabelValues(pluginID).Add(float64(len(errs)))
+		return &ac.ErrorInvalidPermissions{Errs: errs}
+	}
 	return nil
 }
 
-// ValidatePluginRole errors when a plugin role does not match expected pattern
-// or doesn't have permissions matching the expected pattern.
+// validatePluginScope errors when a scope references resources of another plugin
+func validatePluginScope(ids []string, idPrefixes []string, scope string) error {
+	if scope == "" || globalScopes[scope] || hasAnyPrefix(scope, idPrefixes, false) {
+		return nil
+	}
+
+	pluginScopes := make([]string, 0, len(ids))
+	for _, id := range ids {
+		pluginScope := plugins.ScopeProvider.GetResourceScope(id)
+		if scope == pluginScope {
+			return nil
+		}
+		pluginScopes = append(pluginScopes, pluginScope)
+	}
+
+	return &ac.ErrorScopePrefixMissing{Scope: scope, Prefixes: append(pluginScopes, idPrefixes...)}
+}
+
+// validWildcardAction checks that wildcards only appear as a single trailing ':*'
+func validWildcardAction(action string) bool {
+	n := strings.Count(action, "*")
+	return n == 0 || (n == 1 && strings.HasSuffix(action, ":*"))
+}
+
+func hasAnyPrefix(s string, prefixes []string, ignoreCase bool) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+		if ignoreCase && len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAction(actions []string, action string) bool {
+	for _, a := range actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidatePluginRole errors when a plugin role does not match expected pattern,
+// has an invalid display name or version or doesn't have permissions matching the expected pattern.
 func ValidatePluginRole(pluginID string, role ac.RoleDTO) error {
 	if pluginID == "" {
 		return ac.ErrPluginIDRequired
@@ -30,33 +146,106 @@ func ValidatePluginRole(pluginID string, role ac.RoleDTO) error {
 	if !strings.HasPrefix(role.Name, ac.PluginRolePrefix+pluginID+":") {
 		return &ac.ErrorRolePrefixMissing{Role: role.Name, Prefixes: []string{ac.PluginRolePrefix + pluginID + ":"}}
 	}
+	if err := validateDisplayName(role); err != nil {
+		return err
+	}
+	if role.Version < 0 {
+		return &ac.ErrorInvalidRoleVersion{Role: role.Name, Version: role.Version}
+	}
 
 	return ValidatePluginPermissions(pluginID, role.Permissions)
 }
 
-func ToRegistrations(pluginName string, regs []plugins.RoleRegistration) []ac.RoleRegistration {
+// validateDisplayName errors when the display name of a role is empty, too long or contains control characters
+func validateDisplayName(role ac.RoleDTO) error {
+	if strings.TrimSpace(role.DisplayName) == "" {
+		return &ac.ErrorInvalidDisplayName{Role: role.Name, Reason: "display name is required"}
+	}
+	if utf8.RuneCountInString(role.DisplayName) > maxDisplayNameLength {
+		return &ac.ErrorInvalidDisplayName{Role: role.Name,
+			Reason: fmt.Sprintf("display name is longer than %d characters", maxDisplayNameLength)}
+	}
+	for _, r := range role.DisplayName {
+		if unicode.IsControl(r) {
+			return &ac.ErrorInvalidDisplayName{Role: role.Name, Reason: "display name contains control characters"}
+		}
+	}
+	return nil
+}
+
+// ValidatePluginRoles validates every role of the registrations with ValidatePluginRole.
+// All invalid roles are reported together in an ac.ErrorInvalidRoles, each failure carrying the role index.
+func ValidatePluginRoles(pluginID string, regs []plugins.RoleRegistration) error {
+	if len(regs) == 0 {
+		return nil
+	}
+	if pluginID == "" {
+		return ac.ErrPluginIDRequired
+	}
+
+	var errs []error
+	for i := range regs {
+		role := toRole(pluginID, pluginID, regs[i].Role)
+		if err := ValidatePluginRole(pluginID, role); err != nil {
+			errs = append(errs, &ac.ErrorRoleAtIndex{Index: i, Role: role.Name, Err: err})
+		}
+	}
+
+	if len(errs) > 0 {
+		return &ac.ErrorInvalidRoles{Errs: errs}
+	}
+	return nil
+}
+
+// ToRegistrations converts the plugin role registrations, it errors when a role is granted to
+// something else than a basic role
+func ToRegistrations(pluginID, pluginName string, regs []plugins.RoleRegistration) ([]ac.RoleRegistration, error) {
 	res := make([]ac.RoleRegistration, 0, len(regs))
 	for i := range regs {
+		if err := ac.ValidateBuiltInRoles(regs[i].Grants); err != nil {
+			return nil, fmt.Errorf("role '%s': %w", regs[i].Role.Name, err)
+		}
 		res = append(res, ac.RoleRegistration{
-			Role: ac.RoleDTO{
-				Version:     1,
-				Name:        regs[i].Role.Name,
-				DisplayName: regs[i].Role.DisplayName,
-				Description: regs[i].Role.Description,
-				Group:       pluginName,
-				Permissions: toPermissions(regs[i].Role.Permissions),
-				OrgID:       ac.GlobalOrgID,
-			},
+			Role:   toRole(pluginID, pluginName, regs[i].Role),
 			Grants: regs[i].Grants,
 		})
 	}
-	return res
+	return res, nil
+}
+
+// toRole converts a plugin role, roles without a version default to version 1
+func toRole(pluginID, pluginName string, role plugins.Role) ac.RoleDTO {
+	version := role.Version
+	if version == 0 {
+		version = 1
+	}
+	return ac.RoleDTO{
+		Version:     version,
+		Name:        role.Name,
+		DisplayName: role.DisplayName,
+		Description: role.Description,
+		Group:       pluginName,
+		Permissions: toPermissions(pluginID, role.Permissions),
+		Hidden:      role.Hidden,
+		OrgID:       ac.GlobalOrgID,
+	}
 }
 
-func toPermissions(perms []plugins.Permission) []ac.Permission {
+// toPermissions converts the plugin permissions, trimming their actions, expanding the plugin ID
+// in their scopes and dropping repeated action and scope pairs
+func toPermissions(pluginID string, perms []plugins.Permission) []ac.Permission {
 	res := make([]ac.Permission, 0, len(perms))
+	seen := make(map[plugins.Permission]bool, len(perms))
 	for i := range perms {
-		res = append(res, ac.Permission{Action: perms[i].Action, Scope: perms[i].Scope})
+		p := plugins.Permission{
+			Action: strings.TrimSpace(perms[i].Action),
+			Scope:  strings.ReplaceAll(perms[i].Scope, pluginIDScopeToken, pluginID),
+		}
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		res = append(res, ac.Permission{Action: p.Action, Scope: p.Scope})
 	}
 	return res
 }
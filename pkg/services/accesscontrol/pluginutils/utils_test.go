@@ -1,11 +1,15 @@
 package pluginutils
 
 import (
+	"strings"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/metrics"
 	"github.com/grafana/grafana/pkg/plugins"
 	ac "github.com/grafana/grafana/pkg/services/accesscontrol"
-	"github.com/stretchr/testify/require"
 )
 
 func TestToRegistrations(t *testing.T) {
@@ -68,15 +72,321 @@ func TestToRegistrations(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "duplicate permissions are dropped",
+			regs: []plugins.RoleRegistration{
+				{
+					Role: plugins.Role{
+						Name: "test:name",
+						Permissions: []plugins.Permission{
+							{Action: "test:action", Scope: "test:scope"},
+							{Action: "test:action"},
+							{Action: "test:action", Scope: "test:scope"},
+							{Action: "test:other"},
+							{Action: " test:action"},
+						},
+					},
+				},
+			},
+			want: []ac.RoleRegistration{
+				{
+					Role: ac.RoleDTO{
+						Version: 1,
+						Name:    "test:name",
+						Group:   "PluginName",
+						Permissions: []ac.Permission{
+							{Action: "test:action", Scope: "test:scope"},
+							{Action: "test:action"},
+							{Action: "test:other"},
+						},
+						OrgID: ac.GlobalOrgID,
+					},
+				},
+			},
+		},
+		{
+			name: "plugin ID is expanded in scopes",
+			regs: []plugins.RoleRegistration{
+				{
+					Role: plugins.Role{
+						Name: "test:name",
+						Permissions: []plugins.Permission{
+							{Action: "test-app:read", Scope: "{{.PluginID}}:id:*"},
+							{Action: "test-app:write", Scope: "test-app:id:1"},
+						},
+					},
+				},
+			},
+			want: []ac.RoleRegistration{
+				{
+					Role: ac.RoleDTO{
+						Version: 1,
+						Name:    "test:name",
+						Group:   "PluginName",
+						Permissions: []ac.Permission{
+							{Action: "test-app:read", Scope: "test-app:id:*"},
+							{Action: "test-app:write", Scope: "test-app:id:1"},
+						},
+						OrgID: ac.GlobalOrgID,
+					},
+				},
+			},
+		},
+		{
+			name: "hidden flag is kept",
+			regs: []plugins.RoleRegistration{
+				{
+					Role: plugins.Role{Name: "test:name", Hidden: true},
+				},
+			},
+			want: []ac.RoleRegistration{
+				{
+					Role: ac.RoleDTO{
+						Version:     1,
+						Name:        "test:name",
+						Group:       "PluginName",
+						Permissions: []ac.Permission{},
+						Hidden:      true,
+						OrgID:       ac.GlobalOrgID,
+					},
+				},
+			},
+		},
+		{
+			name: "provided version is kept",
+			regs: []plugins.RoleRegistration{
+				{
+					Role: plugins.Role{Name: "test:name", Version: 3},
+				},
+			},
+			want: []ac.RoleRegistration{
+				{
+					Role: ac.RoleDTO{
+						Version:     3,
+						Name:        "test:name",
+						Group:       "PluginName",
+						Permissions: []ac.Permission{},
+						OrgID:       ac.GlobalOrgID,
+					},
+				},
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := ToRegistrations("PluginName", tt.regs)
+			got, err := ToRegistrations("test-app", "PluginName", tt.regs)
+			require.NoError(t, err)
 			require.Equal(t, tt.want, got)
 		})
 	}
 }
 
+func TestToRegistrations_InvalidGrant(t *testing.T) {
+	_, err := ToRegistrations("test-app", "PluginName", []plugins.RoleRegistration{
+		{Role: plugins.Role{Name: "test:reader"}, Grants: []string{"Viewer"}},
+		{Role: plugins.Role{Name: "test:writer"}, Grants: []string{"Editor", "Editr"}},
+	})
+	require.ErrorIs(t, err, ac.ErrInvalidBuiltinRole)
+	require.Contains(t, err.Error(), "test:writer")
+	require.Contains(t, err.Error(), "Editr")
+}
+
+func TestValidatePluginPermissions(t *testing.T) {
+	tests := []struct {
+		name         string
+		permissions  []ac.Permission
+		extraActions []string
+		wantErr      error
+	}{
+		{
+			name:        "unprefixed action without extra actions",
+			permissions: []ac.Permission{{Action: "datasources:read"}},
+			wantErr:     &ac.ErrorInvalidRole{},
+		},
+		{
+			name:         "allowed extra action",
+			permissions:  []ac.Permission{{Action: "test-app:read"}, {Action: "datasources:read"}},
+			extraActions: []string{"datasources:read"},
+		},
+		{
+			name:         "extra action with a core scope",
+			permissions:  []ac.Permission{{Action: "datasources:read", Scope: "datasources:*"}},
+			extraActions: []string{"datasources:read"},
+		},
+		{
+			name:         "unrelated action with extra actions",
+			permissions:  []ac.Permission{{Action: "datasources:read"}, {Action: "users:write"}},
+			extraActions: []string{"datasources:read"},
+			wantErr:      &ac.ErrorInvalidRole{},
+		},
+		{
+			name: "self scoped permissions",
+			permissions: []ac.Permission{
+				{Action: "plugins.app:access", Scope: "plugins:id:test-app"},
+				{Action: "test-app:read", Scope: "test-app:*"},
+				{Action: "test-app.resources:read", Scope: "test-app.resources:uid:abc"},
+				{Action: "test-app:write", Scope: "*"},
+			},
+		},
+		{
+			name: "wildcard actions",
+			permissions: []ac.Permission{
+				{Action: "test-app:*"},
+				{Action: "test-app.resources:*"},
+			},
+		},
+		{
+			name:        "malformed wildcard action",
+			permissions: []ac.Permission{{Action: "test-app:read:*:*"}},
+			wantErr:     &ac.ErrorInvalidRole{},
+		},
+		{
+			name:        "partial wildcard action",
+			permissions: []ac.Permission{{Action: "test-app:re*"}},
+			wantErr:     &ac.ErrorInvalidRole{},
+		},
+		{
+			name:        "empty action",
+			permissions: []ac.Permission{{Action: "test-app:read"}, {Action: "  "}},
+			wantErr:     ac.ErrEmptyAction,
+		},
+		{
+			name:        "whitespace padded action",
+			permissions: []ac.Permission{{Action: " test-app:read "}},
+		},
+		{
+			name:        "cross plugin scope",
+			permissions: []ac.Permission{{Action: "test-app:read", Scope: "other-app:*"}},
+			wantErr:     &ac.ErrorInvalidRole{},
+		},
+		{
+			name:        "other plugin's app scope",
+			permissions: []ac.Permission{{Action: "plugins.app:access", Scope: "plugins:id:other-app"}},
+			wantErr:     &ac.ErrorInvalidRole{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidatePluginPermissions("test-app", tt.permissions, tt.extraActions...)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestValidatePluginRole_DisplayNameError(t *testing.T) {
+	for _, displayName := range []string{"", " \t"} {
+		err := ValidatePluginRole("test-app", ac.RoleDTO{Name: "plugins:test-app:reader", DisplayName: displayName})
+
+		var displayNameErr *ac.ErrorInvalidDisplayName
+		require.ErrorAs(t, err, &displayNameErr)
+		require.Equal(t, "plugins:test-app:reader", displayNameErr.Role)
+	}
+}
+
+func TestValidatePluginPermissions_ScopeError(t *testing.T) {
+	err := ValidatePluginPermissions("test-app", []ac.Permission{{Action: "test-app:read", Scope: "other-app:*"}})
+
+	var scopeErr *ac.ErrorScopePrefixMissing
+	require.ErrorAs(t, err, &scopeErr)
+	require.Equal(t, "other-app:*", scopeErr.Scope)
+}
+
+func TestValidatePluginPermissions_WildcardError(t *testing.T) {
+	err := ValidatePluginPermissions("test-app", []ac.Permission{{Action: "test-app:read:*:*"}})
+
+	var wildcardErr *ac.ErrorMalformedWildcardAction
+	require.ErrorAs(t, err, &wildcardErr)
+	require.Equal(t, "test-app:read:*:*", wildcardErr.Action)
+	require.Contains(t, err.Error(), "'plugin-id:*'")
+}
+
+func TestValidatePluginPermissions_RejectionMetric(t *testing.T) {
+	rejected := metrics.MAccessPluginPermissionsRejectedCount.WithLabelValues("metric-app")
+	before := testutil.ToFloat64(rejected)
+
+	require.NoError(t, ValidatePluginPermissions("metric-app", []ac.Permission{{Action: "metric-app:read"}}))
+	require.Equal(t, before, testutil.ToFloat64(rejected))
+
+	require.Error(t, ValidatePluginPermissions("metric-app", []ac.Permission{
+		{Action: "metric-app:read"},
+		{Action: "users:read"},
+		{Action: "teams:read"},
+	}))
+	require.Equal(t, before+2, testutil.ToFloat64(rejected))
+}
+
+func TestValidatePluginPermissionsWithAliases(t *testing.T) {
+	aliases := []string{"old-app"}
+
+	t.Run("accepts actions and scopes under an alias", func(t *testing.T) {
+		err := ValidatePluginPermissionsWithAliases("test-app", aliases, []ac.Permission{
+			{Action: "test-app:read", Scope: "test-app:*"},
+			{Action: "old-app:read", Scope: "old-app:*"},
+			{Action: "old-app.resources:write"},
+			{Action: "plugins.app:access", Scope: "plugins:id:old-app"},
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("rejects actions under other plugin IDs", func(t *testing.T) {
+		err := ValidatePluginPermissionsWithAliases("test-app", aliases, []ac.Permission{{Action: "other-app:read"}})
+		require.ErrorIs(t, err, &ac.ErrorInvalidRole{})
+	})
+
+	t.Run("aliases aren't accepted without being declared", func(t *testing.T) {
+		err := ValidatePluginPermissions("test-app", []ac.Permission{{Action: "old-app:read"}})
+		require.ErrorIs(t, err, &ac.ErrorInvalidRole{})
+	})
+}
+
+func TestValidatePluginPermissionsWithOptions(t *testing.T) {
+	permissions := []ac.Permission{
+		{Action: "My-App:read"},
+		{Action: "my-app.Resources:write"},
+	}
+
+	t.Run("plugin ID prefix is case sensitive by default", func(t *testing.T) {
+		err := ValidatePluginPermissionsWithOptions("my-app", permissions, ValidationOptions{})
+		require.ErrorIs(t, err, &ac.ErrorInvalidRole{})
+	})
+
+	t.Run("accepts a mixed case plugin ID prefix with the option", func(t *testing.T) {
+		err := ValidatePluginPermissionsWithOptions("my-app", permissions, ValidationOptions{CaseInsensitiveID: true})
+		require.NoError(t, err)
+	})
+
+	t.Run("still rejects other plugin IDs with the option", func(t *testing.T) {
+		err := ValidatePluginPermissionsWithOptions("my-app", []ac.Permission{{Action: "Other-App:read"}},
+			ValidationOptions{CaseInsensitiveID: true})
+		require.ErrorIs(t, err, &ac.ErrorInvalidRole{})
+	})
+}
+
+func TestValidatePluginPermissions_ReportsAllErrors(t *testing.T) {
+	err := ValidatePluginPermissions("test-app", []ac.Permission{
+		{Action: "test-app:read"},
+		{Action: "users:read"},
+		{Action: "teams:read"},
+		{Action: "test-app:write"},
+		{Action: "other-app:read"},
+	})
+
+	var permErr *ac.ErrorInvalidPermissions
+	require.ErrorAs(t, err, &permErr)
+	require.Len(t, permErr.Errs, 3)
+	for i, action := range []string{"users:read", "teams:read", "other-app:read"} {
+		var actionErr *ac.ErrorActionPrefixMissing
+		require.ErrorAs(t, permErr.Errs[i], &actionErr)
+		require.Equal(t, action, actionErr.Action)
+		require.Contains(t, err.Error(), action)
+	}
+	require.ErrorIs(t, err, &ac.ErrorInvalidRole{})
+}
+
 func TestValidatePluginRole(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -105,13 +415,44 @@ func TestValidatePluginRole(t *testing.T) {
 		{
 			name:     "valid name",
 			pluginID: "test-app",
+			role:     ac.RoleDTO{Name: "plugins:test-app:reader", DisplayName: "Reader"},
+		},
+		{
+			name:     "empty display name",
+			pluginID: "test-app",
 			role:     ac.RoleDTO{Name: "plugins:test-app:reader"},
+			wantErr:  &ac.ErrorInvalidRole{},
+		},
+		{
+			name:     "whitespace display name",
+			pluginID: "test-app",
+			role:     ac.RoleDTO{Name: "plugins:test-app:reader", DisplayName: " \t"},
+			wantErr:  &ac.ErrorInvalidRole{},
+		},
+		{
+			name:     "too long display name",
+			pluginID: "test-app",
+			role:     ac.RoleDTO{Name: "plugins:test-app:reader", DisplayName: strings.Repeat("a", 191)},
+			wantErr:  &ac.ErrorInvalidRole{},
+		},
+		{
+			name:     "negative version",
+			pluginID: "test-app",
+			role:     ac.RoleDTO{Name: "plugins:test-app:reader", DisplayName: "Reader", Version: -1},
+			wantErr:  &ac.ErrorInvalidRole{},
+		},
+		{
+			name:     "display name with control characters",
+			pluginID: "test-app",
+			role:     ac.RoleDTO{Name: "plugins:test-app:reader", DisplayName: "Reader\n"},
+			wantErr:  &ac.ErrorInvalidRole{},
 		},
 		{
 			name:     "invalid permission",
 			pluginID: "test-app",
 			role: ac.RoleDTO{
 				Name:        "plugins:test-app:reader",
+				DisplayName: "Reader",
 				Permissions: []ac.Permission{{Action: "invalidtest-app:read"}},
 			},
 			wantErr: &ac.ErrorInvalidRole{},
@@ -120,7 +461,8 @@ func TestValidatePluginRole(t *testing.T) {
 			name:     "valid permissions",
 			pluginID: "test-app",
 			role: ac.RoleDTO{
-				Name: "plugins:test-app:reader",
+				Name:        "plugins:test-app:reader",
+				DisplayName: "Reader",
 				Permissions: []ac.Permission{
 					{Action: "plugins.app:access"},
 					{Action: "test-app:read"},
@@ -140,3 +482,46 @@ func TestValidatePluginRole(t *testing.T) {
 		})
 	}
 }
+
+func TestValidatePluginRoles(t *testing.T) {
+	t.Run("no registrations", func(t *testing.T) {
+		require.NoError(t, ValidatePluginRoles("", nil))
+	})
+
+	t.Run("plugin ID is required", func(t *testing.T) {
+		err := ValidatePluginRoles("", []plugins.RoleRegistration{{Role: plugins.Role{Name: "plugins::reader", DisplayName: "Reader"}}})
+		require.ErrorIs(t, err, ac.ErrPluginIDRequired)
+	})
+
+	t.Run("reports every invalid role with its index", func(t *testing.T) {
+		err := ValidatePluginRoles("test-app", []plugins.RoleRegistration{
+			{Role: plugins.Role{Name: "plugins:test-app:reader", DisplayName: "Reader"}},
+			{Role: plugins.Role{Name: "test-app:writer", DisplayName: "Writer"}},
+			{Role: plugins.Role{Name: "plugins:test-app:admin", DisplayName: "Admin"}},
+			{Role: plugins.Role{
+				Name:        "plugins:test-app:editor",
+				DisplayName: "Editor",
+				Permissions: []plugins.Permission{{Action: "users:write"}},
+			}},
+		})
+
+		var rolesErr *ac.ErrorInvalidRoles
+		require.ErrorAs(t, err, &rolesErr)
+		require.Len(t, rolesErr.Errs, 2)
+
+		var first, second *ac.ErrorRoleAtIndex
+		require.ErrorAs(t, rolesErr.Errs[0], &first)
+		require.Equal(t, 1, first.Index)
+		require.Equal(t, "test-app:writer", first.Role)
+		var prefixErr *ac.ErrorRolePrefixMissing
+		require.ErrorAs(t, first, &prefixErr)
+
+		require.ErrorAs(t, rolesErr.Errs[1], &second)
+		require.Equal(t, 3, second.Index)
+		require.Equal(t, "plugins:test-app:editor", second.Role)
+		var actionErr *ac.ErrorActionPrefixMissing
+		require.ErrorAs(t, second, &actionErr)
+
+		require.ErrorIs(t, err, &ac.ErrorInvalidRole{})
+	})
+}
@@ -24,7 +24,7 @@ func (s *Service) executeAnnotationQuery(ctx context.Context, logger log.Logger,
 	*backend.QueryDataResponse, error) {
 	resp := backend.NewQueryDataResponse()
 
-	queries, err := s.buildQueryExecutors(logger, req)
+	queries, err := s.buildQueryExecutors(logger, req, dsInfo)
 	if err != nil {
 		return resp, err
 	}
@@ -2,6 +2,9 @@ package cloudmonitoring
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,8 +13,10 @@ import (
 	"net/url"
 	"path"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/grafana/grafana-google-sdk-go/pkg/utils"
@@ -21,8 +26,10 @@ import (
 	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/grafana/grafana/pkg/infra/httpclient"
+	"github.com/grafana/grafana/pkg/infra/localcache"
 	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/infra/tracing"
 	"github.com/grafana/grafana/pkg/setting"
@@ -38,6 +45,11 @@ var (
 	metricNameFormat            = regexp.MustCompile(`([\w\d_]+)\.(googleapis\.com|io)/(.+)`)
 	wildcardRegexRe             = regexp.MustCompile(`[-\/^$+?.()|[\]{}]`)
 	alignmentPeriodRe           = regexp.MustCompile("[0-9]+")
+	alignmentPeriodFormatRe     = regexp.MustCompile(`^\+?(\d+(?:\.\d+)?)(ms|s)?$`)
+	lookbackPeriodRe            = regexp.MustCompile(`^\d+(ms|s|m|h|d)$`)
+	decimalNumberRe             = regexp.MustCompile(`^-?\d+(\.\d+)?$`)
+	filterValueEscaper          = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	numericComparisonOperators  = map[string]bool{">": true, "<": true, ">=": true, "<=": true}
 	cloudMonitoringUnitMappings = map[string]string{
 		"bit":     "bits",
 		"By":      "bytes",
@@ -54,23 +66,61 @@ var (
 		"By/s":    "Bps",
 		"GBy":     "decgbytes",
 	}
+	// groupByPrefixes are the prefixes of the label keys series can be grouped by
+	groupByPrefixes = []string{"metric.label.", "resource.label.", "metadata.system_labels.", "metadata.user_labels."}
+	// alignment periods, in seconds, the auto alignment period is rounded up to
+	autoAlignmentPeriods = []int{60, 120, 300, 600, 900, 1800, 3600, 7200, 21600, 43200, 86400}
 )
 
 const (
-	gceAuthentication         = "gce"
-	jwtAuthentication         = "jwt"
-	metricQueryType           = "metrics"
-	sloQueryType              = "slo"
-	mqlEditorMode             = "mql"
-	crossSeriesReducerDefault = "REDUCE_NONE"
-	perSeriesAlignerDefault   = "ALIGN_MEAN"
+	gceAuthentication           = "gce"
+	jwtAuthentication           = "jwt"
+	impersonationAuthentication = "impersonation"
+	metricQueryType             = "metrics"
+	sloQueryType                = "slo"
+	mqlEditorMode               = "mql"
+	crossSeriesReducerDefault   = "REDUCE_NONE"
+	perSeriesAlignerDefault     = "ALIGN_MEAN"
+	alignNone                   = "ALIGN_NONE"
+	alignRate                   = "ALIGN_RATE"
+	groupIDFilterKey            = "group.id"
+	defaultMinAlignmentSeconds  = 60
+	minAlignmentPeriodFloor     = time.Second
+
+	// maxAlignmentPeriodSeconds is the longest alignment period the API accepts, 104 weeks
+	maxAlignmentPeriodSeconds = 104 * 7 * 24 * 60 * 60
+
+	// maxConcurrentQueries is how many executors of a single request query the API at the same time
+	maxConcurrentQueries = 5
+
+	// maxRawResponseLength is the maximum length, in bytes, of the raw response attached for debugging
+	maxRawResponseLength = 64 * 1024
+
+	// maxFieldDescriptionLength is the maximum length, in characters, of the field description
+	maxFieldDescriptionLength = 200
+
+	// pluginID is the id of the datasource plugin, used for its [plugin.stackdriver] settings
+	pluginID = "stackdriver"
+
+	// modes for filling alignment periods without data
+	fillMissingNull      = "null"
+	fillMissingConnected = "connected"
+	fillMissingZero      = "zero"
+
+	// visTypeHeatmap hints the frontend to render distribution buckets as a heatmap.
+	visTypeHeatmap data.VisType = "heatmap"
 )
 
-func ProvideService(httpClientProvider httpclient.Provider, tracer tracing.Tracer) *Service {
+func ProvideService(cfg *setting.Cfg, httpClientProvider httpclient.Provider, tracer tracing.Tracer) *Service {
+	// credentials files can only be read from the directory configured by the server admin
+	credentialsFilesDir := cfg.PluginSettings[pluginID]["credentials_files_dir"]
+
+	registerMetrics(prometheus.DefaultRegisterer)
+
 	s := &Service{
 		tracer:             tracer,
 		httpClientProvider: httpClientProvider,
-		im:                 datasource.NewInstanceManager(newInstanceSettings(httpClientProvider)),
+		im:                 datasource.NewInstanceManager(newInstanceSettings(httpClientProvider, credentialsFilesDir)),
 
 		gceDefaultProjectGetter: utils.GCEDefaultProject,
 	}
@@ -90,6 +140,24 @@ func (s *Service) CheckHealth(ctx context.Context, req *backend.CheckHealthReque
 		return nil, err
 	}
 
+	if dsInfo.apiEndpoint != "" {
+		if err := validateAPIEndpoint(dsInfo.apiEndpoint); err != nil {
+			return &backend.CheckHealthResult{
+				Status:  backend.HealthStatusError,
+				Message: err.Error(),
+			}, nil
+		}
+	}
+
+	if dsInfo.authenticationType == jwtAuthentication && dsInfo.credentialsFilePath != "" {
+		if _, err := newCredentialsFileTokenSource(ctx, dsInfo.credentialsFilePath, routes[cloudMonitor].scopes); err != nil {
+			return &backend.CheckHealthResult{
+				Status:  backend.HealthStatusError,
+				Message: err.Error(),
+			}, nil
+		}
+	}
+
 	defaultProject, err := s.getDefaultProject(ctx, *dsInfo)
 	if err != nil {
 		return &backend.CheckHealthResult{
@@ -98,15 +166,18 @@ func (s *Service) CheckHealth(ctx context.Context, req *backend.CheckHealthReque
 		}, nil
 	}
 
-	url := fmt.Sprintf("%v/v3/projects/%v/metricDescriptors", dsInfo.services[cloudMonitor].url, defaultProject)
-	request, err := http.NewRequest(http.MethodGet, url, nil)
+	url := fmt.Sprintf("%v/v3/projects/%v/metricDescriptors?pageSize=1", dsInfo.services[cloudMonitor].url, defaultProject)
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	res, err := dsInfo.services[cloudMonitor].client.Do(request)
 	if err != nil {
-		return nil, err
+		return &backend.CheckHealthResult{
+			Status:  backend.HealthStatusError,
+			Message: err.Error(),
+		}, nil
 	}
 	defer func() {
 		if err := res.Body.Close(); err != nil {
@@ -119,6 +190,11 @@ func (s *Service) CheckHealth(ctx context.Context, req *backend.CheckHealthReque
 	if res.StatusCode != 200 {
 		status = backend.HealthStatusError
 		message = res.Status
+		if body, err := io.ReadAll(res.Body); err == nil {
+			if apiErr := parseAPIError(body); apiErr != "" {
+				message = fmt.Sprintf("%s: %s", res.Status, apiErr)
+			}
+		}
 	}
 	return &backend.CheckHealthResult{
 		Status:  status,
@@ -126,6 +202,22 @@ func (s *Service) CheckHealth(ctx context.Context, req *backend.CheckHealthReque
 	}, nil
 }
 
+// validateAPIEndpoint checks that the Cloud Monitoring API endpoint override is a well-formed https URL.
+// A path isn't allowed since request paths are always set from the root of the endpoint.
+func validateAPIEndpoint(apiEndpoint string) error {
+	u, err := url.Parse(apiEndpoint)
+	if err != nil {
+		return fmt.Errorf("invalid API endpoint %q: %w", apiEndpoint, err)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("invalid API endpoint %q: expected an https URL such as https://monitoring.us-central1.rep.googleapis.com", apiEndpoint)
+	}
+	if strings.Trim(u.Path, "/") != "" || u.RawQuery != "" {
+		return fmt.Errorf("invalid API endpoint %q: the endpoint must not have a path or query", apiEndpoint)
+	}
+	return nil
+}
+
 type Service struct {
 	httpClientProvider httpclient.Provider
 	im                 instancemgmt.InstanceManager
@@ -149,8 +241,18 @@ type datasourceInfo struct {
 	defaultProject     string
 	clientEmail        string
 	tokenUri           string
+	targetPrincipal    string
+	apiEndpoint        string
+	quotaProject       string
+	minAlignmentPeriod time.Duration
 	services           map[string]datasourceService
+	labelKeysCache     *localcache.CacheService
+	descriptorCache    *localcache.CacheService
+	// access tokens of the service account, shared by the routes and queries of the instance
+	jwtTokens *jwtTokenCache
 
+	// path of an application default credentials file used instead of the stored private key
+	credentialsFilePath     string
 	decryptedSecureJSONData map[string]string
 }
 
@@ -159,7 +261,7 @@ type datasourceService struct {
 	client *http.Client
 }
 
-func newInstanceSettings(httpClientProvider httpclient.Provider) datasource.InstanceFactoryFunc {
+func newInstanceSettings(httpClientProvider httpclient.Provider, credentialsFilesDir string) datasource.InstanceFactoryFunc {
 	return func(settings backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
 		var jsonData map[string]interface{}
 		err := json.Unmarshal(settings.JSONData, &jsonData)
@@ -187,6 +289,49 @@ func newInstanceSettings(httpClientProvider httpclient.Provider) datasource.Inst
 			tokenUri = jsonData["tokenUri"].(string)
 		}
 
+		var targetPrincipal string
+		if jsonData["targetPrincipal"] != nil {
+			targetPrincipal = jsonData["targetPrincipal"].(string)
+		}
+
+		var apiEndpoint string
+		if jsonData["apiEndpoint"] != nil {
+			apiEndpoint = jsonData["apiEndpoint"].(string)
+		}
+		if apiEndpoint != "" {
+			if err := validateAPIEndpoint(apiEndpoint); err != nil {
+				return nil, err
+			}
+		}
+
+		var quotaProject string
+		if jsonData["quotaProject"] != nil {
+			quotaProject = jsonData["quotaProject"].(string)
+		}
+
+		var credentialsFilePath string
+		if jsonData["credentialsFilePath"] != nil {
+			credentialsFilePath = jsonData["credentialsFilePath"].(string)
+		}
+		if credentialsFilePath != "" {
+			credentialsFilePath, err = resolveCredentialsFilePath(credentialsFilesDir, credentialsFilePath)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		var minAlignmentPeriod time.Duration
+		if jsonData["minAlignmentPeriod"] != nil {
+			value, ok := jsonData["minAlignmentPeriod"].(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid minAlignmentPeriod %v: expected a duration string such as 15s", jsonData["minAlignmentPeriod"])
+			}
+			minAlignmentPeriod, err = parseMinAlignmentPeriod(value)
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		dsInfo := &datasourceInfo{
 			id:                      settings.ID,
 			updated:                 settings.Updated,
@@ -195,8 +340,16 @@ func newInstanceSettings(httpClientProvider httpclient.Provider) datasource.Inst
 			defaultProject:          defaultProject,
 			clientEmail:             clientEmail,
 			tokenUri:                tokenUri,
+			targetPrincipal:         targetPrincipal,
+			apiEndpoint:             apiEndpoint,
+			quotaProject:            quotaProject,
+			minAlignmentPeriod:      minAlignmentPeriod,
+			credentialsFilePath:     credentialsFilePath,
 			decryptedSecureJSONData: settings.DecryptedSecureJSONData,
 			services:                map[string]datasourceService{},
+			labelKeysCache:          localcache.New(labelKeysCacheTTL, 2*labelKeysCacheTTL),
+			descriptorCache:         localcache.New(descriptorCacheTTL, 2*descriptorCacheTTL),
+			jwtTokens:               newJWTTokenCache(),
 		}
 
 		opts, err := settings.HTTPClientOptions()
@@ -209,8 +362,12 @@ func newInstanceSettings(httpClientProvider httpclient.Provider) datasource.Inst
 			if err != nil {
 				return nil, err
 			}
+			serviceURL := info.url
+			if name == cloudMonitor && apiEndpoint != "" {
+				serviceURL = strings.TrimSuffix(apiEndpoint, "/")
+			}
 			dsInfo.services[name] = datasourceService{
-				url:    info.url,
+				url:    serviceURL,
 				client: client,
 			}
 		}
@@ -254,27 +411,104 @@ func (s *Service) QueryData(ctx context.Context, req *backend.QueryDataRequest)
 func (s *Service) executeTimeSeriesQuery(ctx context.Context, logger log.Logger, req *backend.QueryDataRequest, dsInfo datasourceInfo) (
 	*backend.QueryDataResponse, error) {
 	resp := backend.NewQueryDataResponse()
-	queryExecutors, err := s.buildQueryExecutors(logger, req)
+	queryExecutors, err := s.buildQueryExecutors(logger, req, dsInfo)
 	if err != nil {
 		return resp, err
 	}
 
-	for _, queryExecutor := range queryExecutors {
-		queryRes, dr, executedQueryString, err := queryExecutor.run(ctx, req, s, dsInfo, s.tracer)
-		if err != nil {
-			return resp, err
+	// the executors run concurrently, every executor writes its result to its own slot so the
+	// responses can be assembled in a deterministic order afterwards
+	results := make([]*backend.DataResponse, len(queryExecutors))
+	slots := make(chan struct{}, maxConcurrentQueries)
+	var wg sync.WaitGroup
+	for i, queryExecutor := range queryExecutors {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			results[i] = &backend.DataResponse{Error: ctx.Err()}
+			continue
 		}
-		err = queryExecutor.parseResponse(queryRes, dr, executedQueryString)
-		if err != nil {
-			queryRes.Error = err
+
+		wg.Add(1)
+		go func(i int, queryExecutor cloudMonitoringQueryExecutor) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			results[i] = s.runQueryExecutor(ctx, logger, req, dsInfo, queryExecutor)
+		}(i, queryExecutor)
+	}
+	wg.Wait()
+
+	for i, queryExecutor := range queryExecutors {
+		queryRes := results[i]
+
+		// queries spanning multiple projects have one executor per project, merge their frames
+		if existing, ok := resp.Responses[queryExecutor.getRefID()]; ok {
+			existing.Frames = append(existing.Frames, queryRes.Frames...)
+			if existing.Error == nil {
+				existing.Error = queryRes.Error
+			}
+			queryRes = &existing
 		}
 
 		resp.Responses[queryExecutor.getRefID()] = *queryRes
 	}
 
+	for _, res := range resp.Responses {
+		sortFrames(res.Frames)
+	}
+
 	return resp, nil
 }
 
+// sortFrames orders frames by their labels so legends don't reorder between refreshes. Frames with
+// the same labels, like the buckets of a distribution, keep their order.
+func sortFrames(frames data.Frames) {
+	if len(frames) < 2 {
+		return
+	}
+	sort.SliceStable(frames, func(i, j int) bool {
+		return frameLabelsKey(frames[i]) < frameLabelsKey(frames[j])
+	})
+}
+
+// frameLabelsKey returns the labels of the first labelled field of a frame, with the label keys sorted
+func frameLabelsKey(frame *data.Frame) string {
+	for _, field := range frame.Fields {
+		if len(field.Labels) > 0 {
+			return field.Labels.String()
+		}
+	}
+	return ""
+}
+
+// runQueryExecutor runs a single executor and parses its response. A failing query is reported in
+// its own response so it doesn't affect the other queries of the request.
+func (s *Service) runQueryExecutor(ctx context.Context, logger log.Logger, req *backend.QueryDataRequest,
+	dsInfo datasourceInfo, queryExecutor cloudMonitoringQueryExecutor) (queryRes *backend.DataResponse) {
+	start := time.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("Query panicked", "refId", queryExecutor.getRefID(), "correlationId", queryExecutor.getCorrelationID(), "error", r, "stack", log.Stack(1))
+			queryRes = &backend.DataResponse{Error: fmt.Errorf("query failed unexpectedly (correlation id %s)", queryExecutor.getCorrelationID())}
+			observeQuery(queryExecutor, start, true)
+		}
+	}()
+
+	queryRes, dr, executedQueryString, err := queryExecutor.run(ctx, req, s, dsInfo, s.tracer)
+	if err != nil {
+		queryRes = &backend.DataResponse{Error: err}
+	} else if err := queryExecutor.parseResponse(queryRes, dr, executedQueryString); err != nil {
+		queryRes.Error = err
+	}
+	observeQuery(queryExecutor, start, queryRes.Error != nil)
+	if queryRes.Error != nil {
+		logger.Error("Query failed", "refId", queryExecutor.getRefID(), "correlationId", queryExecutor.getCorrelationID(), "error", queryRes.Error)
+		queryRes.Error = fmt.Errorf("%w (correlation id %s)", queryRes.Error, queryExecutor.getCorrelationID())
+	}
+
+	return queryRes
+}
+
 func queryModel(query backend.DataQuery) (grafanaQuery, error) {
 	var rawQuery map[string]interface{}
 	err := json.Unmarshal(query.JSON, &rawQuery)
@@ -282,7 +516,8 @@ func queryModel(query backend.DataQuery) (grafanaQuery, error) {
 		return grafanaQuery{}, err
 	}
 
-	if rawQuery["metricQuery"] == nil {
+	// legacy queries have the metric query fields at the top level, SLO queries never do
+	if rawQuery["metricQuery"] == nil && rawQuery["sloQuery"] == nil {
 		// migrate legacy query
 		var mq metricQuery
 		err = json.Unmarshal(query.JSON, &mq)
@@ -290,9 +525,18 @@ func queryModel(query backend.DataQuery) (grafanaQuery, error) {
 			return grafanaQuery{}, err
 		}
 
+		var legacy struct {
+			ScopedVars scopedVars
+		}
+		err = json.Unmarshal(query.JSON, &legacy)
+		if err != nil {
+			return grafanaQuery{}, err
+		}
+
 		return grafanaQuery{
 			QueryType:   metricQueryType,
 			MetricQuery: mq,
+			ScopedVars:  legacy.ScopedVars,
 		}, nil
 	}
 
@@ -305,16 +549,21 @@ func queryModel(query backend.DataQuery) (grafanaQuery, error) {
 	return q, nil
 }
 
-func (s *Service) buildQueryExecutors(logger log.Logger, req *backend.QueryDataRequest) ([]cloudMonitoringQueryExecutor, error) {
+func (s *Service) buildQueryExecutors(logger log.Logger, req *backend.QueryDataRequest, dsInfo datasourceInfo) ([]cloudMonitoringQueryExecutor, error) {
 	var cloudMonitoringQueryExecutors []cloudMonitoringQueryExecutor
 	startTime := req.Queries[0].TimeRange.From
 	endTime := req.Queries[0].TimeRange.To
 	durationSeconds := int(endTime.Sub(startTime).Seconds())
+	maxDataPoints := req.Queries[0].MaxDataPoints
+	minAlignmentSeconds := defaultMinAlignmentSeconds
+	if dsInfo.minAlignmentPeriod > 0 {
+		minAlignmentSeconds = int(dsInfo.minAlignmentPeriod.Seconds())
+	}
 
 	for _, query := range req.Queries {
 		q, err := queryModel(query)
 		if err != nil {
-			return nil, fmt.Errorf("could not unmarshal CloudMonitoringQuery json: %w", err)
+			return nil, fmt.Errorf("%w: %v", ErrInvalidQuery, err)
 		}
 
 		q.MetricQuery.PreprocessorType = toPreprocessorType(q.MetricQuery.Preprocessor)
@@ -323,15 +572,39 @@ func (s *Service) buildQueryExecutors(logger log.Logger, req *backend.QueryDataR
 		params.Add("interval.startTime", startTime.UTC().Format(time.RFC3339))
 		params.Add("interval.endTime", endTime.UTC().Format(time.RFC3339))
 
+		// log lines of concurrent queries are told apart by the query's correlation ID
+		correlationID := newCorrelationID(query.RefID)
+		queryLogger := logger.New("correlationId", correlationID)
+
 		var queryInterface cloudMonitoringQueryExecutor
 		cmtsf := &cloudMonitoringTimeSeriesFilter{
-			RefID:    query.RefID,
-			GroupBys: []string{},
-			logger:   logger,
+			RefID:         query.RefID,
+			GroupBys:      []string{},
+			logger:        queryLogger,
+			correlationID: correlationID,
 		}
 		switch q.QueryType {
 		case metricQueryType:
+			q.MetricQuery.ProjectName, err = q.ScopedVars.interpolate(q.MetricQuery.ProjectName)
+			if err != nil {
+				return nil, fmt.Errorf("invalid project name: %w", err)
+			}
+			for i, projectName := range q.MetricQuery.ProjectNames {
+				q.MetricQuery.ProjectNames[i], err = q.ScopedVars.interpolate(projectName)
+				if err != nil {
+					return nil, fmt.Errorf("invalid project name: %w", err)
+				}
+			}
+			if len(q.MetricQuery.ProjectNames) > 0 {
+				q.MetricQuery.ProjectName = q.MetricQuery.ProjectNames[0]
+			}
+
 			if q.MetricQuery.EditorMode == mqlEditorMode {
+				q.MetricQuery.Query, err = q.ScopedVars.interpolate(q.MetricQuery.Query)
+				if err != nil {
+					return nil, fmt.Errorf("invalid MQL query: %w", err)
+				}
+
 				queryInterface = &cloudMonitoringTimeSeriesQuery{
 					RefID:       query.RefID,
 					ProjectName: q.MetricQuery.ProjectName,
@@ -340,30 +613,98 @@ func (s *Service) buildQueryExecutors(logger log.Logger, req *backend.QueryDataR
 					AliasBy:     q.MetricQuery.AliasBy,
 					timeRange:   req.Queries[0].TimeRange,
 					GraphPeriod: q.MetricQuery.GraphPeriod,
+					logger:      queryLogger,
+
+					debugRawResponse: q.MetricQuery.DebugRawResponse,
+					labelRenames:     q.MetricQuery.LabelRenames,
+					correlationID:    correlationID,
 				}
 			} else {
+				if q.MetricQuery.MetricType == "" {
+					return nil, fmt.Errorf("%w for query %s", ErrMissingMetricType, query.RefID)
+				}
+				q.MetricQuery.AlignmentPeriod, err = normalizeAlignmentPeriod(interpolateInterval(q.MetricQuery.AlignmentPeriod, query.Interval))
+				if err != nil {
+					return nil, err
+				}
+				if q.MetricQuery.SecondaryAlignmentPeriod != "" {
+					q.MetricQuery.SecondaryAlignmentPeriod, err = normalizeAlignmentPeriod(interpolateInterval(q.MetricQuery.SecondaryAlignmentPeriod, query.Interval))
+					if err != nil {
+						return nil, err
+					}
+				}
+				if err := validateGroupBys(q.MetricQuery.GroupBys); err != nil {
+					return nil, err
+				}
+				if err := validateGroupBys(q.MetricQuery.SecondaryGroupBys); err != nil {
+					return nil, err
+				}
+
 				cmtsf.AliasBy = q.MetricQuery.AliasBy
 				cmtsf.ProjectName = q.MetricQuery.ProjectName
+				cmtsf.MetricType = strings.TrimSpace(q.MetricQuery.MetricType)
 				cmtsf.GroupBys = append(cmtsf.GroupBys, q.MetricQuery.GroupBys...)
+				cmtsf.downsample = q.MetricQuery.Downsample
+				cmtsf.includeMetricTypeLabel = q.MetricQuery.IncludeMetricTypeLabel
+				cmtsf.debugRawResponse = q.MetricQuery.DebugRawResponse
+				cmtsf.labelRenames = q.MetricQuery.LabelRenames
+				switch q.MetricQuery.FillMissing {
+				case "", fillMissingNull, fillMissingConnected, fillMissingZero:
+					cmtsf.fillMissing = q.MetricQuery.FillMissing
+				default:
+					return nil, fmt.Errorf("%w %q, expected one of null, connected or zero", ErrInvalidFillMissing, q.MetricQuery.FillMissing)
+				}
+				cmtsf.defaultAligner = q.MetricQuery.PerSeriesAligner == ""
+				cmtsf.maxDataPoints = query.MaxDataPoints
 				if q.MetricQuery.View == "" {
 					q.MetricQuery.View = "FULL"
 				}
-				params.Add("filter", buildFilterString(q.MetricQuery.MetricType, q.MetricQuery.Filters))
+				filter, err := buildFilterString(q.MetricQuery.MetricType, q.MetricQuery.Filters, q.MetricQuery.CaseInsensitive, q.ScopedVars)
+				if err != nil {
+					return nil, err
+				}
+				params.Add("filter", filter)
 				params.Add("view", q.MetricQuery.View)
-				setMetricAggParams(&params, &q.MetricQuery, durationSeconds, query.Interval.Milliseconds())
+				cmtsf.alignmentPeriodClamped = setMetricAggParams(&params, &q.MetricQuery, durationSeconds, query.Interval.Milliseconds(), maxDataPoints, minAlignmentSeconds)
 				queryInterface = cmtsf
 			}
 		case sloQueryType:
+			for _, field := range []*string{&q.SloQuery.ProjectName, &q.SloQuery.ServiceId, &q.SloQuery.SloId} {
+				*field, err = q.ScopedVars.interpolate(*field)
+				if err != nil {
+					return nil, fmt.Errorf("invalid SLO query: %w", err)
+				}
+			}
 			cmtsf.AliasBy = q.SloQuery.AliasBy
 			cmtsf.ProjectName = q.SloQuery.ProjectName
 			cmtsf.Selector = q.SloQuery.SelectorName
 			cmtsf.Service = q.SloQuery.ServiceId
 			cmtsf.Slo = q.SloQuery.SloId
+			if len(q.SloQuery.LookbackPeriods) == 0 {
+				q.SloQuery.LookbackPeriods = []string{q.SloQuery.LookbackPeriod}
+			}
+			q.SloQuery.LookbackPeriod = q.SloQuery.LookbackPeriods[0]
+			cmtsf.Lookback = q.SloQuery.LookbackPeriod
+			if q.SloQuery.SelectorName == "select_slo_burn_rate" {
+				for _, lookbackPeriod := range q.SloQuery.LookbackPeriods {
+					if !lookbackPeriodRe.MatchString(lookbackPeriod) {
+						return nil, fmt.Errorf("%w %q for select_slo_burn_rate, expected a duration such as 1h or 30m", ErrInvalidLookbackPeriod, lookbackPeriod)
+					}
+				}
+			}
+			q.SloQuery.AlignmentPeriod, err = normalizeAlignmentPeriod(interpolateInterval(q.SloQuery.AlignmentPeriod, query.Interval))
+			if err != nil {
+				return nil, err
+			}
+			// the health selector returns a ratio, aligning it by rate or delta isn't meaningful
+			if q.SloQuery.SelectorName == "select_slo_health" && toPreprocessorType(q.SloQuery.Preprocessor) != PreprocessorTypeNone {
+				return nil, fmt.Errorf("invalid SLO query: the %s preprocessor can't be used with select_slo_health", q.SloQuery.Preprocessor)
+			}
 			params.Add("filter", buildSLOFilterExpression(q.SloQuery))
-			setSloAggParams(&params, &q.SloQuery, durationSeconds, query.Interval.Milliseconds())
+			cmtsf.alignmentPeriodClamped = setSloAggParams(&params, &q.SloQuery, durationSeconds, query.Interval.Milliseconds(), maxDataPoints, minAlignmentSeconds)
 			queryInterface = cmtsf
 		default:
-			panic(fmt.Sprintf("Unrecognized query type %q", q.QueryType))
+			return nil, fmt.Errorf("%w %q", ErrUnsupportedQueryType, q.QueryType)
 		}
 
 		target = params.Encode()
@@ -371,63 +712,205 @@ func (s *Service) buildQueryExecutors(logger log.Logger, req *backend.QueryDataR
 		cmtsf.Params = params
 
 		if setting.Env == setting.Dev {
-			logger.Debug("CloudMonitoring request", "params", params)
+			queryLogger.Debug("CloudMonitoring request", "params", params)
 		}
 
 		cloudMonitoringQueryExecutors = append(cloudMonitoringQueryExecutors, queryInterface)
+
+		// fan out to the remaining projects, sharing the RefID so the results end up in the same response
+		if q.QueryType == metricQueryType && len(q.MetricQuery.ProjectNames) > 1 {
+			for _, projectName := range q.MetricQuery.ProjectNames[1:] {
+				cloudMonitoringQueryExecutors = append(cloudMonitoringQueryExecutors, withProjectName(queryInterface, projectName))
+			}
+		}
+
+		// fan out to the remaining lookback periods of a burn rate, the RefIDs are suffixed with the
+		// lookback period so every window ends up in a response of its own
+		if q.QueryType == sloQueryType && q.SloQuery.SelectorName == "select_slo_burn_rate" && len(q.SloQuery.LookbackPeriods) > 1 {
+			cmtsf.RefID = lookbackRefID(query.RefID, q.SloQuery.LookbackPeriod)
+			for _, lookbackPeriod := range q.SloQuery.LookbackPeriods[1:] {
+				cloudMonitoringQueryExecutors = append(cloudMonitoringQueryExecutors, withLookbackPeriod(cmtsf, q.SloQuery, query.RefID, lookbackPeriod))
+			}
+		}
+	}
+
+	// the cache keys are computed before running the queries, which changes their params and MQL
+	for _, queryExecutor := range cloudMonitoringQueryExecutors {
+		switch e := queryExecutor.(type) {
+		case *cloudMonitoringTimeSeriesFilter:
+			e.cacheKey = e.computeCacheKey()
+		case *cloudMonitoringTimeSeriesQuery:
+			e.cacheKey = e.computeCacheKey()
+		}
 	}
 
 	return cloudMonitoringQueryExecutors, nil
 }
 
+// withProjectName returns a copy of the query executor targeting another project
+func withProjectName(queryExecutor cloudMonitoringQueryExecutor, projectName string) cloudMonitoringQueryExecutor {
+	switch e := queryExecutor.(type) {
+	case *cloudMonitoringTimeSeriesFilter:
+		c := *e
+		c.ProjectName = projectName
+		// params are mutated while paging, so every executor needs its own copy
+		c.Params = copyParams(e.Params)
+		return &c
+	case *cloudMonitoringTimeSeriesQuery:
+		c := *e
+		c.ProjectName = projectName
+		return &c
+	default:
+		return queryExecutor
+	}
+}
+
+// withLookbackPeriod returns a copy of the burn rate executor for another lookback period
+func withLookbackPeriod(e *cloudMonitoringTimeSeriesFilter, query sloQuery, refID string, lookbackPeriod string) *cloudMonitoringTimeSeriesFilter {
+	c := *e
+	c.RefID = lookbackRefID(refID, lookbackPeriod)
+	c.Lookback = lookbackPeriod
+	query.LookbackPeriod = lookbackPeriod
+	c.Params = copyParams(e.Params)
+	c.Params.Set("filter", buildSLOFilterExpression(query))
+	c.Target = c.Params.Encode()
+	return &c
+}
+
+func lookbackRefID(refID string, lookbackPeriod string) string {
+	return refID + "-" + lookbackPeriod
+}
+
+func copyParams(params url.Values) url.Values {
+	c := url.Values{}
+	for k, v := range params {
+		c[k] = append([]string{}, v...)
+	}
+	return c
+}
+
 func interpolateFilterWildcards(value string) string {
 	matches := strings.Count(value, "*")
 	switch {
 	case matches == 2 && strings.HasSuffix(value, "*") && strings.HasPrefix(value, "*"):
 		value = strings.ReplaceAll(value, "*", "")
-		value = fmt.Sprintf(`has_substring("%s")`, value)
+		value = fmt.Sprintf(`has_substring("%s")`, escapeFilterValue(value))
 	case matches == 1 && strings.HasPrefix(value, "*"):
 		value = strings.Replace(value, "*", "", 1)
-		value = fmt.Sprintf(`ends_with("%s")`, value)
+		value = fmt.Sprintf(`ends_with("%s")`, escapeFilterValue(value))
 	case matches == 1 && strings.HasSuffix(value, "*"):
 		value = reverse(strings.Replace(reverse(value), "*", "", 1))
-		value = fmt.Sprintf(`starts_with("%s")`, value)
+		value = fmt.Sprintf(`starts_with("%s")`, escapeFilterValue(value))
 	case matches != 0:
-		value = string(wildcardRegexRe.ReplaceAllFunc([]byte(value), func(in []byte) []byte {
-			return []byte(strings.Replace(string(in), string(in), `\\`+string(in), 1))
-		}))
-		value = strings.ReplaceAll(value, "*", ".*")
-		value = strings.ReplaceAll(value, `"`, `\\"`)
-		value = fmt.Sprintf(`monitoring.regex.full_match("^%s$")`, value)
+		value = fmt.Sprintf(`monitoring.regex.full_match("^%s$")`, wildcardsToRegex(value))
 	}
 
 	return value
 }
 
-func buildFilterString(metricType string, filterParts []string) string {
-	filterString := ""
-	for i, part := range filterParts {
-		mod := i % 4
-		switch {
-		case part == "AND":
-			filterString += " "
-		case mod == 2:
-			operator := filterParts[i-1]
-			switch {
-			case operator == "=~" || operator == "!=~":
-				filterString = reverse(strings.Replace(reverse(filterString), "~", "", 1))
-				filterString += fmt.Sprintf(`monitoring.regex.full_match("%s")`, part)
-			case strings.Contains(part, "*"):
-				filterString += interpolateFilterWildcards(part)
-			default:
-				filterString += fmt.Sprintf(`"%s"`, part)
+// interpolateCaseInsensitiveWildcards is like interpolateFilterWildcards, but always matches
+// using a case-insensitive regular expression
+func interpolateCaseInsensitiveWildcards(value string) string {
+	if !strings.Contains(value, "*") {
+		return value
+	}
+
+	return fmt.Sprintf(`monitoring.regex.full_match("(?i)^%s$")`, wildcardsToRegex(value))
+}
+
+func wildcardsToRegex(value string) string {
+	value = string(wildcardRegexRe.ReplaceAllFunc([]byte(value), func(in []byte) []byte {
+		return []byte(strings.Replace(string(in), string(in), `\\`+string(in), 1))
+	}))
+	value = strings.ReplaceAll(value, "*", ".*")
+	return strings.ReplaceAll(value, `"`, `\\"`)
+}
+
+// escapeFilterValue escapes backslashes and double quotes so the value can be safely
+// embedded in a double quoted string argument of a filter function
+func escapeFilterValue(value string) string {
+	return filterValueEscaper.Replace(value)
+}
+
+// buildFilterString builds the monitoring filter from the metric type and the filter parts.
+// Filter parts come in groups of key, operator and value, joined by AND or OR. Clauses joined
+// by OR are wrapped in parentheses, e.g. (zone="a" OR zone="b") instance="c". When caseInsensitive
+// is set, wildcard values are matched regardless of case. A filter value that references a
+// multi-value template variable is expanded to an OR group with a clause per value.
+func buildFilterString(metricType string, filterParts []string, caseInsensitive bool, vars scopedVars) (string, error) {
+	// stray whitespace, e.g. from copy pasting, would make the filter match nothing
+	metricType = strings.TrimSpace(metricType)
+
+	var expressions []string
+	var orGroup []string
+	for i := 0; i < len(filterParts); i += 4 {
+		// a clause can be negated by prefixing it with a NOT token
+		negated := filterParts[i] == "NOT"
+		if negated {
+			i++
+		}
+		if i+2 >= len(filterParts) {
+			break
+		}
+
+		key, operator, value := strings.TrimSpace(filterParts[i]), filterParts[i+1], strings.TrimSpace(filterParts[i+2])
+		values := []string{value}
+		if multiValues, ok := vars.multiValues(value); ok && (operator == "=" || operator == "=~") {
+			values = multiValues
+		}
+		var clauses []string
+		for _, value := range values {
+			clause, err := buildFilterClause(key, operator, value, caseInsensitive)
+			if err != nil {
+				return "", err
 			}
-		default:
-			filterString += part
+			clauses = append(clauses, clause)
 		}
+		if negated {
+			clauses = []string{"NOT " + joinFilterClauses(clauses)}
+		}
+		orGroup = append(orGroup, clauses...)
+		if i+3 < len(filterParts) && filterParts[i+3] == "OR" {
+			continue
+		}
+
+		expressions = append(expressions, joinFilterClauses(orGroup))
+		orGroup = nil
+	}
+	if len(orGroup) > 0 {
+		expressions = append(expressions, joinFilterClauses(orGroup))
 	}
 
-	return strings.Trim(fmt.Sprintf(`metric.type="%s" %s`, metricType, filterString), " ")
+	return strings.Trim(fmt.Sprintf(`metric.type="%s" %s`, metricType, strings.Join(expressions, " ")), " "), nil
+}
+
+func buildFilterClause(key string, operator string, value string, caseInsensitive bool) (string, error) {
+	switch {
+	case key == groupIDFilterKey && (operator == "=" || operator == "!="):
+		// group ids are exact identifiers, they're never matched as wildcards
+		return fmt.Sprintf(`%s%s"%s"`, key, operator, escapeFilterValue(value)), nil
+	case numericComparisonOperators[operator]:
+		// ParseFloat would also accept NaN, Inf and hex floats, which aren't valid in a filter
+		if !decimalNumberRe.MatchString(value) {
+			return "", fmt.Errorf("invalid filter %s%s%s: the %s operator requires a numeric value", key, operator, value, operator)
+		}
+		return key + operator + value, nil
+	case operator == "=~" || operator == "!=~":
+		return key + strings.Replace(operator, "~", "", 1) + fmt.Sprintf(`monitoring.regex.full_match("%s")`, escapeFilterValue(value)), nil
+	case strings.Contains(value, "*") && caseInsensitive:
+		return key + operator + interpolateCaseInsensitiveWildcards(value), nil
+	case strings.Contains(value, "*"):
+		return key + operator + interpolateFilterWildcards(value), nil
+	default:
+		return fmt.Sprintf(`%s%s"%s"`, key, operator, value), nil
+	}
+}
+
+func joinFilterClauses(clauses []string) string {
+	if len(clauses) == 1 {
+		return clauses[0]
+	}
+	return "(" + strings.Join(clauses, " OR ") + ")"
 }
 
 func buildSLOFilterExpression(q sloQuery) string {
@@ -440,7 +923,9 @@ func buildSLOFilterExpression(q sloQuery) string {
 	}
 }
 
-func setMetricAggParams(params *url.Values, query *metricQuery, durationSeconds int, intervalMs int64) {
+// setMetricAggParams sets the aggregation of a metric query. It returns whether the alignment
+// period was clamped to the maximum the API accepts.
+func setMetricAggParams(params *url.Values, query *metricQuery, durationSeconds int, intervalMs int64, maxDataPoints int64, minAlignmentSeconds int) bool {
 	if query.CrossSeriesReducer == "" {
 		query.CrossSeriesReducer = crossSeriesReducerDefault
 	}
@@ -449,29 +934,41 @@ func setMetricAggParams(params *url.Values, query *metricQuery, durationSeconds
 		query.PerSeriesAligner = perSeriesAlignerDefault
 	}
 
-	alignmentPeriod := calculateAlignmentPeriod(query.AlignmentPeriod, intervalMs, durationSeconds)
+	alignmentPeriod, clamped := calculateAlignmentPeriod(query.AlignmentPeriod, intervalMs, durationSeconds, maxDataPoints, minAlignmentSeconds)
 
 	// In case a preprocessor is defined, the preprocessor becomes the primary aggregation
 	// and the aggregation that is specified in the UI becomes the secondary aggregation
 	// Rules are specified in this issue: https://github.com/grafana/grafana/issues/30866
 	if query.PreprocessorType != PreprocessorTypeNone {
-		params.Add("secondaryAggregation.alignmentPeriod", alignmentPeriod)
+		if query.PerSeriesAligner != alignNone {
+			secondaryAlignmentPeriod := alignmentPeriod
+			if query.SecondaryAlignmentPeriod != "" {
+				var secondaryClamped bool
+				secondaryAlignmentPeriod, secondaryClamped = calculateAlignmentPeriod(query.SecondaryAlignmentPeriod, intervalMs, durationSeconds, maxDataPoints, minAlignmentSeconds)
+				clamped = clamped || secondaryClamped
+			}
+			params.Add("secondaryAggregation.alignmentPeriod", secondaryAlignmentPeriod)
+		}
 		params.Add("secondaryAggregation.crossSeriesReducer", query.CrossSeriesReducer)
 		params.Add("secondaryAggregation.perSeriesAligner", query.PerSeriesAligner)
 
 		primaryCrossSeriesReducer := crossSeriesReducerDefault
-		if len(query.GroupBys) > 0 {
+		switch {
+		case query.PrimaryCrossSeriesReducer != "":
+			primaryCrossSeriesReducer = query.PrimaryCrossSeriesReducer
+		case len(query.GroupBys) > 0:
 			primaryCrossSeriesReducer = query.CrossSeriesReducer
 		}
 		params.Add("aggregation.crossSeriesReducer", primaryCrossSeriesReducer)
 
-		aligner := "ALIGN_RATE"
-		if query.PreprocessorType == PreprocessorTypeDelta {
-			aligner = "ALIGN_DELTA"
-		}
-		params.Add("aggregation.perSeriesAligner", aligner)
+		params.Add("aggregation.perSeriesAligner", query.PreprocessorType.aligner())
 
-		for _, groupBy := range query.GroupBys {
+		// the secondary aggregation groups by the primary group bys unless it has its own
+		secondaryGroupBys := query.GroupBys
+		if len(query.SecondaryGroupBys) > 0 {
+			secondaryGroupBys = query.SecondaryGroupBys
+		}
+		for _, groupBy := range secondaryGroupBys {
 			params.Add("secondaryAggregation.groupByFields", groupBy)
 		}
 	} else {
@@ -479,25 +976,152 @@ func setMetricAggParams(params *url.Values, query *metricQuery, durationSeconds
 		params.Add("aggregation.perSeriesAligner", query.PerSeriesAligner)
 	}
 
-	params.Add("aggregation.alignmentPeriod", alignmentPeriod)
+	// raw points are returned unaligned, the API ignores the alignment period in that case
+	if query.PreprocessorType != PreprocessorTypeNone || query.PerSeriesAligner != alignNone {
+		params.Add("aggregation.alignmentPeriod", alignmentPeriod)
+	}
 
 	for _, groupBy := range query.GroupBys {
 		params.Add("aggregation.groupByFields", groupBy)
 	}
+
+	return clamped
 }
 
-func setSloAggParams(params *url.Values, query *sloQuery, durationSeconds int, intervalMs int64) {
-	params.Add("aggregation.alignmentPeriod", calculateAlignmentPeriod(query.AlignmentPeriod, intervalMs, durationSeconds))
+// setSloAggParams sets the aggregation of an SLO query. Like for metric queries, a preprocessor
+// becomes the primary aggregation and the selector's aligner moves to the secondary aggregation.
+// It returns whether the alignment period was clamped to the maximum the API accepts.
+func setSloAggParams(params *url.Values, query *sloQuery, durationSeconds int, intervalMs int64, maxDataPoints int64, minAlignmentSeconds int) bool {
+	alignmentPeriod, clamped := calculateAlignmentPeriod(query.AlignmentPeriod, intervalMs, durationSeconds, maxDataPoints, minAlignmentSeconds)
+	params.Add("aggregation.alignmentPeriod", alignmentPeriod)
+
+	aligner := "ALIGN_NEXT_OLDER"
 	if query.SelectorName == "select_slo_health" {
-		params.Add("aggregation.perSeriesAligner", "ALIGN_MEAN")
-	} else {
-		params.Add("aggregation.perSeriesAligner", "ALIGN_NEXT_OLDER")
+		aligner = "ALIGN_MEAN"
+	}
+	if preprocessor := toPreprocessorType(query.Preprocessor); preprocessor != PreprocessorTypeNone {
+		params.Add("secondaryAggregation.alignmentPeriod", alignmentPeriod)
+		params.Add("secondaryAggregation.perSeriesAligner", aligner)
+		aligner = preprocessor.aligner()
+	}
+	params.Add("aggregation.perSeriesAligner", aligner)
+
+	return clamped
+}
+
+// parseMinAlignmentPeriod parses the datasource's minimum alignment period, e.g. 15s. The Cloud
+// Monitoring API doesn't accept alignment periods below one second.
+func parseMinAlignmentPeriod(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	period, err := time.ParseDuration(strings.TrimPrefix(value, "+"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid minAlignmentPeriod %q: %w", value, err)
+	}
+	if period < minAlignmentPeriodFloor {
+		return minAlignmentPeriodFloor, nil
+	}
+
+	return period.Truncate(time.Second), nil
+}
+
+// validateGroupBys makes sure every group by is a label key, a typo such as metric.labels.zone
+// would otherwise silently return ungrouped series
+func validateGroupBys(groupBys []string) error {
+	for _, groupBy := range groupBys {
+		// series can also be grouped by their resource type, which isn't a label
+		if groupBy == "resource.type" {
+			continue
+		}
+
+		valid := false
+		for _, prefix := range groupByPrefixes {
+			if strings.HasPrefix(groupBy, prefix) && len(groupBy) > len(prefix) {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf("%w %q, expected a label key starting with one of %s", ErrInvalidGroupBy, groupBy, strings.Join(groupByPrefixes, ", "))
+		}
+	}
+
+	return nil
+}
+
+// interpolateInterval replaces the $__interval and $__interval_ms variables, which the frontend
+// leaves for the backend to resolve, with the interval of the query
+func interpolateInterval(alignmentPeriod string, interval time.Duration) string {
+	if !strings.Contains(alignmentPeriod, "__interval") {
+		return alignmentPeriod
+	}
+
+	return strings.NewReplacer(
+		"${__interval_ms}", strconv.FormatInt(interval.Milliseconds(), 10)+"ms",
+		"$__interval_ms", strconv.FormatInt(interval.Milliseconds(), 10)+"ms",
+		"${__interval}", strconv.FormatFloat(interval.Seconds(), 'f', -1, 64)+"s",
+		"$__interval", strconv.FormatFloat(interval.Seconds(), 'f', -1, 64)+"s",
+	).Replace(alignmentPeriod)
+}
+
+// normalizeAlignmentPeriod accepts the auto alignment modes and explicit periods given in seconds
+// or milliseconds, such as +60s, 60s, 60 or 60000ms. Explicit periods are returned in the +60s form.
+func normalizeAlignmentPeriod(alignmentPeriod string) (string, error) {
+	switch alignmentPeriod {
+	case "", "grafana-auto", "auto", "cloud-monitoring-auto", "stackdriver-auto":
+		return alignmentPeriod, nil
+	}
+
+	matches := alignmentPeriodFormatRe.FindStringSubmatch(alignmentPeriod)
+	if matches == nil {
+		return "", fmt.Errorf("%w %q, expected a period such as +60s, 60s, 60 or 60000ms", ErrInvalidAlignmentPeriod, alignmentPeriod)
+	}
+
+	if matches[2] == "ms" {
+		milliseconds, err := strconv.ParseFloat(matches[1], 64)
+		if err != nil {
+			return "", fmt.Errorf("%w %q: %v", ErrInvalidAlignmentPeriod, alignmentPeriod, err)
+		}
+		return "+" + strconv.FormatFloat(milliseconds/1000, 'f', -1, 64) + "s", nil
 	}
+
+	return "+" + matches[1] + "s", nil
 }
 
-func calculateAlignmentPeriod(alignmentPeriod string, intervalMs int64, durationSeconds int) string {
+// calculateAlignmentPeriod resolves the auto alignment modes, these never go below
+// minAlignmentSeconds, which is 60s unless the datasource configures a lower minimum, and never
+// above the maximum the API accepts. It returns whether the period was clamped to that maximum.
+func calculateAlignmentPeriod(alignmentPeriod string, intervalMs int64, durationSeconds int, maxDataPoints int64, minAlignmentSeconds int) (string, bool) {
+	clamped := false
 	if alignmentPeriod == "grafana-auto" || alignmentPeriod == "" {
-		alignmentPeriodValue := int(math.Max(float64(intervalMs)/1000, 60.0))
+		alignmentPeriodValue := int(math.Max(float64(intervalMs)/1000, float64(minAlignmentSeconds)))
+		// make sure the panel doesn't receive more points than it's able to render
+		if maxDataPoints > 0 {
+			alignmentPeriodValue = int(math.Max(float64(alignmentPeriodValue), math.Ceil(float64(durationSeconds)/float64(maxDataPoints))))
+		}
+		alignmentPeriodValue, clamped = clampAlignmentPeriod(alignmentPeriodValue)
+		alignmentPeriod = "+" + strconv.Itoa(alignmentPeriodValue) + "s"
+	}
+
+	if alignmentPeriod == "auto" {
+		// the target is roughly one point per pixel, but never finer than the query interval or the minimum period
+		target := math.Max(float64(intervalMs)/1000, float64(minAlignmentSeconds))
+		if maxDataPoints > 0 {
+			target = math.Max(target, math.Ceil(float64(durationSeconds)/float64(maxDataPoints)))
+		}
+		alignmentPeriodValue := int(math.Ceil(target))
+		// sub-minute periods can only be reached with a lower minimum and are used as is
+		if alignmentPeriodValue >= autoAlignmentPeriods[0] {
+			for _, allowed := range autoAlignmentPeriods {
+				if allowed >= alignmentPeriodValue {
+					alignmentPeriodValue = allowed
+					break
+				}
+			}
+		}
+		alignmentPeriodValue, clamped = clampAlignmentPeriod(alignmentPeriodValue)
 		alignmentPeriod = "+" + strconv.Itoa(alignmentPeriodValue) + "s"
 	}
 
@@ -513,7 +1137,15 @@ func calculateAlignmentPeriod(alignmentPeriod string, intervalMs int64, duration
 		}
 	}
 
-	return alignmentPeriod
+	return alignmentPeriod, clamped
+}
+
+// clampAlignmentPeriod limits an alignment period to the maximum the API accepts
+func clampAlignmentPeriod(seconds int) (int, bool) {
+	if seconds > maxAlignmentPeriodSeconds {
+		return maxAlignmentPeriodSeconds, true
+	}
+	return seconds, false
 }
 
 func formatLegendKeys(metricType string, defaultMetricName string, labels map[string]string,
@@ -561,7 +1193,9 @@ func formatLegendKeys(metricType string, defaultMetricName string, labels map[st
 			return []byte(query.Selector)
 		}
 
-		return in
+		// Tokens that don't resolve to anything on this series are dropped
+		// rather than rendered literally.
+		return []byte{}
 	})
 
 	return string(result)
@@ -594,10 +1228,14 @@ func calcBucketBound(bucketOptions cloudMonitoringBucketOptions, n int) string {
 
 	switch {
 	case bucketOptions.LinearBuckets != nil:
-		bucketBound = strconv.FormatInt(bucketOptions.LinearBuckets.Offset+(bucketOptions.LinearBuckets.Width*int64(n-1)), 10)
+		bounds := computeLinearBounds(bucketOptions.LinearBuckets.Offset, bucketOptions.LinearBuckets.Width, n-1)
+		bucketBound = strconv.FormatFloat(bounds[n-1], 'f', -1, 64)
 	case bucketOptions.ExponentialBuckets != nil:
-		bucketBound = strconv.FormatInt(int64(bucketOptions.ExponentialBuckets.Scale*math.Pow(bucketOptions.ExponentialBuckets.GrowthFactor, float64(n-1))), 10)
+		// the lower bound of bucket n is the upper bound of bucket n-1
+		bounds := computeExponentialBounds(bucketOptions.ExponentialBuckets.GrowthFactor, bucketOptions.ExponentialBuckets.Scale, n-1)
+		bucketBound = strconv.FormatInt(int64(bounds[n-1]), 10)
 	case bucketOptions.ExplicitBuckets != nil:
+		// explicit bounds are used as they are
 		if n < len(bucketOptions.ExplicitBuckets.Bounds) {
 			bucketBound = fmt.Sprintf("%g", bucketOptions.ExplicitBuckets.Bounds[n])
 		} else {
@@ -608,6 +1246,34 @@ func calcBucketBound(bucketOptions cloudMonitoringBucketOptions, n int) string {
 	return bucketBound
 }
 
+// computeLinearBounds returns the numBuckets+1 bucket bounds of linear bucket options, bound i is
+// the upper bound of bucket i, bucket 0 being the underflow bucket
+// https://cloud.google.com/monitoring/api/ref_v3/rest/v3/TimeSeries#linear
+func computeLinearBounds(offset, width float64, numBuckets int) []float64 {
+	if numBuckets < 0 {
+		return nil
+	}
+	bounds := make([]float64, numBuckets+1)
+	for i := range bounds {
+		bounds[i] = offset + width*float64(i)
+	}
+	return bounds
+}
+
+// computeExponentialBounds returns the numBuckets+1 bucket bounds of exponential bucket options, bound i is
+// the upper bound of bucket i, bucket 0 being the underflow bucket
+// https://cloud.google.com/monitoring/api/ref_v3/rest/v3/TimeSeries#exponential
+func computeExponentialBounds(growthFactor, scale float64, numBuckets int) []float64 {
+	if numBuckets < 0 {
+		return nil
+	}
+	bounds := make([]float64, numBuckets+1)
+	for i := range bounds {
+		bounds[i] = scale * math.Pow(growthFactor, float64(i))
+	}
+	return bounds
+}
+
 func (s *Service) createRequest(logger log.Logger, dsInfo *datasourceInfo, proxyPass string, body io.Reader) (*http.Request, error) {
 	u, err := url.Parse(dsInfo.url)
 	if err != nil {
@@ -661,10 +1327,279 @@ func unmarshalResponse(logger log.Logger, res *http.Response) (cloudMonitoringRe
 		logger.Error("Failed to unmarshal CloudMonitoring response", "error", err, "status", res.Status, "body", string(body))
 		return cloudMonitoringResponse{}, fmt.Errorf("failed to unmarshal query response: %w", err)
 	}
+	data.RawResponse = body
 
 	return data, nil
 }
 
+// parseAPIError extracts the error message from a Google API error response body
+func parseAPIError(body []byte) string {
+	var apiErr apiErrorResponse
+	if err := json.Unmarshal(body, &apiErr); err != nil {
+		return ""
+	}
+	return apiErr.Error.Message
+}
+
+// addFieldDescription sets the metric description on the value fields, overly long descriptions are
+// truncated so they still fit in a tooltip
+func addFieldDescription(frames data.Frames, description string) {
+	if description == "" {
+		return
+	}
+
+	if runes := []rune(description); len(runes) > maxFieldDescriptionLength {
+		description = strings.TrimSpace(string(runes[:maxFieldDescriptionLength-1])) + "…"
+	}
+
+	for _, frame := range frames {
+		frame.Fields[1].Config.Description = description
+	}
+}
+
+// pointValueFieldType returns the type of the field the points of a series are read into. INT64
+// points are kept as int64, values beyond 2^53 would lose precision as float64. STRING points
+// are read into a string field, so they can be shown in tables.
+func pointValueFieldType(valueType string) data.FieldType {
+	switch valueType {
+	case "INT64":
+		return data.FieldTypeInt64
+	case "STRING":
+		return data.FieldTypeString
+	}
+	return data.FieldTypeFloat64
+}
+
+// newPointValueField returns the field the points of a series are read into. BOOL points are read
+// as 0 and 1, the field config maps them back to false and true so they can be shown as a state.
+func newPointValueField(valueType string, length int) *data.Field {
+	field := data.NewFieldFromFieldType(pointValueFieldType(valueType), length)
+	if valueType == "BOOL" {
+		min, max := data.ConfFloat64(0), data.ConfFloat64(1)
+		field.Config = &data.FieldConfig{
+			Min: &min,
+			Max: &max,
+			Mappings: data.ValueMappings{
+				data.ValueMapper{
+					"0": data.ValueMappingResult{Text: "false"},
+					"1": data.ValueMappingResult{Text: "true"},
+				},
+			},
+		}
+	}
+	return field
+}
+
+// pointValue returns the value of a point, typed for the field returned by pointValueFieldType
+func pointValue(valueType string, doubleValue float64, int64Value string, boolValue bool, stringValue string) (interface{}, error) {
+	switch valueType {
+	case "STRING":
+		return stringValue, nil
+	case "INT64":
+		value, err := strconv.ParseInt(int64Value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid INT64 point value %q: %w", int64Value, err)
+		}
+		return value, nil
+	case "BOOL":
+		if boolValue {
+			return float64(1), nil
+		}
+		return float64(0), nil
+	}
+	return doubleValue, nil
+}
+
+// renameFrameLabels renames the labels of the fields of the frames, labels without a rename are kept
+func renameFrameLabels(frames data.Frames, renames map[string]string) {
+	if len(renames) == 0 {
+		return
+	}
+	for _, frame := range frames {
+		for _, field := range frame.Fields {
+			if len(field.Labels) == 0 {
+				continue
+			}
+			// the labels can be shared by the frames of a distribution, so they're copied
+			renamed := make(data.Labels, len(field.Labels))
+			for key, value := range field.Labels {
+				if newKey, ok := renames[key]; ok && newKey != "" {
+					key = newKey
+				}
+				renamed[key] = value
+			}
+			field.Labels = renamed
+		}
+	}
+}
+
+// addRawResponse attaches the raw API response to the custom meta of the first frame, responses
+// longer than maxRawResponseLength are cut off
+func addRawResponse(frames data.Frames, rawResponse []byte) {
+	if len(frames) == 0 {
+		return
+	}
+
+	if len(rawResponse) > maxRawResponseLength {
+		rawResponse = rawResponse[:maxRawResponseLength]
+	}
+
+	if frames[0].Meta == nil {
+		frames[0].Meta = &data.FrameMeta{}
+	}
+	custom, ok := frames[0].Meta.Custom.(map[string]interface{})
+	if !ok {
+		custom = map[string]interface{}{}
+	}
+	// the custom meta can be shared with other frames, so it's copied before it's changed
+	withRaw := make(map[string]interface{}, len(custom)+1)
+	for k, v := range custom {
+		withRaw[k] = v
+	}
+	withRaw["rawResponse"] = string(rawResponse)
+	frames[0].Meta.Custom = withRaw
+}
+
+// downsampleFrames reduces frames with more rows than maxDataPoints by keeping the last row of
+// each bucket of consecutive rows, and warns on the first frame when any frame was reduced
+func downsampleFrames(frames data.Frames, maxDataPoints int64) data.Frames {
+	if maxDataPoints <= 0 {
+		return frames
+	}
+
+	maxRows := 0
+	for i, frame := range frames {
+		rows := frame.Rows()
+		if int64(rows) <= maxDataPoints {
+			continue
+		}
+		if rows > maxRows {
+			maxRows = rows
+		}
+
+		bucketSize := int(math.Ceil(float64(rows) / float64(maxDataPoints)))
+		fields := make([]*data.Field, 0, len(frame.Fields))
+		for _, field := range frame.Fields {
+			downsampled := data.NewFieldFromFieldType(field.Type(), 0)
+			downsampled.Name = field.Name
+			downsampled.Labels = field.Labels
+			downsampled.Config = field.Config
+			for end := bucketSize; end-bucketSize < rows; end += bucketSize {
+				downsampled.Append(field.At(int(math.Min(float64(end), float64(rows))) - 1))
+			}
+			fields = append(fields, downsampled)
+		}
+		frames[i].Fields = fields
+	}
+
+	if maxRows > 0 {
+		if frames[0].Meta == nil {
+			frames[0].Meta = &data.FrameMeta{}
+		}
+		frames[0].Meta.Notices = append(frames[0].Meta.Notices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text: fmt.Sprintf("Series were downsampled from up to %d to at most %d points. Increase the alignment period to see all points.",
+				maxRows, maxDataPoints),
+		})
+	}
+
+	return frames
+}
+
+// fillMissingPoints adds a row at every alignment period boundary without data, so graphs render a
+// gap instead of connecting the points around it. In the null mode the value fields become
+// nullable and the added rows are null, in the zero mode they are zero. The connected mode leaves
+// the frames as they are.
+func fillMissingPoints(frames data.Frames, mode string, alignmentPeriod time.Duration) data.Frames {
+	if alignmentPeriod <= 0 || (mode != fillMissingNull && mode != fillMissingZero) {
+		return frames
+	}
+
+	for i, frame := range frames {
+		if len(frame.Fields) < 2 || frame.Fields[0].Type() != data.FieldTypeTime {
+			continue
+		}
+
+		fields := make([]*data.Field, 0, len(frame.Fields))
+		for j, field := range frame.Fields {
+			fieldType := field.Type()
+			if j > 0 && mode == fillMissingNull {
+				fieldType = fieldType.NullableType()
+			}
+			filled := data.NewFieldFromFieldType(fieldType, 0)
+			filled.Name = field.Name
+			filled.Labels = field.Labels
+			filled.Config = field.Config
+			fields = append(fields, filled)
+		}
+
+		timeField := frame.Fields[0]
+		for row := 0; row < frame.Rows(); row++ {
+			if row > 0 {
+				next := timeField.At(row).(time.Time)
+				for missing := timeField.At(row - 1).(time.Time).Add(alignmentPeriod); missing.Before(next); missing = missing.Add(alignmentPeriod) {
+					// the added value is the zero value of the field, null for nullable fields
+					for _, field := range fields {
+						field.Extend(1)
+					}
+					fields[0].Set(fields[0].Len()-1, missing)
+				}
+			}
+			for j, field := range frame.Fields {
+				fields[j].Extend(1)
+				if v, ok := field.ConcreteAt(row); ok {
+					fields[j].SetConcrete(fields[j].Len()-1, v)
+				}
+			}
+		}
+		frames[i].Fields = fields
+	}
+
+	return frames
+}
+
+// newCorrelationID returns an ID for a single execution of a query, the RefID followed by a short
+// random suffix
+func newCorrelationID(refID string) string {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return refID
+	}
+	return refID + "-" + hex.EncodeToString(suffix)
+}
+
+// buildCacheKey hashes the given parts into a deterministic key for the query cache
+func buildCacheKey(parts ...string) string {
+	hash := sha256.New()
+	for _, part := range parts {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// addTruncationNotice warns on the first frame that the API could only return part of the
+// series, e.g. when some of the data couldn't be read in time
+func addTruncationNotice(frames data.Frames, errs []apiStatus) {
+	if len(errs) == 0 || len(frames) == 0 {
+		return
+	}
+
+	messages := make([]string, 0, len(errs))
+	for _, e := range errs {
+		messages = append(messages, e.Message)
+	}
+
+	if frames[0].Meta == nil {
+		frames[0].Meta = &data.FrameMeta{}
+	}
+	frames[0].Meta.Notices = append(frames[0].Meta.Notices, data.Notice{
+		Severity: data.NoticeSeverityWarning,
+		Text: fmt.Sprintf("Results are incomplete, Cloud Monitoring could not return all series: %s. Narrow down the filters or the time range to see all series.",
+			strings.Join(messages, "; ")),
+	})
+}
+
 func addConfigData(frames data.Frames, dl string, unit string, period string) data.Frames {
 	for i := range frames {
 		if frames[i].Fields[1].Config == nil {
@@ -1,19 +1,31 @@
 package cloudmonitoring
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"path/filepath"
 	"reflect"
+	"regexp"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	gokitlog "github.com/go-kit/log"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/datasource"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
 
+	"github.com/grafana/grafana/pkg/infra/httpclient"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/infra/tracing"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -23,7 +35,7 @@ func TestCloudMonitoring(t *testing.T) {
 
 	t.Run("Parse migrated queries from frontend and build Google Cloud Monitoring API queries", func(t *testing.T) {
 		t.Run("and query has no aggregation set", func(t *testing.T) {
-			qes, err := service.buildQueryExecutors(slog, baseReq())
+			qes, err := service.buildQueryExecutors(slog, baseReq(), datasourceInfo{})
 			require.NoError(t, err)
 			queries := getCloudMonitoringQueriesFromInterface(t, qes)
 
@@ -64,7 +76,7 @@ func TestCloudMonitoring(t *testing.T) {
 				"filters":    ["key", "=", "value", "AND", "key2", "=", "value2", "AND", "resource.type", "=", "another/resource/type"]
 			}`)
 
-			qes, err := service.buildQueryExecutors(slog, query)
+			qes, err := service.buildQueryExecutors(slog, query, datasourceInfo{})
 			require.NoError(t, err)
 			queries := getCloudMonitoringQueriesFromInterface(t, qes)
 			assert.Equal(t, 1, len(queries))
@@ -87,16 +99,45 @@ func TestCloudMonitoring(t *testing.T) {
 			verifyDeepLink(t, dl, expectedTimeSelection, expectedTimeSeriesFilter)
 		})
 
+		t.Run("and query has resource label filters", func(t *testing.T) {
+			query := baseReq()
+			query.Queries[0].JSON = json.RawMessage(`{
+				"metricType": "a/metric/type",
+				"filters":    ["resource.label.zone", "=", "us-central1-a"]
+			}`)
+
+			qes, err := service.buildQueryExecutors(slog, query, datasourceInfo{})
+			require.NoError(t, err)
+			queries := getCloudMonitoringQueriesFromInterface(t, qes)
+			assert.Equal(t, `metric.type="a/metric/type" resource.label.zone="us-central1-a"`, queries[0].Params["filter"][0])
+
+			// assign resource type to query parameters to be included in the deep link filter
+			// in the actual workflow this information comes from the response of the Monitoring API
+			queries[0].Params.Set("resourceType", "a/resource/type")
+			dl := queries[0].buildDeepLink()
+
+			expectedTimeSelection := map[string]string{
+				"timeRange": "custom",
+				"start":     "2018-03-15T13:00:00Z",
+				"end":       "2018-03-15T13:34:00Z",
+			}
+			expectedTimeSeriesFilter := map[string]interface{}{
+				"filter": `resource.type="a/resource/type" metric.type="a/metric/type" resource.label.zone="us-central1-a"`,
+			}
+			verifyDeepLink(t, dl, expectedTimeSelection, expectedTimeSeriesFilter)
+		})
+
 		t.Run("and alignmentPeriod is set to grafana-auto", func(t *testing.T) {
 			t.Run("and IntervalMS is larger than 60000", func(t *testing.T) {
 				req := baseReq()
 				req.Queries[0].Interval = 1000000 * time.Millisecond
 				req.Queries[0].JSON = json.RawMessage(`{
+					"metricType": "a/metric/type",
 					"alignmentPeriod": "grafana-auto",
 					"filters":    ["key", "=", "value", "AND", "key2", "=", "value2"]
 				}`)
 
-				qes, err := service.buildQueryExecutors(slog, req)
+				qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
 				require.NoError(t, err)
 				queries := getCloudMonitoringQueriesFromInterface(t, qes)
 				assert.Equal(t, `+1000s`, queries[0].Params["aggregation.alignmentPeriod"][0])
@@ -120,11 +161,12 @@ func TestCloudMonitoring(t *testing.T) {
 				req := baseReq()
 				req.Queries[0].Interval = 30000 * time.Millisecond
 				req.Queries[0].JSON = json.RawMessage(`{
+					"metricType": "a/metric/type",
 					"alignmentPeriod": "grafana-auto",
 					"filters":    ["key", "=", "value", "AND", "key2", "=", "value2"]
 				}`)
 
-				qes, err := service.buildQueryExecutors(slog, req)
+				qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
 				require.NoError(t, err)
 				queries := getCloudMonitoringQueriesFromInterface(t, qes)
 				assert.Equal(t, `+60s`, queries[0].Params["aggregation.alignmentPeriod"][0])
@@ -144,6 +186,144 @@ func TestCloudMonitoring(t *testing.T) {
 				}
 				verifyDeepLink(t, dl, expectedTimeSelection, expectedTimeSeriesFilter)
 			})
+			t.Run("and MaxDataPoints requires a coarser period than IntervalMS", func(t *testing.T) {
+				req := baseReq()
+				req.Queries[0].Interval = 60000 * time.Millisecond
+				req.Queries[0].MaxDataPoints = 100
+				req.Queries[0].TimeRange.To = req.Queries[0].TimeRange.From.Add(24 * time.Hour)
+				req.Queries[0].JSON = json.RawMessage(`{
+					"metricType": "a/metric/type",
+					"alignmentPeriod": "grafana-auto",
+					"filters":    ["key", "=", "value", "AND", "key2", "=", "value2"]
+				}`)
+
+				qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+				require.NoError(t, err)
+				queries := getCloudMonitoringQueriesFromInterface(t, qes)
+				assert.Equal(t, `+864s`, queries[0].Params["aggregation.alignmentPeriod"][0])
+			})
+			t.Run("and MaxDataPoints allows a finer period than IntervalMS", func(t *testing.T) {
+				req := baseReq()
+				req.Queries[0].Interval = 1000000 * time.Millisecond
+				req.Queries[0].MaxDataPoints = 1000
+				req.Queries[0].JSON = json.RawMessage(`{
+					"metricType": "a/metric/type",
+					"alignmentPeriod": "grafana-auto",
+					"filters":    ["key", "=", "value", "AND", "key2", "=", "value2"]
+				}`)
+
+				qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+				require.NoError(t, err)
+				queries := getCloudMonitoringQueriesFromInterface(t, qes)
+				assert.Equal(t, `+1000s`, queries[0].Params["aggregation.alignmentPeriod"][0])
+			})
+		})
+
+		t.Run("and the datasource has a lower minimum alignment period", func(t *testing.T) {
+			dsInfo := datasourceInfo{minAlignmentPeriod: 15 * time.Second}
+
+			for _, alignmentPeriod := range []string{"grafana-auto", "auto"} {
+				req := baseReq()
+				req.Queries[0].Interval = 10 * time.Second
+				req.Queries[0].MaxDataPoints = 1000
+				req.Queries[0].JSON = json.RawMessage(fmt.Sprintf(`{
+					"metricType": "a/metric/type",
+					"alignmentPeriod": %q
+				}`, alignmentPeriod))
+
+				qes, err := service.buildQueryExecutors(slog, req, dsInfo)
+				require.NoError(t, err)
+				queries := getCloudMonitoringQueriesFromInterface(t, qes)
+				assert.Equal(t, `+15s`, queries[0].Params["aggregation.alignmentPeriod"][0], alignmentPeriod)
+			}
+		})
+
+		t.Run("and alignmentPeriod is set to auto", func(t *testing.T) {
+			tests := []struct {
+				name           string
+				timeRange      time.Duration
+				expectedPeriod string
+			}{
+				{"and range is two hours", 2 * time.Hour, `+60s`},
+				{"and range is 23 hours", 23 * time.Hour, `+120s`},
+				{"and range is 7 days", 7 * 24 * time.Hour, `+900s`},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					req := baseReq()
+					req.Queries[0].Interval = time.Second
+					req.Queries[0].MaxDataPoints = 1000
+					req.Queries[0].TimeRange.To = req.Queries[0].TimeRange.From.Add(tt.timeRange)
+					req.Queries[0].JSON = json.RawMessage(`{
+						"metricType": "a/metric/type",
+						"target": "target",
+						"alignmentPeriod": "auto"
+					}`)
+
+					qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+					require.NoError(t, err)
+					queries := getCloudMonitoringQueriesFromInterface(t, qes)
+					assert.Equal(t, tt.expectedPeriod, queries[0].Params["aggregation.alignmentPeriod"][0])
+				})
+			}
+
+			t.Run("and the interval is coarser than the data density target", func(t *testing.T) {
+				req := baseReq()
+				req.Queries[0].Interval = 250 * time.Second
+				req.Queries[0].MaxDataPoints = 1000
+				req.Queries[0].JSON = json.RawMessage(`{
+					"metricType": "a/metric/type",
+					"target": "target",
+					"alignmentPeriod": "auto"
+				}`)
+
+				qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+				require.NoError(t, err)
+				queries := getCloudMonitoringQueriesFromInterface(t, qes)
+				assert.Equal(t, `+300s`, queries[0].Params["aggregation.alignmentPeriod"][0])
+			})
+		})
+
+		t.Run("and the time range spans multiple years", func(t *testing.T) {
+			for _, alignmentPeriod := range []string{"grafana-auto", "auto"} {
+				t.Run(alignmentPeriod, func(t *testing.T) {
+					req := baseReq()
+					req.Queries[0].MaxDataPoints = 1
+					req.Queries[0].TimeRange.To = req.Queries[0].TimeRange.From.AddDate(5, 0, 0)
+					req.Queries[0].JSON = json.RawMessage(fmt.Sprintf(`{
+						"metricType": "a/metric/type",
+						"alignmentPeriod": %q
+					}`, alignmentPeriod))
+
+					qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+					require.NoError(t, err)
+					queries := getCloudMonitoringQueriesFromInterface(t, qes)
+					assert.Equal(t, `+62899200s`, queries[0].Params["aggregation.alignmentPeriod"][0])
+					assert.True(t, queries[0].alignmentPeriodClamped)
+
+					res := &backend.DataResponse{}
+					require.NoError(t, queries[0].parseResponse(res, cloudMonitoringResponse{}, ""))
+					require.Len(t, res.Frames, 1)
+					require.Len(t, res.Frames[0].Meta.Notices, 1)
+					assert.Equal(t, data.NoticeSeverityWarning, res.Frames[0].Meta.Notices[0].Severity)
+					assert.Contains(t, res.Frames[0].Meta.Notices[0].Text, "limited to the maximum of 62899200s")
+				})
+			}
+
+			t.Run("and the range is short the period isn't clamped", func(t *testing.T) {
+				req := baseReq()
+				req.Queries[0].MaxDataPoints = 1
+				req.Queries[0].JSON = json.RawMessage(`{
+					"metricType": "a/metric/type",
+					"alignmentPeriod": "grafana-auto"
+				}`)
+
+				qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+				require.NoError(t, err)
+				queries := getCloudMonitoringQueriesFromInterface(t, qes)
+				assert.Equal(t, `+2040s`, queries[0].Params["aggregation.alignmentPeriod"][0])
+				assert.False(t, queries[0].alignmentPeriodClamped)
+			})
 		})
 
 		t.Run("and alignmentPeriod is set to cloud-monitoring-auto", func(t *testing.T) { // legacy
@@ -154,11 +334,12 @@ func TestCloudMonitoring(t *testing.T) {
 				req.Queries[0].TimeRange.From = now.Add(-(time.Hour * 2))
 				req.Queries[0].TimeRange.To = now
 				req.Queries[0].JSON = json.RawMessage(`{
+					"metricType": "a/metric/type",
 					"target": "target",
 					"alignmentPeriod": "cloud-monitoring-auto"
 				}`)
 
-				qes, err := service.buildQueryExecutors(slog, req)
+				qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
 				require.NoError(t, err)
 				queries := getCloudMonitoringQueriesFromInterface(t, qes)
 				assert.Equal(t, `+60s`, queries[0].Params["aggregation.alignmentPeriod"][0])
@@ -169,11 +350,12 @@ func TestCloudMonitoring(t *testing.T) {
 				req.Queries[0].TimeRange.From = now.Add(-(time.Hour * 22))
 				req.Queries[0].TimeRange.To = now
 				req.Queries[0].JSON = json.RawMessage(`{
+					"metricType": "a/metric/type",
 					"target": "target",
 					"alignmentPeriod": "cloud-monitoring-auto"
 				}`)
 
-				qes, err := service.buildQueryExecutors(slog, req)
+				qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
 				require.NoError(t, err)
 				queries := getCloudMonitoringQueriesFromInterface(t, qes)
 				assert.Equal(t, `+60s`, queries[0].Params["aggregation.alignmentPeriod"][0])
@@ -184,11 +366,12 @@ func TestCloudMonitoring(t *testing.T) {
 				req.Queries[0].TimeRange.From = now.Add(-(time.Hour * 23))
 				req.Queries[0].TimeRange.To = now
 				req.Queries[0].JSON = json.RawMessage(`{
+					"metricType": "a/metric/type",
 					"target": "target",
 					"alignmentPeriod": "cloud-monitoring-auto"
 				}`)
 
-				qes, err := service.buildQueryExecutors(slog, req)
+				qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
 				require.NoError(t, err)
 				queries := getCloudMonitoringQueriesFromInterface(t, qes)
 				assert.Equal(t, `+300s`, queries[0].Params["aggregation.alignmentPeriod"][0])
@@ -199,11 +382,12 @@ func TestCloudMonitoring(t *testing.T) {
 				req.Queries[0].TimeRange.From = now
 				req.Queries[0].TimeRange.To = now.AddDate(0, 0, 7)
 				req.Queries[0].JSON = json.RawMessage(`{
+					"metricType": "a/metric/type",
 					"target": "target",
 					"alignmentPeriod": "cloud-monitoring-auto"
 				}`)
 
-				qes, err := service.buildQueryExecutors(slog, req)
+				qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
 				require.NoError(t, err)
 				queries := getCloudMonitoringQueriesFromInterface(t, qes)
 				assert.Equal(t, `+3600s`, queries[0].Params["aggregation.alignmentPeriod"][0])
@@ -218,11 +402,12 @@ func TestCloudMonitoring(t *testing.T) {
 				req.Queries[0].TimeRange.From = now.Add(-(time.Hour * 2))
 				req.Queries[0].TimeRange.To = now
 				req.Queries[0].JSON = json.RawMessage(`{
+					"metricType": "a/metric/type",
 					"target": "target",
 					"alignmentPeriod": "stackdriver-auto"
 				}`)
 
-				qes, err := service.buildQueryExecutors(slog, req)
+				qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
 				require.NoError(t, err)
 				queries := getCloudMonitoringQueriesFromInterface(t, qes)
 				assert.Equal(t, `+60s`, queries[0].Params["aggregation.alignmentPeriod"][0])
@@ -248,11 +433,12 @@ func TestCloudMonitoring(t *testing.T) {
 				req.Queries[0].TimeRange.From = now.Add(-(time.Hour * 22))
 				req.Queries[0].TimeRange.To = now
 				req.Queries[0].JSON = json.RawMessage(`{
+					"metricType": "a/metric/type",
 					"target": "target",
 					"alignmentPeriod": "stackdriver-auto"
 				}`)
 
-				qes, err := service.buildQueryExecutors(slog, req)
+				qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
 				require.NoError(t, err)
 				queries := getCloudMonitoringQueriesFromInterface(t, qes)
 				assert.Equal(t, `+60s`, queries[0].Params["aggregation.alignmentPeriod"][0])
@@ -278,11 +464,12 @@ func TestCloudMonitoring(t *testing.T) {
 				req.Queries[0].TimeRange.From = now.Add(-(time.Hour * 23))
 				req.Queries[0].TimeRange.To = now
 				req.Queries[0].JSON = json.RawMessage(`{
+					"metricType": "a/metric/type",
 					"target": "target",
 					"alignmentPeriod": "stackdriver-auto"
 				}`)
 
-				qes, err := service.buildQueryExecutors(slog, req)
+				qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
 				require.NoError(t, err)
 				queries := getCloudMonitoringQueriesFromInterface(t, qes)
 				assert.Equal(t, `+300s`, queries[0].Params["aggregation.alignmentPeriod"][0])
@@ -308,11 +495,12 @@ func TestCloudMonitoring(t *testing.T) {
 				req.Queries[0].TimeRange.From = now.AddDate(0, 0, -7)
 				req.Queries[0].TimeRange.To = now
 				req.Queries[0].JSON = json.RawMessage(`{
+					"metricType": "a/metric/type",
 					"target": "target",
 					"alignmentPeriod": "stackdriver-auto"
 				}`)
 
-				qes, err := service.buildQueryExecutors(slog, req)
+				qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
 				require.NoError(t, err)
 				queries := getCloudMonitoringQueriesFromInterface(t, qes)
 				assert.Equal(t, `+3600s`, queries[0].Params["aggregation.alignmentPeriod"][0])
@@ -339,10 +527,11 @@ func TestCloudMonitoring(t *testing.T) {
 				req := baseReq()
 				req.Queries[0].Interval = 1000
 				req.Queries[0].JSON = json.RawMessage(`{
+					"metricType": "a/metric/type",
 					"alignmentPeriod": "+600s"
 				}`)
 
-				qes, err := service.buildQueryExecutors(slog, req)
+				qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
 				require.NoError(t, err)
 				queries := getCloudMonitoringQueriesFromInterface(t, qes)
 				assert.Equal(t, `+600s`, queries[0].Params["aggregation.alignmentPeriod"][0])
@@ -362,6 +551,97 @@ func TestCloudMonitoring(t *testing.T) {
 				}
 				verifyDeepLink(t, dl, expectedTimeSelection, expectedTimeSeriesFilter)
 			})
+
+			t.Run("and alignment period is fractional", func(t *testing.T) {
+				req := baseReq()
+				req.Queries[0].JSON = json.RawMessage(`{
+					"metricType": "a/metric/type",
+					"alignmentPeriod": "+0.5s"
+				}`)
+
+				qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+				require.NoError(t, err)
+				queries := getCloudMonitoringQueriesFromInterface(t, qes)
+				assert.Equal(t, `+0.5s`, queries[0].Params["aggregation.alignmentPeriod"][0])
+
+				dl := queries[0].buildDeepLink()
+
+				expectedTimeSelection := map[string]string{
+					"timeRange": "custom",
+					"start":     "2018-03-15T13:00:00Z",
+					"end":       "2018-03-15T13:34:00Z",
+				}
+				expectedTimeSeriesFilter := map[string]interface{}{
+					"minAlignmentPeriod": `1s`,
+				}
+				verifyDeepLink(t, dl, expectedTimeSelection, expectedTimeSeriesFilter)
+			})
+		})
+
+		t.Run("and alignmentPeriod is not in the +NNNs form", func(t *testing.T) {
+			tests := []struct {
+				alignmentPeriod string
+				expected        string
+			}{
+				{alignmentPeriod: "60000ms", expected: "+60s"},
+				{alignmentPeriod: "1500ms", expected: "+1.5s"},
+				{alignmentPeriod: "60", expected: "+60s"},
+				{alignmentPeriod: "60s", expected: "+60s"},
+			}
+
+			for _, tt := range tests {
+				t.Run(tt.alignmentPeriod, func(t *testing.T) {
+					req := baseReq()
+					req.Queries[0].JSON = json.RawMessage(fmt.Sprintf(`{
+						"metricType": "a/metric/type",
+						"alignmentPeriod": %q
+					}`, tt.alignmentPeriod))
+
+					qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+					require.NoError(t, err)
+					queries := getCloudMonitoringQueriesFromInterface(t, qes)
+					assert.Equal(t, tt.expected, queries[0].Params["aggregation.alignmentPeriod"][0])
+				})
+			}
+
+			t.Run("$__interval", func(t *testing.T) {
+				req := baseReq()
+				req.Queries[0].Interval = 2 * time.Minute
+				req.Queries[0].JSON = json.RawMessage(`{
+					"metricType": "a/metric/type",
+					"alignmentPeriod": "$__interval"
+				}`)
+
+				qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+				require.NoError(t, err)
+				queries := getCloudMonitoringQueriesFromInterface(t, qes)
+				assert.Equal(t, "+120s", queries[0].Params["aggregation.alignmentPeriod"][0])
+			})
+
+			t.Run("$__interval_ms", func(t *testing.T) {
+				req := baseReq()
+				req.Queries[0].Interval = 90 * time.Second
+				req.Queries[0].JSON = json.RawMessage(`{
+					"metricType": "a/metric/type",
+					"alignmentPeriod": "${__interval_ms}"
+				}`)
+
+				qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+				require.NoError(t, err)
+				queries := getCloudMonitoringQueriesFromInterface(t, qes)
+				assert.Equal(t, "+90s", queries[0].Params["aggregation.alignmentPeriod"][0])
+			})
+
+			t.Run("fast", func(t *testing.T) {
+				req := baseReq()
+				req.Queries[0].JSON = json.RawMessage(`{
+					"metricType": "a/metric/type",
+					"alignmentPeriod": "fast"
+				}`)
+
+				_, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+				assert.ErrorIs(t, err, ErrInvalidAlignmentPeriod)
+			})
 		})
 
 		t.Run("and query has aggregation mean set", func(t *testing.T) {
@@ -372,7 +652,7 @@ func TestCloudMonitoring(t *testing.T) {
 				"view":               "FULL"
 			}`)
 
-			qes, err := service.buildQueryExecutors(slog, req)
+			qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
 			require.NoError(t, err)
 			queries := getCloudMonitoringQueriesFromInterface(t, qes)
 
@@ -407,33 +687,21 @@ func TestCloudMonitoring(t *testing.T) {
 			verifyDeepLink(t, dl, expectedTimeSelection, expectedTimeSeriesFilter)
 		})
 
-		t.Run("and query has group bys", func(t *testing.T) {
+		t.Run("and query has a percentile cross series reducer", func(t *testing.T) {
 			req := baseReq()
 			req.Queries[0].JSON = json.RawMessage(`{
 				"metricType":         "a/metric/type",
-				"crossSeriesReducer": "REDUCE_NONE",
-				"groupBys":           ["metric.label.group1", "metric.label.group2"],
+				"crossSeriesReducer": "REDUCE_PERCENTILE_95",
 				"view":               "FULL"
 			}`)
 
-			qes, err := service.buildQueryExecutors(slog, req)
+			qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
 			require.NoError(t, err)
 			queries := getCloudMonitoringQueriesFromInterface(t, qes)
 
 			assert.Equal(t, 1, len(queries))
-			assert.Equal(t, "A", queries[0].RefID)
-			assert.Equal(t, "aggregation.alignmentPeriod=%2B60s&aggregation.crossSeriesReducer=REDUCE_NONE&aggregation.groupByFields=metric.label.group1&aggregation.groupByFields=metric.label.group2&aggregation.perSeriesAligner=ALIGN_MEAN&filter=metric.type%3D%22a%2Fmetric%2Ftype%22&interval.endTime=2018-03-15T13%3A34%3A00Z&interval.startTime=2018-03-15T13%3A00%3A00Z&view=FULL", queries[0].Target)
-			assert.Equal(t, 8, len(queries[0].Params))
-			assert.Equal(t, "2018-03-15T13:00:00Z", queries[0].Params["interval.startTime"][0])
-			assert.Equal(t, "2018-03-15T13:34:00Z", queries[0].Params["interval.endTime"][0])
-			assert.Equal(t, "ALIGN_MEAN", queries[0].Params["aggregation.perSeriesAligner"][0])
-			assert.Equal(t, "metric.label.group1", queries[0].Params["aggregation.groupByFields"][0])
-			assert.Equal(t, "metric.label.group2", queries[0].Params["aggregation.groupByFields"][1])
-			assert.Equal(t, "metric.type=\"a/metric/type\"", queries[0].Params["filter"][0])
-			assert.Equal(t, "FULL", queries[0].Params["view"][0])
+			assert.Equal(t, "REDUCE_PERCENTILE_95", queries[0].Params["aggregation.crossSeriesReducer"][0])
 
-			// assign resource type to query parameters to be included in the deep link filter
-			// in the actual workflow this information comes from the response of the Monitoring API
 			queries[0].Params.Set("resourceType", "a/resource/type")
 			dl := queries[0].buildDeepLink()
 
@@ -444,59 +712,59 @@ func TestCloudMonitoring(t *testing.T) {
 			}
 			expectedTimeSeriesFilter := map[string]interface{}{
 				"minAlignmentPeriod": `60s`,
+				"crossSeriesReducer": "REDUCE_PERCENTILE_95",
 				"perSeriesAligner":   "ALIGN_MEAN",
 				"filter":             "resource.type=\"a/resource/type\" metric.type=\"a/metric/type\"",
-				"groupByFields":      []interface{}{"metric.label.group1", "metric.label.group2"},
 			}
 			verifyDeepLink(t, dl, expectedTimeSelection, expectedTimeSeriesFilter)
 		})
-	})
 
-	t.Run("Parse queries from frontend and build Google Cloud Monitoring API queries", func(t *testing.T) {
-		fromStart := time.Date(2018, 3, 15, 13, 0, 0, 0, time.UTC).In(time.Local)
-		req := &backend.QueryDataRequest{
-			Queries: []backend.DataQuery{
-				{
-					RefID: "A",
-					TimeRange: backend.TimeRange{
-						From: fromStart,
-						To:   fromStart.Add(34 * time.Minute),
-					},
-					JSON: json.RawMessage(`{
-		 				 "queryType": "metrics",
-                         "metricQuery": {
-		 					"metricType": "a/metric/type",
-		 					"view":       "FULL",
-		 					"aliasBy":    "testalias",
-		 					"type":       "timeSeriesQuery",
-		 					"groupBys":   ["metric.label.group1", "metric.label.group2"]
-		 				}
-		 			}`),
-				},
-			},
-		}
-		t.Run("and query type is metrics", func(t *testing.T) {
-			qes, err := service.buildQueryExecutors(slog, req)
+		t.Run("and query has an interpolation aligner", func(t *testing.T) {
+			for _, aligner := range []string{"ALIGN_INTERPOLATE", "ALIGN_NEXT_OLDER"} {
+				req := baseReq()
+				req.Queries[0].JSON = json.RawMessage(fmt.Sprintf(`{
+					"metricType":       "a/metric/type",
+					"perSeriesAligner": %q,
+					"view":             "FULL"
+				}`, aligner))
+
+				qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+				require.NoError(t, err)
+				queries := getCloudMonitoringQueriesFromInterface(t, qes)
+
+				assert.Equal(t, 1, len(queries))
+				assert.Equal(t, aligner, queries[0].Params["aggregation.perSeriesAligner"][0])
+
+				dl := queries[0].buildDeepLink()
+
+				expectedTimeSelection := map[string]string{
+					"timeRange": "custom",
+					"start":     "2018-03-15T13:00:00Z",
+					"end":       "2018-03-15T13:34:00Z",
+				}
+				expectedTimeSeriesFilter := map[string]interface{}{
+					"perSeriesAligner": aligner,
+				}
+				verifyDeepLink(t, dl, expectedTimeSelection, expectedTimeSeriesFilter)
+			}
+		})
+
+		t.Run("and query has a group id filter", func(t *testing.T) {
+			req := baseReq()
+			req.Queries[0].JSON = json.RawMessage(`{
+				"metricType": "a/metric/type",
+				"filters":    ["group.id", "=", "1234567890"],
+				"view":       "FULL"
+			}`)
+
+			qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
 			require.NoError(t, err)
 			queries := getCloudMonitoringQueriesFromInterface(t, qes)
 
 			assert.Equal(t, 1, len(queries))
-			assert.Equal(t, "A", queries[0].RefID)
-			assert.Equal(t, "aggregation.alignmentPeriod=%2B60s&aggregation.crossSeriesReducer=REDUCE_NONE&aggregation.groupByFields=metric.label.group1&aggregation.groupByFields=metric.label.group2&aggregation.perSeriesAligner=ALIGN_MEAN&filter=metric.type%3D%22a%2Fmetric%2Ftype%22&interval.endTime=2018-03-15T13%3A34%3A00Z&interval.startTime=2018-03-15T13%3A00%3A00Z&view=FULL", queries[0].Target)
-			assert.Equal(t, 8, len(queries[0].Params))
-			assert.Equal(t, "metric.label.group1", queries[0].Params["aggregation.groupByFields"][0])
-			assert.Equal(t, "metric.label.group2", queries[0].Params["aggregation.groupByFields"][1])
-			assert.Equal(t, "2018-03-15T13:00:00Z", queries[0].Params["interval.startTime"][0])
-			assert.Equal(t, "2018-03-15T13:34:00Z", queries[0].Params["interval.endTime"][0])
-			assert.Equal(t, "ALIGN_MEAN", queries[0].Params["aggregation.perSeriesAligner"][0])
-			assert.Equal(t, "metric.type=\"a/metric/type\"", queries[0].Params["filter"][0])
-			assert.Equal(t, "FULL", queries[0].Params["view"][0])
-			assert.Equal(t, "testalias", queries[0].AliasBy)
-			assert.Equal(t, []string{"metric.label.group1", "metric.label.group2"}, queries[0].GroupBys)
+			assert.Equal(t, `metric.type="a/metric/type" group.id="1234567890"`, queries[0].Params["filter"][0])
 
-			// assign resource type to query parameters to be included in the deep link filter
-			// in the actual workflow this information comes from the response of the Monitoring API
-			queries[0].Params.Set("resourceType", "a/resource/type")
+			queries[0].Params.Set("resourceType", "gce_instance")
 			dl := queries[0].buildDeepLink()
 
 			expectedTimeSelection := map[string]string{
@@ -505,46 +773,208 @@ func TestCloudMonitoring(t *testing.T) {
 				"end":       "2018-03-15T13:34:00Z",
 			}
 			expectedTimeSeriesFilter := map[string]interface{}{
-				"minAlignmentPeriod": `60s`,
-				"perSeriesAligner":   "ALIGN_MEAN",
-				"filter":             "resource.type=\"a/resource/type\" metric.type=\"a/metric/type\"",
-				"groupByFields":      []interface{}{"metric.label.group1", "metric.label.group2"},
+				"filter": `resource.type="gce_instance" metric.type="a/metric/type" group.id="1234567890"`,
 			}
 			verifyDeepLink(t, dl, expectedTimeSelection, expectedTimeSeriesFilter)
+		})
 
+		t.Run("and query has a log-based metric type", func(t *testing.T) {
+			req := baseReq()
 			req.Queries[0].JSON = json.RawMessage(`{
-				"queryType": "metrics",
-				 "metricQuery": {
-					"editorMode":  "mql",
-					"projectName": "test-proj",
-					"query":       "test-query",
-					"aliasBy":     "test-alias"
-				},
-				"sloQuery": {}
+				"metricType": "logging.googleapis.com/user/my-app/error_count",
+				"view":       "FULL"
 			}`)
 
-			qes, err = service.buildQueryExecutors(slog, req)
+			qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
 			require.NoError(t, err)
-			tqueries := make([]*cloudMonitoringTimeSeriesQuery, 0)
-			for _, qi := range qes {
-				q, ok := qi.(*cloudMonitoringTimeSeriesQuery)
-				assert.True(t, ok)
-				tqueries = append(tqueries, q)
-			}
+			queries := getCloudMonitoringQueriesFromInterface(t, qes)
 
-			assert.Equal(t, 1, len(tqueries))
-			assert.Equal(t, "A", tqueries[0].RefID)
-			assert.Equal(t, "test-proj", tqueries[0].ProjectName)
-			assert.Equal(t, "test-query", tqueries[0].Query)
-			assert.Equal(t, "test-alias", tqueries[0].AliasBy)
-		})
+			assert.Equal(t, 1, len(queries))
+			assert.Equal(t, `metric.type="logging.googleapis.com/user/my-app/error_count"`, queries[0].Params["filter"][0])
 
-		t.Run("and query type is SLOs", func(t *testing.T) {
-			req.Queries[0].JSON = json.RawMessage(`{
-				"queryType": "slo",
-				 "sloQuery": {
-					"projectName":      "test-proj",
-					"alignmentPeriod":  "stackdriver-auto",
+			queries[0].Params.Set("resourceType", "k8s_container")
+			dl := queries[0].buildDeepLink()
+
+			expectedTimeSelection := map[string]string{
+				"timeRange": "custom",
+				"start":     "2018-03-15T13:00:00Z",
+				"end":       "2018-03-15T13:34:00Z",
+			}
+			expectedTimeSeriesFilter := map[string]interface{}{
+				"filter": `resource.type="k8s_container" metric.type="logging.googleapis.com/user/my-app/error_count"`,
+			}
+			verifyDeepLink(t, dl, expectedTimeSelection, expectedTimeSeriesFilter)
+		})
+
+		t.Run("and query has group bys", func(t *testing.T) {
+			req := baseReq()
+			req.Queries[0].JSON = json.RawMessage(`{
+				"metricType":         "a/metric/type",
+				"crossSeriesReducer": "REDUCE_NONE",
+				"groupBys":           ["metric.label.group1", "metric.label.group2"],
+				"view":               "FULL"
+			}`)
+
+			qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+			require.NoError(t, err)
+			queries := getCloudMonitoringQueriesFromInterface(t, qes)
+
+			assert.Equal(t, 1, len(queries))
+			assert.Equal(t, "A", queries[0].RefID)
+			assert.Equal(t, "aggregation.alignmentPeriod=%2B60s&aggregation.crossSeriesReducer=REDUCE_NONE&aggregation.groupByFields=metric.label.group1&aggregation.groupByFields=metric.label.group2&aggregation.perSeriesAligner=ALIGN_MEAN&filter=metric.type%3D%22a%2Fmetric%2Ftype%22&interval.endTime=2018-03-15T13%3A34%3A00Z&interval.startTime=2018-03-15T13%3A00%3A00Z&view=FULL", queries[0].Target)
+			assert.Equal(t, 8, len(queries[0].Params))
+			assert.Equal(t, "2018-03-15T13:00:00Z", queries[0].Params["interval.startTime"][0])
+			assert.Equal(t, "2018-03-15T13:34:00Z", queries[0].Params["interval.endTime"][0])
+			assert.Equal(t, "ALIGN_MEAN", queries[0].Params["aggregation.perSeriesAligner"][0])
+			assert.Equal(t, "metric.label.group1", queries[0].Params["aggregation.groupByFields"][0])
+			assert.Equal(t, "metric.label.group2", queries[0].Params["aggregation.groupByFields"][1])
+			assert.Equal(t, "metric.type=\"a/metric/type\"", queries[0].Params["filter"][0])
+			assert.Equal(t, "FULL", queries[0].Params["view"][0])
+
+			// assign resource type to query parameters to be included in the deep link filter
+			// in the actual workflow this information comes from the response of the Monitoring API
+			queries[0].Params.Set("resourceType", "a/resource/type")
+			dl := queries[0].buildDeepLink()
+
+			expectedTimeSelection := map[string]string{
+				"timeRange": "custom",
+				"start":     "2018-03-15T13:00:00Z",
+				"end":       "2018-03-15T13:34:00Z",
+			}
+			expectedTimeSeriesFilter := map[string]interface{}{
+				"minAlignmentPeriod": `60s`,
+				"perSeriesAligner":   "ALIGN_MEAN",
+				"filter":             "resource.type=\"a/resource/type\" metric.type=\"a/metric/type\"",
+				"groupByFields":      []interface{}{"metric.label.group1", "metric.label.group2"},
+			}
+			verifyDeepLink(t, dl, expectedTimeSelection, expectedTimeSeriesFilter)
+		})
+
+		t.Run("and query has resource label group bys", func(t *testing.T) {
+			req := baseReq()
+			req.Queries[0].JSON = json.RawMessage(`{
+				"metricType":         "a/metric/type",
+				"crossSeriesReducer": "REDUCE_SUM",
+				"groupBys":           ["resource.label.zone", "metric.label.group1"],
+				"view":               "FULL"
+			}`)
+
+			qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+			require.NoError(t, err)
+			queries := getCloudMonitoringQueriesFromInterface(t, qes)
+
+			assert.Equal(t, 1, len(queries))
+			assert.Equal(t, []string{"resource.label.zone", "metric.label.group1"}, queries[0].Params["aggregation.groupByFields"])
+
+			queries[0].Params.Set("resourceType", "a/resource/type")
+			dl := queries[0].buildDeepLink()
+
+			expectedTimeSelection := map[string]string{
+				"timeRange": "custom",
+				"start":     "2018-03-15T13:00:00Z",
+				"end":       "2018-03-15T13:34:00Z",
+			}
+			expectedTimeSeriesFilter := map[string]interface{}{
+				"crossSeriesReducer": "REDUCE_SUM",
+				"groupByFields":      []interface{}{"resource.label.zone", "metric.label.group1"},
+			}
+			verifyDeepLink(t, dl, expectedTimeSelection, expectedTimeSeriesFilter)
+		})
+	})
+
+	t.Run("Parse queries from frontend and build Google Cloud Monitoring API queries", func(t *testing.T) {
+		fromStart := time.Date(2018, 3, 15, 13, 0, 0, 0, time.UTC).In(time.Local)
+		req := &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{
+				{
+					RefID: "A",
+					TimeRange: backend.TimeRange{
+						From: fromStart,
+						To:   fromStart.Add(34 * time.Minute),
+					},
+					JSON: json.RawMessage(`{
+		 				 "queryType": "metrics",
+                         "metricQuery": {
+		 					"metricType": "a/metric/type",
+		 					"view":       "FULL",
+		 					"aliasBy":    "testalias",
+		 					"type":       "timeSeriesQuery",
+		 					"groupBys":   ["metric.label.group1", "metric.label.group2"]
+		 				}
+		 			}`),
+				},
+			},
+		}
+		t.Run("and query type is metrics", func(t *testing.T) {
+			qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+			require.NoError(t, err)
+			queries := getCloudMonitoringQueriesFromInterface(t, qes)
+
+			assert.Equal(t, 1, len(queries))
+			assert.Equal(t, "A", queries[0].RefID)
+			assert.Equal(t, "aggregation.alignmentPeriod=%2B60s&aggregation.crossSeriesReducer=REDUCE_NONE&aggregation.groupByFields=metric.label.group1&aggregation.groupByFields=metric.label.group2&aggregation.perSeriesAligner=ALIGN_MEAN&filter=metric.type%3D%22a%2Fmetric%2Ftype%22&interval.endTime=2018-03-15T13%3A34%3A00Z&interval.startTime=2018-03-15T13%3A00%3A00Z&view=FULL", queries[0].Target)
+			assert.Equal(t, 8, len(queries[0].Params))
+			assert.Equal(t, "metric.label.group1", queries[0].Params["aggregation.groupByFields"][0])
+			assert.Equal(t, "metric.label.group2", queries[0].Params["aggregation.groupByFields"][1])
+			assert.Equal(t, "2018-03-15T13:00:00Z", queries[0].Params["interval.startTime"][0])
+			assert.Equal(t, "2018-03-15T13:34:00Z", queries[0].Params["interval.endTime"][0])
+			assert.Equal(t, "ALIGN_MEAN", queries[0].Params["aggregation.perSeriesAligner"][0])
+			assert.Equal(t, "metric.type=\"a/metric/type\"", queries[0].Params["filter"][0])
+			assert.Equal(t, "FULL", queries[0].Params["view"][0])
+			assert.Equal(t, "testalias", queries[0].AliasBy)
+			assert.Equal(t, []string{"metric.label.group1", "metric.label.group2"}, queries[0].GroupBys)
+
+			// assign resource type to query parameters to be included in the deep link filter
+			// in the actual workflow this information comes from the response of the Monitoring API
+			queries[0].Params.Set("resourceType", "a/resource/type")
+			dl := queries[0].buildDeepLink()
+
+			expectedTimeSelection := map[string]string{
+				"timeRange": "custom",
+				"start":     "2018-03-15T13:00:00Z",
+				"end":       "2018-03-15T13:34:00Z",
+			}
+			expectedTimeSeriesFilter := map[string]interface{}{
+				"minAlignmentPeriod": `60s`,
+				"perSeriesAligner":   "ALIGN_MEAN",
+				"filter":             "resource.type=\"a/resource/type\" metric.type=\"a/metric/type\"",
+				"groupByFields":      []interface{}{"metric.label.group1", "metric.label.group2"},
+			}
+			verifyDeepLink(t, dl, expectedTimeSelection, expectedTimeSeriesFilter)
+
+			req.Queries[0].JSON = json.RawMessage(`{
+				"queryType": "metrics",
+				 "metricQuery": {
+					"editorMode":  "mql",
+					"projectName": "test-proj",
+					"query":       "test-query",
+					"aliasBy":     "test-alias"
+				},
+				"sloQuery": {}
+			}`)
+
+			qes, err = service.buildQueryExecutors(slog, req, datasourceInfo{})
+			require.NoError(t, err)
+			tqueries := make([]*cloudMonitoringTimeSeriesQuery, 0)
+			for _, qi := range qes {
+				q, ok := qi.(*cloudMonitoringTimeSeriesQuery)
+				assert.True(t, ok)
+				tqueries = append(tqueries, q)
+			}
+
+			assert.Equal(t, 1, len(tqueries))
+			assert.Equal(t, "A", tqueries[0].RefID)
+			assert.Equal(t, "test-proj", tqueries[0].ProjectName)
+			assert.Equal(t, "test-query", tqueries[0].Query)
+			assert.Equal(t, "test-alias", tqueries[0].AliasBy)
+		})
+
+		t.Run("and query type is SLOs", func(t *testing.T) {
+			req.Queries[0].JSON = json.RawMessage(`{
+				"queryType": "slo",
+				 "sloQuery": {
+					"projectName":      "test-proj",
+					"alignmentPeriod":  "stackdriver-auto",
 					"perSeriesAligner": "ALIGN_NEXT_OLDER",
 					"aliasBy":          "",
 					"selectorName":     "select_slo_health",
@@ -554,7 +984,7 @@ func TestCloudMonitoring(t *testing.T) {
 				"metricQuery": {}
 			}`)
 
-			qes, err := service.buildQueryExecutors(slog, req)
+			qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
 			require.NoError(t, err)
 			queries := getCloudMonitoringQueriesFromInterface(t, qes)
 
@@ -582,7 +1012,7 @@ func TestCloudMonitoring(t *testing.T) {
 				"metricQuery": {}
 			}`)
 
-			qes, err = service.buildQueryExecutors(slog, req)
+			qes, err = service.buildQueryExecutors(slog, req, datasourceInfo{})
 			require.NoError(t, err)
 			qqueries := getCloudMonitoringQueriesFromInterface(t, qes)
 			assert.Equal(t, "ALIGN_NEXT_OLDER", qqueries[0].Params["aggregation.perSeriesAligner"][0])
@@ -605,261 +1035,1296 @@ func TestCloudMonitoring(t *testing.T) {
 				"metricQuery": {}
 			}`)
 
-			qes, err = service.buildQueryExecutors(slog, req)
+			qes, err = service.buildQueryExecutors(slog, req, datasourceInfo{})
 			require.NoError(t, err)
 			qqqueries := getCloudMonitoringQueriesFromInterface(t, qes)
 			assert.Equal(t, `aggregation.alignmentPeriod=%2B60s&aggregation.perSeriesAligner=ALIGN_NEXT_OLDER&filter=select_slo_burn_rate%28%22projects%2Ftest-proj%2Fservices%2Ftest-service%2FserviceLevelObjectives%2Ftest-slo%22%2C+%221h%22%29&interval.endTime=2018-03-15T13%3A34%3A00Z&interval.startTime=2018-03-15T13%3A00%3A00Z`, qqqueries[0].Target)
-		})
-	})
 
-	t.Run("when interpolating filter wildcards", func(t *testing.T) {
-		t.Run("and wildcard is used in the beginning and the end of the word", func(t *testing.T) {
-			t.Run("and there's no wildcard in the middle of the word", func(t *testing.T) {
-				value := interpolateFilterWildcards("*-central1*")
-				assert.Equal(t, `has_substring("-central1")`, value)
-			})
-			t.Run("and there is a wildcard in the middle of the word", func(t *testing.T) {
-				value := interpolateFilterWildcards("*-cent*ral1*")
-				assert.False(t, strings.HasPrefix(value, `has_substring`))
-			})
-		})
+			burnRateDeepLink := qqqueries[0].buildDeepLink()
+			require.NotEmpty(t, burnRateDeepLink)
+			deepLinkURL, err := url.Parse(burnRateDeepLink)
+			require.NoError(t, err)
+			continueURL, err := url.Parse(deepLinkURL.Query().Get("continue"))
+			require.NoError(t, err)
+			assert.Equal(t, "/monitoring/services/test-service", continueURL.Path)
+			assert.Equal(t, "test-proj", continueURL.Query().Get("project"))
+			var burnRatePageState map[string]map[string]string
+			require.NoError(t, json.Unmarshal([]byte(continueURL.Query().Get("pageState")), &burnRatePageState))
+			assert.Equal(t, "projects/test-proj/services/test-service/serviceLevelObjectives/test-slo", burnRatePageState["slo"]["name"])
+			assert.Equal(t, "1h", burnRatePageState["slo"]["lookbackPeriod"])
+			assert.Equal(t, "2018-03-15T13:00:00Z", burnRatePageState["timeSelection"]["start"])
+
+			t.Run("and several lookback periods are set", func(t *testing.T) {
+				req.Queries[0].JSON = json.RawMessage(`{
+					"queryType": "slo",
+					"sloQuery": {
+						"projectName":      "test-proj",
+						"alignmentPeriod":  "stackdriver-auto",
+						"perSeriesAligner": "ALIGN_NEXT_OLDER",
+						"selectorName":     "select_slo_burn_rate",
+						"serviceId":        "test-service",
+						"sloId":            "test-slo",
+						"lookbackPeriods":  ["5m", "1h"]
+					}
+				}`)
 
-		t.Run("and wildcard is used in the beginning of the word", func(t *testing.T) {
-			t.Run("and there is not a wildcard elsewhere in the word", func(t *testing.T) {
-				value := interpolateFilterWildcards("*-central1")
-				assert.Equal(t, `ends_with("-central1")`, value)
-			})
-			t.Run("and there is a wildcard elsewhere in the word", func(t *testing.T) {
-				value := interpolateFilterWildcards("*-cent*al1")
-				assert.False(t, strings.HasPrefix(value, `ends_with`))
+				qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+				require.NoError(t, err)
+				queries := getCloudMonitoringQueriesFromInterface(t, qes)
+				require.Len(t, queries, 2)
+				assert.Equal(t, "A-5m", queries[0].RefID)
+				assert.Equal(t, "5m", queries[0].Lookback)
+				assert.Equal(t, `select_slo_burn_rate("projects/test-proj/services/test-service/serviceLevelObjectives/test-slo", "5m")`, queries[0].Params.Get("filter"))
+				assert.Equal(t, "A-1h", queries[1].RefID)
+				assert.Equal(t, "1h", queries[1].Lookback)
+				assert.Equal(t, `select_slo_burn_rate("projects/test-proj/services/test-service/serviceLevelObjectives/test-slo", "1h")`, queries[1].Params.Get("filter"))
+				assert.Equal(t, queries[1].Params.Encode(), queries[1].Target)
+				assert.Equal(t, queries[0].Params.Get("aggregation.alignmentPeriod"), queries[1].Params.Get("aggregation.alignmentPeriod"))
 			})
-		})
 
-		t.Run("and wildcard is used at the end of the word", func(t *testing.T) {
-			t.Run("and there is not a wildcard elsewhere in the word", func(t *testing.T) {
-				value := interpolateFilterWildcards("us-central*")
-				assert.Equal(t, `starts_with("us-central")`, value)
-			})
-			t.Run("and there is a wildcard elsewhere in the word", func(t *testing.T) {
-				value := interpolateFilterWildcards("*us-central*")
-				assert.False(t, strings.HasPrefix(value, `starts_with`))
-			})
-		})
+			for _, lookbackPeriod := range []string{"1hour", ""} {
+				req.Queries[0].JSON = json.RawMessage(fmt.Sprintf(`{
+					"queryType": "slo",
+					 "sloQuery": {
+						"projectName":      "test-proj",
+						"alignmentPeriod":  "stackdriver-auto",
+						"selectorName":     "select_slo_burn_rate",
+						"serviceId":        "test-service",
+						"sloId":            "test-slo",
+						"lookbackPeriod":   "%s"
+					},
+					"metricQuery": {}
+				}`, lookbackPeriod))
 
-		t.Run("and wildcard is used in the middle of the word", func(t *testing.T) {
-			t.Run("and there is only one wildcard", func(t *testing.T) {
-				value := interpolateFilterWildcards("us-ce*tral1-b")
-				assert.Equal(t, `monitoring.regex.full_match("^us\\-ce.*tral1\\-b$")`, value)
-			})
+				_, err = service.buildQueryExecutors(slog, req, datasourceInfo{})
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), "invalid lookback period")
+			}
 
-			t.Run("and there is more than one wildcard", func(t *testing.T) {
-				value := interpolateFilterWildcards("us-ce*tra*1-b")
-				assert.Equal(t, `monitoring.regex.full_match("^us\\-ce.*tra.*1\\-b$")`, value)
-			})
+			for _, selector := range []string{"select_slo_budget", "select_slo_budget_fraction"} {
+				req.Queries[0].JSON = json.RawMessage(fmt.Sprintf(`{
+					"queryType": "slo",
+					 "sloQuery": {
+						"projectName":      "test-proj",
+						"alignmentPeriod":  "stackdriver-auto",
+						"perSeriesAligner": "ALIGN_NEXT_OLDER",
+						"aliasBy":          "",
+						"selectorName":     "%s",
+						"serviceId":        "test-service",
+						"sloId":            "test-slo"
+					},
+					"metricQuery": {}
+				}`, selector))
+
+				qes, err = service.buildQueryExecutors(slog, req, datasourceInfo{})
+				require.NoError(t, err)
+				budgetQueries := getCloudMonitoringQueriesFromInterface(t, qes)
+				assert.Equal(t, "ALIGN_NEXT_OLDER", budgetQueries[0].Params["aggregation.perSeriesAligner"][0])
+				assert.Equal(t, selector+`("projects/test-proj/services/test-service/serviceLevelObjectives/test-slo")`, budgetQueries[0].Params["filter"][0])
+				assert.Equal(t, `aggregation.alignmentPeriod=%2B60s&aggregation.perSeriesAligner=ALIGN_NEXT_OLDER&filter=`+selector+`%28%22projects%2Ftest-proj%2Fservices%2Ftest-service%2FserviceLevelObjectives%2Ftest-slo%22%29&interval.endTime=2018-03-15T13%3A34%3A00Z&interval.startTime=2018-03-15T13%3A00%3A00Z`, budgetQueries[0].Target)
+			}
 		})
+	})
 
-		t.Run("and wildcard is used in the middle of the word and in the beginning of the word", func(t *testing.T) {
-			value := interpolateFilterWildcards("*s-ce*tral1-b")
-			assert.Equal(t, `monitoring.regex.full_match("^.*s\\-ce.*tral1\\-b$")`, value)
+	t.Run("when interpolating scoped template variables", func(t *testing.T) {
+		t.Run("the project name is resolved for a metric query", func(t *testing.T) {
+			req := baseReq()
+			req.Queries[0].JSON = json.RawMessage(`{
+				"queryType": "metrics",
+				"metricQuery": {
+					"projectName": "$project",
+					"metricType":  "a/metric/type"
+				},
+				"scopedVars": {
+					"project": {"text": "Prod", "value": "prod-proj"}
+				}
+			}`)
+
+			qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+			require.NoError(t, err)
+			queries := getCloudMonitoringQueriesFromInterface(t, qes)
+			assert.Equal(t, "prod-proj", queries[0].ProjectName)
 		})
 
-		t.Run("and wildcard is used in the middle of the word and in the ending of the word", func(t *testing.T) {
-			value := interpolateFilterWildcards("us-ce*tral1-*")
-			assert.Equal(t, `monitoring.regex.full_match("^us\\-ce.*tral1\\-.*$")`, value)
+		t.Run("the project name and query are resolved for an MQL query", func(t *testing.T) {
+			req := baseReq()
+			req.Queries[0].JSON = json.RawMessage(`{
+				"queryType": "metrics",
+				"metricQuery": {
+					"editorMode":  "mql",
+					"projectName": "${project}",
+					"query":       "fetch gce_instance | filter zone = '$zone'"
+				},
+				"scopedVars": {
+					"project": {"text": "Prod", "value": "prod-proj"},
+					"zone":    {"text": "us-east1-b", "value": "us-east1-b"}
+				}
+			}`)
+
+			qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+			require.NoError(t, err)
+			require.Len(t, qes, 1)
+			query, ok := qes[0].(*cloudMonitoringTimeSeriesQuery)
+			require.True(t, ok)
+			assert.Equal(t, "prod-proj", query.ProjectName)
+			assert.Equal(t, "fetch gce_instance | filter zone = 'us-east1-b'", query.Query)
 		})
 
-		t.Run("and no wildcard is used", func(t *testing.T) {
-			value := interpolateFilterWildcards("us-central1-a}")
-			assert.Equal(t, `us-central1-a}`, value)
-		})
+		t.Run("the project, service and SLO are resolved for an SLO query", func(t *testing.T) {
+			req := baseReq()
+			req.Queries[0].JSON = json.RawMessage(`{
+				"queryType": "slo",
+				"sloQuery": {
+					"projectName":  "$project",
+					"selectorName": "select_slo_health",
+					"serviceId":    "${service}",
+					"sloId":        "$slo"
+				},
+				"scopedVars": {
+					"project": {"text": "Prod", "value": "prod-proj"},
+					"service": {"text": "Checkout", "value": "checkout-svc"},
+					"slo":     {"text": "Availability", "value": "availability-slo"}
+				}
+			}`)
+
+			qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+			require.NoError(t, err)
+			queries := getCloudMonitoringQueriesFromInterface(t, qes)
+			assert.Equal(t, "prod-proj", queries[0].ProjectName)
+			assert.Equal(t, `select_slo_health("projects/prod-proj/services/checkout-svc/serviceLevelObjectives/availability-slo")`, queries[0].Params.Get("filter"))
+		})
+
+		t.Run("an unresolved variable in an SLO query returns an error", func(t *testing.T) {
+			req := baseReq()
+			req.Queries[0].JSON = json.RawMessage(`{
+				"queryType": "slo",
+				"sloQuery": {
+					"projectName":  "prod-proj",
+					"selectorName": "select_slo_health",
+					"serviceId":    "checkout-svc",
+					"sloId":        "$slo"
+				}
+			}`)
+
+			_, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "$slo")
+		})
+
+		t.Run("an unresolved variable returns an error", func(t *testing.T) {
+			req := baseReq()
+			req.Queries[0].JSON = json.RawMessage(`{
+				"queryType": "metrics",
+				"metricQuery": {
+					"projectName": "$project",
+					"metricType":  "a/metric/type"
+				}
+			}`)
+
+			_, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "$project")
+		})
+	})
+
+	t.Run("when a metric query has multiple project names", func(t *testing.T) {
+		req := baseReq()
+		req.Queries[0].JSON = json.RawMessage(`{
+			"queryType": "metrics",
+			"metricQuery": {
+				"projectNames": ["proj-a", "proj-b", "proj-c"],
+				"metricType":   "a/metric/type"
+			}
+		}`)
+
+		t.Run("one executor is built per project", func(t *testing.T) {
+			qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+			require.NoError(t, err)
+			queries := getCloudMonitoringQueriesFromInterface(t, qes)
+
+			require.Len(t, queries, 3)
+			for i, projectName := range []string{"proj-a", "proj-b", "proj-c"} {
+				assert.Equal(t, "A", queries[i].RefID)
+				assert.Equal(t, projectName, queries[i].ProjectName)
+				assert.Equal(t, queries[0].Target, queries[i].Target)
+			}
+		})
+
+		t.Run("every project is queried and the frames are merged", func(t *testing.T) {
+			var mu sync.Mutex
+			var paths []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/timeSeries") {
+					mu.Lock()
+					paths = append(paths, r.URL.Path)
+					mu.Unlock()
+				}
+				_, _ = w.Write([]byte(`{"timeSeries": [{"metric": {"type": "a/metric/type"}, "resource": {"type": "global"}, "valueType": "DOUBLE", "points": []}]}`))
+			}))
+			defer srv.Close()
+
+			s := &Service{tracer: tracing.InitializeTracerForTest()}
+			dsInfo := datasourceInfo{
+				services: map[string]datasourceService{
+					cloudMonitor: {url: srv.URL, client: srv.Client()},
+				},
+			}
+
+			resp, err := s.executeTimeSeriesQuery(context.Background(), slog, req, dsInfo)
+			require.NoError(t, err)
+			assert.ElementsMatch(t, []string{
+				"/v3/projects/proj-a/timeSeries",
+				"/v3/projects/proj-b/timeSeries",
+				"/v3/projects/proj-c/timeSeries",
+			}, paths)
+			require.Len(t, resp.Responses, 1)
+			assert.Len(t, resp.Responses["A"].Frames, 3)
+		})
+	})
+
+	t.Run("when a query is executed", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`{"timeSeries": [{"metric": {"type": "a/metric/type"}, "resource": {"type": "global"}, "valueType": "DOUBLE", "points": []}]}`))
+		}))
+		defer srv.Close()
+
+		s := &Service{tracer: tracing.InitializeTracerForTest()}
+		dsInfo := datasourceInfo{
+			services: map[string]datasourceService{
+				cloudMonitor: {url: srv.URL, client: srv.Client()},
+			},
+		}
+
+		t.Run("the query counter is incremented", func(t *testing.T) {
+			req := baseReq()
+			req.Queries[0].JSON = json.RawMessage(`{
+				"queryType": "metrics",
+				"metricQuery": {
+					"projectName": "test-proj",
+					"metricType":  "a/metric/type"
+				}
+			}`)
+
+			successes := testutil.ToFloat64(queriesTotal.WithLabelValues(metricQueryType, queryStatusSuccess))
+			failures := testutil.ToFloat64(queriesTotal.WithLabelValues(metricQueryType, queryStatusError))
+
+			_, err := s.executeTimeSeriesQuery(context.Background(), slog, req, dsInfo)
+			require.NoError(t, err)
+			assert.Equal(t, successes+1, testutil.ToFloat64(queriesTotal.WithLabelValues(metricQueryType, queryStatusSuccess)))
+			assert.Equal(t, failures, testutil.ToFloat64(queriesTotal.WithLabelValues(metricQueryType, queryStatusError)))
+		})
+	})
+
+	t.Run("when a request has several queries", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.Contains(r.URL.Query().Get("filter"), "failing/metric/type") {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"error": {"code": 400, "message": "invalid filter"}}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"timeSeries": [{"metric": {"type": "a/metric/type"}, "resource": {"type": "global"}, "valueType": "DOUBLE", "points": []}]}`))
+		}))
+		defer srv.Close()
+
+		s := &Service{tracer: tracing.InitializeTracerForTest()}
+		dsInfo := datasourceInfo{
+			services: map[string]datasourceService{
+				cloudMonitor: {url: srv.URL, client: srv.Client()},
+			},
+		}
+		req := baseReq()
+		query := req.Queries[0]
+		req.Queries = nil
+		for refID, metricType := range map[string]string{"A": "a/metric/type", "B": "failing/metric/type", "C": "c/metric/type"} {
+			q := query
+			q.RefID = refID
+			q.JSON = json.RawMessage(fmt.Sprintf(`{
+				"queryType": "metrics",
+				"metricQuery": {
+					"projectName": "test-proj",
+					"metricType":  %q
+				}
+			}`, metricType))
+			req.Queries = append(req.Queries, q)
+		}
+
+		resp, err := s.executeTimeSeriesQuery(context.Background(), slog, req, dsInfo)
+		require.NoError(t, err)
+		require.Len(t, resp.Responses, 3)
+		for _, refID := range []string{"A", "C"} {
+			assert.NoError(t, resp.Responses[refID].Error)
+			require.Len(t, resp.Responses[refID].Frames, 1)
+			assert.Equal(t, refID, resp.Responses[refID].Frames[0].RefID)
+		}
+		require.Error(t, resp.Responses["B"].Error)
+		assert.Contains(t, resp.Responses["B"].Error.Error(), "invalid filter")
+	})
+
+	t.Run("when a query returns several series", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`{"timeSeries": [
+				{"metric": {"type": "a/metric/type", "labels": {"zone": "us-east1-b"}}, "resource": {"type": "global"}, "valueType": "DOUBLE", "points": []},
+				{"metric": {"type": "a/metric/type", "labels": {"zone": "europe-west1-c"}}, "resource": {"type": "global"}, "valueType": "DOUBLE", "points": []},
+				{"metric": {"type": "a/metric/type", "labels": {"zone": "asia-east1-a"}}, "resource": {"type": "global"}, "valueType": "DOUBLE", "points": []}
+			]}`))
+		}))
+		defer srv.Close()
+
+		s := &Service{tracer: tracing.InitializeTracerForTest()}
+		dsInfo := datasourceInfo{
+			services: map[string]datasourceService{
+				cloudMonitor: {url: srv.URL, client: srv.Client()},
+			},
+		}
+		req := baseReq()
+		req.Queries[0].JSON = json.RawMessage(`{
+			"queryType": "metrics",
+			"metricQuery": {
+				"projectName": "test-proj",
+				"metricType":  "a/metric/type"
+			}
+		}`)
+
+		resp, err := s.executeTimeSeriesQuery(context.Background(), slog, req, dsInfo)
+		require.NoError(t, err)
+		frames := resp.Responses["A"].Frames
+		require.Len(t, frames, 3)
+		for i, zone := range []string{"asia-east1-a", "europe-west1-c", "us-east1-b"} {
+			assert.Equal(t, zone, frames[i].Fields[1].Labels["metric.label.zone"])
+		}
+	})
+
+	t.Run("when a query fails", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error": {"code": 400, "message": "invalid filter"}}`))
+		}))
+		defer srv.Close()
+
+		s := &Service{tracer: tracing.InitializeTracerForTest()}
+		dsInfo := datasourceInfo{
+			services: map[string]datasourceService{
+				cloudMonitor: {url: srv.URL, client: srv.Client()},
+			},
+		}
+		req := baseReq()
+		req.Queries[0].JSON = json.RawMessage(`{
+			"queryType": "metrics",
+			"metricQuery": {
+				"projectName": "test-proj",
+				"metricType":  "a/metric/type"
+			}
+		}`)
+
+		buf := &bytes.Buffer{}
+		logger := log.NewNopLogger()
+		logger.Swap(gokitlog.NewLogfmtLogger(buf))
+
+		resp, err := s.executeTimeSeriesQuery(context.Background(), logger, req, dsInfo)
+		require.NoError(t, err)
+		require.Error(t, resp.Responses["A"].Error)
+
+		matches := regexp.MustCompile(`\(correlation id (A-[0-9a-f]{8})\)`).FindStringSubmatch(resp.Responses["A"].Error.Error())
+		require.Len(t, matches, 2)
+		assert.Contains(t, buf.String(), "correlationId="+matches[1])
+		assert.Contains(t, buf.String(), "Request failed")
+	})
+
+	t.Run("when a query is invalid", func(t *testing.T) {
+		tests := []struct {
+			name        string
+			json        string
+			expectedErr error
+		}{
+			{
+				name:        "malformed json",
+				json:        `{"metricType": `,
+				expectedErr: ErrInvalidQuery,
+			},
+			{
+				name:        "unsupported query type",
+				json:        `{"queryType": "logs", "metricQuery": {}}`,
+				expectedErr: ErrUnsupportedQueryType,
+			},
+			{
+				name:        "missing metric type",
+				json:        `{"queryType": "metrics", "metricQuery": {"projectName": "test-proj"}}`,
+				expectedErr: ErrMissingMetricType,
+			},
+			{
+				name:        "invalid alignment period",
+				json:        `{"metricType": "a/metric/type", "alignmentPeriod": "one minute"}`,
+				expectedErr: ErrInvalidAlignmentPeriod,
+			},
+			{
+				name:        "invalid SLO alignment period",
+				json:        `{"queryType": "slo", "sloQuery": {"selectorName": "select_slo_health", "alignmentPeriod": "fast"}}`,
+				expectedErr: ErrInvalidAlignmentPeriod,
+			},
+			{
+				name:        "invalid group by",
+				json:        `{"metricType": "a/metric/type", "groupBys": ["metric.labels.zone"]}`,
+				expectedErr: ErrInvalidGroupBy,
+			},
+			{
+				name:        "invalid secondary group by",
+				json:        `{"metricType": "a/metric/type", "preprocessor": "rate", "secondaryGroupBys": ["zone"]}`,
+				expectedErr: ErrInvalidGroupBy,
+			},
+			{
+				name:        "invalid fill missing mode",
+				json:        `{"metricType": "a/metric/type", "fillMissing": "previous"}`,
+				expectedErr: ErrInvalidFillMissing,
+			},
+			{
+				name:        "invalid lookback period",
+				json:        `{"queryType": "slo", "sloQuery": {"selectorName": "select_slo_burn_rate", "lookbackPeriod": "1hour"}}`,
+				expectedErr: ErrInvalidLookbackPeriod,
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				req := baseReq()
+				req.Queries[0].JSON = json.RawMessage(tt.json)
+
+				_, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+				require.Error(t, err)
+				assert.ErrorIs(t, err, tt.expectedErr)
+			})
+		}
+	})
+
+	t.Run("an SLO query with an empty metric query doesn't require a metric type", func(t *testing.T) {
+		req := baseReq()
+		req.Queries[0].JSON = json.RawMessage(`{
+			"queryType": "slo",
+			"sloQuery": {
+				"projectName":  "test-proj",
+				"selectorName": "select_slo_health",
+				"serviceId":    "test-service",
+				"sloId":        "test-slo"
+			},
+			"metricQuery": {}
+		}`)
+
+		qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+		require.NoError(t, err)
+		require.Len(t, getCloudMonitoringQueriesFromInterface(t, qes), 1)
+	})
+
+	t.Run("when interpolating filter wildcards", func(t *testing.T) {
+		t.Run("and wildcard is used in the beginning and the end of the word", func(t *testing.T) {
+			t.Run("and there's no wildcard in the middle of the word", func(t *testing.T) {
+				value := interpolateFilterWildcards("*-central1*")
+				assert.Equal(t, `has_substring("-central1")`, value)
+			})
+			t.Run("and the word contains a double quote", func(t *testing.T) {
+				value := interpolateFilterWildcards(`*a"b*`)
+				assert.Equal(t, `has_substring("a\"b")`, value)
+			})
+			t.Run("and there is a wildcard in the middle of the word", func(t *testing.T) {
+				value := interpolateFilterWildcards("*-cent*ral1*")
+				assert.False(t, strings.HasPrefix(value, `has_substring`))
+			})
+		})
+
+		t.Run("and wildcard is used in the beginning of the word", func(t *testing.T) {
+			t.Run("and there is not a wildcard elsewhere in the word", func(t *testing.T) {
+				value := interpolateFilterWildcards("*-central1")
+				assert.Equal(t, `ends_with("-central1")`, value)
+			})
+			t.Run("and the word contains a double quote", func(t *testing.T) {
+				value := interpolateFilterWildcards(`*a"b`)
+				assert.Equal(t, `ends_with("a\"b")`, value)
+			})
+			t.Run("and there is a wildcard elsewhere in the word", func(t *testing.T) {
+				value := interpolateFilterWildcards("*-cent*al1")
+				assert.False(t, strings.HasPrefix(value, `ends_with`))
+			})
+		})
+
+		t.Run("and wildcard is used at the end of the word", func(t *testing.T) {
+			t.Run("and there is not a wildcard elsewhere in the word", func(t *testing.T) {
+				value := interpolateFilterWildcards("us-central*")
+				assert.Equal(t, `starts_with("us-central")`, value)
+			})
+			t.Run("and the word contains a double quote", func(t *testing.T) {
+				value := interpolateFilterWildcards(`a"b*`)
+				assert.Equal(t, `starts_with("a\"b")`, value)
+			})
+			t.Run("and there is a wildcard elsewhere in the word", func(t *testing.T) {
+				value := interpolateFilterWildcards("*us-central*")
+				assert.False(t, strings.HasPrefix(value, `starts_with`))
+			})
+		})
+
+		t.Run("and wildcard is used in the middle of the word", func(t *testing.T) {
+			t.Run("and there is only one wildcard", func(t *testing.T) {
+				value := interpolateFilterWildcards("us-ce*tral1-b")
+				assert.Equal(t, `monitoring.regex.full_match("^us\\-ce.*tral1\\-b$")`, value)
+			})
+
+			t.Run("and there is more than one wildcard", func(t *testing.T) {
+				value := interpolateFilterWildcards("us-ce*tra*1-b")
+				assert.Equal(t, `monitoring.regex.full_match("^us\\-ce.*tra.*1\\-b$")`, value)
+			})
+		})
+
+		t.Run("and wildcard is used in the middle of the word and in the beginning of the word", func(t *testing.T) {
+			value := interpolateFilterWildcards("*s-ce*tral1-b")
+			assert.Equal(t, `monitoring.regex.full_match("^.*s\\-ce.*tral1\\-b$")`, value)
+		})
+
+		t.Run("and wildcard is used in the middle of the word and in the ending of the word", func(t *testing.T) {
+			value := interpolateFilterWildcards("us-ce*tral1-*")
+			assert.Equal(t, `monitoring.regex.full_match("^us\\-ce.*tral1\\-.*$")`, value)
+		})
+
+		t.Run("and no wildcard is used", func(t *testing.T) {
+			value := interpolateFilterWildcards("us-central1-a}")
+			assert.Equal(t, `us-central1-a}`, value)
+		})
+	})
+
+	t.Run("when formatting the deep link alignment period", func(t *testing.T) {
+		t.Run("and period is fractional", func(t *testing.T) {
+			assert.Equal(t, "1s", toDeepLinkAlignmentPeriod("+0.5s"))
+		})
+
+		t.Run("and period is a whole number of seconds", func(t *testing.T) {
+			assert.Equal(t, "3600s", toDeepLinkAlignmentPeriod("+3600s"))
+		})
+
+		t.Run("and period is derived from grafana-auto", func(t *testing.T) {
+			alignmentPeriod, _ := calculateAlignmentPeriod("grafana-auto", 30000, 3600, 0, defaultMinAlignmentSeconds)
+			assert.Equal(t, "60s", toDeepLinkAlignmentPeriod(alignmentPeriod))
+			alignmentPeriod, _ = calculateAlignmentPeriod("grafana-auto", 1000000, 3600, 0, defaultMinAlignmentSeconds)
+			assert.Equal(t, "1000s", toDeepLinkAlignmentPeriod(alignmentPeriod))
+		})
+	})
+
+	t.Run("when building filter string", func(t *testing.T) {
+		t.Run("and there's no regex operator", func(t *testing.T) {
+			t.Run("and there are wildcards in a filter value", func(t *testing.T) {
+				filterParts := []string{"zone", "=", "*-central1*"}
+				value, err := buildFilterString("somemetrictype", filterParts, false, nil)
+				require.NoError(t, err)
+				assert.Equal(t, `metric.type="somemetrictype" zone=has_substring("-central1")`, value)
+			})
+
+			t.Run("and there are no wildcards in any filter value", func(t *testing.T) {
+				filterParts := []string{"zone", "!=", "us-central1-a"}
+				value, err := buildFilterString("somemetrictype", filterParts, false, nil)
+				require.NoError(t, err)
+				assert.Equal(t, `metric.type="somemetrictype" zone!="us-central1-a"`, value)
+			})
+		})
+
+		t.Run("and there is a regex operator", func(t *testing.T) {
+			filterParts := []string{"zone", "=~", "us-central1-a~"}
+			value, err := buildFilterString("somemetrictype", filterParts, false, nil)
+			require.NoError(t, err)
+			assert.NotContains(t, value, `=~`)
+			assert.Contains(t, value, `zone=`)
+
+			assert.Contains(t, value, `zone=monitoring.regex.full_match("us-central1-a~")`)
+		})
+
+		t.Run("and the regex value contains a double quote", func(t *testing.T) {
+			filterParts := []string{"zone", "=~", `a"b.*`}
+			value, err := buildFilterString("somemetrictype", filterParts, false, nil)
+			require.NoError(t, err)
+			assert.Equal(t, `metric.type="somemetrictype" zone=monitoring.regex.full_match("a\"b.*")`, value)
+		})
+
+		t.Run("and there is a numeric comparison", func(t *testing.T) {
+			filterParts := []string{"metric.label.cpu", ">", "0.5", "AND", "zone", "=", "us-east1-b"}
+			value, err := buildFilterString("somemetrictype", filterParts, false, nil)
+			require.NoError(t, err)
+			assert.Equal(t, `metric.type="somemetrictype" metric.label.cpu>0.5 zone="us-east1-b"`, value)
+		})
+
+		t.Run("and a comparison operator is used with a non numeric value", func(t *testing.T) {
+			filterParts := []string{"metric.label.cpu", "<=", "high"}
+			_, err := buildFilterString("somemetrictype", filterParts, false, nil)
+			require.Error(t, err)
+			assert.Equal(t, "invalid filter metric.label.cpu<=high: the <= operator requires a numeric value", err.Error())
+
+			for _, value := range []string{"NaN", "Inf", "-Inf", "0x1p-2", "1e3", "1_000", ".5"} {
+				_, err := buildFilterString("somemetrictype", []string{"metric.label.cpu", ">", value}, false, nil)
+				assert.Error(t, err, value)
+			}
+		})
+
+		t.Run("and a comparison operator is used with a negative decimal value", func(t *testing.T) {
+			value, err := buildFilterString("somemetrictype", []string{"metric.label.cpu", ">=", "-1.25"}, false, nil)
+			require.NoError(t, err)
+			assert.Equal(t, `metric.type="somemetrictype" metric.label.cpu>=-1.25`, value)
+		})
+
+		t.Run("and there is a group id filter", func(t *testing.T) {
+			filterParts := []string{"group.id", "=", "1234*", "AND", "zone", "=", "us-*"}
+			value, err := buildFilterString("somemetrictype", filterParts, true, nil)
+			require.NoError(t, err)
+			assert.Equal(t, `metric.type="somemetrictype" group.id="1234*" zone=monitoring.regex.full_match("(?i)^us\\-.*$")`, value)
+		})
+
+		t.Run("and the metric type, keys and values are padded with whitespace", func(t *testing.T) {
+			filterParts := []string{" zone ", "=", " us-central1-a ", "AND", "instance_name\t", "=", " collector*"}
+			value, err := buildFilterString("  a/metric/type \n", filterParts, false, nil)
+			require.NoError(t, err)
+			assert.Equal(t, `metric.type="a/metric/type" zone="us-central1-a" instance_name=starts_with("collector")`, value)
+		})
+
+		t.Run("and case insensitive matching is enabled", func(t *testing.T) {
+			filterParts := []string{"instance_name", "=", "*Collector*", "AND", "zone", "=", "us-east1-b"}
+			value, err := buildFilterString("somemetrictype", filterParts, true, nil)
+			require.NoError(t, err)
+			assert.Equal(t, `metric.type="somemetrictype" instance_name=monitoring.regex.full_match("(?i)^.*Collector.*$") zone="us-east1-b"`, value)
+		})
+
+		t.Run("and case insensitive matching is disabled", func(t *testing.T) {
+			filterParts := []string{"instance_name", "=", "*Collector*", "AND", "zone", "=", "us-east1-b"}
+			value, err := buildFilterString("somemetrictype", filterParts, false, nil)
+			require.NoError(t, err)
+			assert.Equal(t, `metric.type="somemetrictype" instance_name=has_substring("Collector") zone="us-east1-b"`, value)
+			assert.NotContains(t, value, "(?i)")
+		})
+
+		t.Run("and there is an OR group followed by an AND clause", func(t *testing.T) {
+			filterParts := []string{"zone", "=", "us-east1-b", "OR", "zone", "=", "us-west1-*", "AND", "instance_name", "!=", "collector"}
+			value, err := buildFilterString("somemetrictype", filterParts, false, nil)
+			require.NoError(t, err)
+			assert.Equal(t, `metric.type="somemetrictype" (zone="us-east1-b" OR zone=starts_with("us-west1-")) instance_name!="collector"`, value)
+		})
+
+		t.Run("and there is an AND clause followed by an OR group", func(t *testing.T) {
+			filterParts := []string{"instance_name", "=", "collector", "AND", "zone", "=~", "us-.*", "OR", "zone", "=", "europe-west1-b"}
+			value, err := buildFilterString("somemetrictype", filterParts, false, nil)
+			require.NoError(t, err)
+			assert.Equal(t, `metric.type="somemetrictype" instance_name="collector" (zone=monitoring.regex.full_match("us-.*") OR zone="europe-west1-b")`, value)
+		})
+
+		t.Run("and the filter keys have dotted segments", func(t *testing.T) {
+			filterParts := []string{
+				"metadata.system_labels.spot", "=", "tru*", "AND",
+				"metric.label.instance.version", "=", "1.2.3", "AND",
+				"resource.label.cluster.zone", "=", "*-central1-*",
+			}
+			value, err := buildFilterString("somemetrictype", filterParts, false, nil)
+			require.NoError(t, err)
+			assert.Equal(t, `metric.type="somemetrictype" metadata.system_labels.spot=starts_with("tru") metric.label.instance.version="1.2.3" resource.label.cluster.zone=has_substring("-central1-")`, value)
+		})
+
+		t.Run("and a clause is negated", func(t *testing.T) {
+			t.Run("the NOT prefix is placed before the clause", func(t *testing.T) {
+				filterParts := []string{"NOT", "zone", "=", "us-central1-a", "AND", "instance_name", "=", "collector"}
+				value, err := buildFilterString("somemetrictype", filterParts, false, nil)
+				require.NoError(t, err)
+				assert.Equal(t, `metric.type="somemetrictype" NOT zone="us-central1-a" instance_name="collector"`, value)
+			})
+
+			t.Run("wildcards are interpolated inside the negated clause", func(t *testing.T) {
+				filterParts := []string{"instance_name", "=", "collector", "AND", "NOT", "zone", "=", "us-*"}
+				value, err := buildFilterString("somemetrictype", filterParts, false, nil)
+				require.NoError(t, err)
+				assert.Equal(t, `metric.type="somemetrictype" instance_name="collector" NOT zone=starts_with("us-")`, value)
+			})
+
+			t.Run("a negated clause can be part of an OR group", func(t *testing.T) {
+				filterParts := []string{"zone", "=", "us-central1-a", "OR", "NOT", "instance_name", "=", "*collector*"}
+				value, err := buildFilterString("somemetrictype", filterParts, false, nil)
+				require.NoError(t, err)
+				assert.Equal(t, `metric.type="somemetrictype" (zone="us-central1-a" OR NOT instance_name=has_substring("collector"))`, value)
+			})
+		})
+
+		t.Run("and a filter value is a multi-value template variable", func(t *testing.T) {
+			vars := scopedVars{"zone": {Value: []interface{}{"a", "b", "c"}}}
+
+			t.Run("the filter is expanded to an OR group", func(t *testing.T) {
+				filterParts := []string{"zone", "=", "$zone", "AND", "instance_name", "=", "collector"}
+				value, err := buildFilterString("somemetrictype", filterParts, false, vars)
+				require.NoError(t, err)
+				assert.Equal(t, `metric.type="somemetrictype" (zone="a" OR zone="b" OR zone="c") instance_name="collector"`, value)
+			})
+
+			t.Run("the expansion joins an existing OR group", func(t *testing.T) {
+				filterParts := []string{"zone", "=", "${zone}", "OR", "zone", "=", "d"}
+				value, err := buildFilterString("somemetrictype", filterParts, false, vars)
+				require.NoError(t, err)
+				assert.Equal(t, `metric.type="somemetrictype" (zone="a" OR zone="b" OR zone="c" OR zone="d")`, value)
+			})
+
+			t.Run("a single value variable is left unchanged", func(t *testing.T) {
+				filterParts := []string{"zone", "=", "$zone"}
+				value, err := buildFilterString("somemetrictype", filterParts, false, scopedVars{"zone": {Value: "a"}})
+				require.NoError(t, err)
+				assert.Equal(t, `metric.type="somemetrictype" zone="$zone"`, value)
+			})
+		})
+	})
+
+	t.Run("and query preprocessor is not defined", func(t *testing.T) {
+		req := baseReq()
+		req.Queries[0].JSON = json.RawMessage(`{
+			"metricType":         "a/metric/type",
+			"crossSeriesReducer": "REDUCE_MIN",
+			"perSeriesAligner":   "REDUCE_SUM",
+			"alignmentPeriod":    "+60s",
+			"groupBys":           ["metric.label.labelname"],
+			"view":               "FULL"
+		}`)
+
+		qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+		require.NoError(t, err)
+		queries := getCloudMonitoringQueriesFromInterface(t, qes)
+
+		assert.Equal(t, 1, len(queries))
+		assert.Equal(t, "REDUCE_MIN", queries[0].Params["aggregation.crossSeriesReducer"][0])
+		assert.Equal(t, "REDUCE_SUM", queries[0].Params["aggregation.perSeriesAligner"][0])
+		assert.Equal(t, "+60s", queries[0].Params["aggregation.alignmentPeriod"][0])
+		assert.Equal(t, "metric.label.labelname", queries[0].Params["aggregation.groupByFields"][0])
+
+		assert.NotContains(t, queries[0].Params, "secondaryAggregation.crossSeriesReducer")
+		assert.NotContains(t, "REDUCE_SUM", queries[0].Params, "secondaryAggregation.perSeriesAligner")
+		assert.NotContains(t, "+60s", queries[0].Params, "secondaryAggregation.alignmentPeriod")
+		assert.NotContains(t, "metric.label.labelname", queries[0].Params, "secondaryAggregation.groupByFields")
+	})
+
+	t.Run("and the group bys are label keys", func(t *testing.T) {
+		req := baseReq()
+		req.Queries[0].JSON = json.RawMessage(`{
+			"metricType":         "a/metric/type",
+			"crossSeriesReducer": "REDUCE_MEAN",
+			"groupBys":           ["metric.label.instance_name", "resource.label.zone", "metadata.system_labels.spot", "metadata.user_labels.team", "resource.type"]
+		}`)
+
+		qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+		require.NoError(t, err)
+		queries := getCloudMonitoringQueriesFromInterface(t, qes)
+		assert.Equal(t, []string{"metric.label.instance_name", "resource.label.zone", "metadata.system_labels.spot", "metadata.user_labels.team", "resource.type"}, queries[0].Params["aggregation.groupByFields"])
+	})
+
+	t.Run("and query has no alignment", func(t *testing.T) {
+		req := baseReq()
+		req.Queries[0].JSON = json.RawMessage(`{
+			"metricType":         "a/metric/type",
+			"crossSeriesReducer": "REDUCE_NONE",
+			"perSeriesAligner":   "ALIGN_NONE",
+			"alignmentPeriod":    "grafana-auto",
+			"view":               "FULL"
+		}`)
+
+		qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+		require.NoError(t, err)
+		queries := getCloudMonitoringQueriesFromInterface(t, qes)
+
+		assert.Equal(t, "ALIGN_NONE", queries[0].Params.Get("aggregation.perSeriesAligner"))
+		_, ok := queries[0].Params["aggregation.alignmentPeriod"]
+		assert.False(t, ok)
+
+		dl := queries[0].buildDeepLink()
+		expectedTimeSelection := map[string]string{
+			"timeRange": "custom",
+			"start":     "2018-03-15T13:00:00Z",
+			"end":       "2018-03-15T13:34:00Z",
+		}
+		expectedTimeSeriesFilter := map[string]interface{}{
+			"perSeriesAligner":   "ALIGN_NONE",
+			"minAlignmentPeriod": "",
+		}
+		verifyDeepLink(t, dl, expectedTimeSelection, expectedTimeSeriesFilter)
+	})
+
+	t.Run("and query has a percentile aligner", func(t *testing.T) {
+		for _, aligner := range []string{"ALIGN_PERCENTILE_50", "ALIGN_PERCENTILE_95", "ALIGN_PERCENTILE_99"} {
+			req := baseReq()
+			req.Queries[0].JSON = json.RawMessage(fmt.Sprintf(`{
+				"metricType":       "a/metric/type",
+				"perSeriesAligner": "%s",
+				"view":             "FULL"
+			}`, aligner))
+			qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+			require.NoError(t, err)
+			queries := getCloudMonitoringQueriesFromInterface(t, qes)
+			assert.Equal(t, aligner, queries[0].Params["aggregation.perSeriesAligner"][0])
+
+			dl := queries[0].buildDeepLink()
+			expectedTimeSelection := map[string]string{
+				"timeRange": "custom",
+				"start":     "2018-03-15T13:00:00Z",
+				"end":       "2018-03-15T13:34:00Z",
+			}
+			expectedTimeSeriesFilter := map[string]interface{}{
+				"perSeriesAligner": aligner,
+			}
+			verifyDeepLink(t, dl, expectedTimeSelection, expectedTimeSeriesFilter)
+		}
+	})
+
+	t.Run("and query preprocessor is set to none", func(t *testing.T) {
+		req := baseReq()
+		req.Queries[0].JSON = json.RawMessage(`{
+			"metricType":         "a/metric/type",
+			"crossSeriesReducer": "REDUCE_MIN",
+			"perSeriesAligner":   "REDUCE_SUM",
+			"alignmentPeriod":    "+60s",
+			"groupBys":           ["metric.label.labelname"],
+			"view":               "FULL",
+			"preprocessor":       "none"
+		}`)
+
+		qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+		require.NoError(t, err)
+		queries := getCloudMonitoringQueriesFromInterface(t, qes)
+
+		assert.Equal(t, 1, len(queries))
+		assert.Equal(t, "REDUCE_MIN", queries[0].Params["aggregation.crossSeriesReducer"][0])
+		assert.Equal(t, "REDUCE_SUM", queries[0].Params["aggregation.perSeriesAligner"][0])
+		assert.Equal(t, "+60s", queries[0].Params["aggregation.alignmentPeriod"][0])
+		assert.Equal(t, "metric.label.labelname", queries[0].Params["aggregation.groupByFields"][0])
+
+		assert.NotContains(t, queries[0].Params, "secondaryAggregation.crossSeriesReducer")
+		assert.NotContains(t, "REDUCE_SUM", queries[0].Params, "secondaryAggregation.perSeriesAligner")
+		assert.NotContains(t, "+60s", queries[0].Params, "secondaryAggregation.alignmentPeriod")
+		assert.NotContains(t, "metric.label.labelname", queries[0].Params, "secondaryAggregation.groupByFields")
+	})
+
+	t.Run("and query preprocessor is set to rate and there's no group bys", func(t *testing.T) {
+		req := baseReq()
+		req.Queries[0].JSON = json.RawMessage(`{
+			"metricType":         "a/metric/type",
+			"crossSeriesReducer": "REDUCE_SUM",
+			"perSeriesAligner":   "REDUCE_MIN",
+			"alignmentPeriod":    "+60s",
+			"groupBys":           [],
+			"view":               "FULL",
+			"preprocessor":       "rate"
+		}`)
+
+		qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+		require.NoError(t, err)
+		queries := getCloudMonitoringQueriesFromInterface(t, qes)
+
+		assert.Equal(t, 1, len(queries))
+		assert.Equal(t, "REDUCE_NONE", queries[0].Params["aggregation.crossSeriesReducer"][0])
+		assert.Equal(t, "ALIGN_RATE", queries[0].Params["aggregation.perSeriesAligner"][0])
+		assert.Equal(t, "+60s", queries[0].Params["aggregation.alignmentPeriod"][0])
+
+		assert.Equal(t, "REDUCE_SUM", queries[0].Params["secondaryAggregation.crossSeriesReducer"][0])
+		assert.Equal(t, "REDUCE_MIN", queries[0].Params["secondaryAggregation.perSeriesAligner"][0])
+		assert.Equal(t, "+60s", queries[0].Params["secondaryAggregation.alignmentPeriod"][0])
+	})
+
+	t.Run("and query preprocessor is set to rate and a primary cross series reducer is set", func(t *testing.T) {
+		req := baseReq()
+		req.Queries[0].JSON = json.RawMessage(`{
+			"metricType":                "a/metric/type",
+			"crossSeriesReducer":        "REDUCE_SUM",
+			"primaryCrossSeriesReducer": "REDUCE_MEAN",
+			"perSeriesAligner":          "ALIGN_MEAN",
+			"alignmentPeriod":           "+60s",
+			"groupBys":                  [],
+			"view":                      "FULL",
+			"preprocessor":              "rate"
+		}`)
+
+		qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+		require.NoError(t, err)
+		queries := getCloudMonitoringQueriesFromInterface(t, qes)
+
+		assert.Equal(t, 1, len(queries))
+		assert.Equal(t, "REDUCE_MEAN", queries[0].Params["aggregation.crossSeriesReducer"][0])
+		assert.Equal(t, "ALIGN_RATE", queries[0].Params["aggregation.perSeriesAligner"][0])
+		assert.Equal(t, "REDUCE_SUM", queries[0].Params["secondaryAggregation.crossSeriesReducer"][0])
+		assert.Equal(t, "ALIGN_MEAN", queries[0].Params["secondaryAggregation.perSeriesAligner"][0])
+	})
+
+	t.Run("and query preprocessor is set to rate and a secondary alignment period is set", func(t *testing.T) {
+		req := baseReq()
+		req.Queries[0].JSON = json.RawMessage(`{
+			"metricType":               "a/metric/type",
+			"crossSeriesReducer":       "REDUCE_SUM",
+			"perSeriesAligner":         "ALIGN_MEAN",
+			"alignmentPeriod":          "+60s",
+			"secondaryAlignmentPeriod": "300000ms",
+			"view":                     "FULL",
+			"preprocessor":             "rate"
+		}`)
+
+		qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+		require.NoError(t, err)
+		queries := getCloudMonitoringQueriesFromInterface(t, qes)
+
+		assert.Equal(t, 1, len(queries))
+		assert.Equal(t, "+60s", queries[0].Params["aggregation.alignmentPeriod"][0])
+		assert.Equal(t, "+300s", queries[0].Params["secondaryAggregation.alignmentPeriod"][0])
+	})
+
+	t.Run("and query preprocessor is set to rate and the secondary alignment period is invalid", func(t *testing.T) {
+		req := baseReq()
+		req.Queries[0].JSON = json.RawMessage(`{
+			"metricType":               "a/metric/type",
+			"perSeriesAligner":         "ALIGN_MEAN",
+			"secondaryAlignmentPeriod": "slow",
+			"preprocessor":             "rate"
+		}`)
+
+		_, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+		require.ErrorIs(t, err, ErrInvalidAlignmentPeriod)
+	})
+
+	t.Run("and query preprocessor is set to rate and group bys exist", func(t *testing.T) {
+		req := baseReq()
+		req.Queries[0].JSON = json.RawMessage(`{
+			"metricType":         "a/metric/type",
+			"crossSeriesReducer": "REDUCE_SUM",
+			"perSeriesAligner":   "REDUCE_MIN",
+			"alignmentPeriod":    "+60s",
+			"groupBys":           ["metric.label.labelname"],
+			"view":               "FULL",
+			"preprocessor":       "rate"
+		}`)
+
+		qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+		require.NoError(t, err)
+		queries := getCloudMonitoringQueriesFromInterface(t, qes)
+
+		assert.Equal(t, 1, len(queries))
+		assert.Equal(t, "REDUCE_SUM", queries[0].Params["aggregation.crossSeriesReducer"][0])
+		assert.Equal(t, "ALIGN_RATE", queries[0].Params["aggregation.perSeriesAligner"][0])
+		assert.Equal(t, "+60s", queries[0].Params["aggregation.alignmentPeriod"][0])
+		assert.Equal(t, "metric.label.labelname", queries[0].Params["aggregation.groupByFields"][0])
+
+		assert.Equal(t, "REDUCE_SUM", queries[0].Params["secondaryAggregation.crossSeriesReducer"][0])
+		assert.Equal(t, "REDUCE_MIN", queries[0].Params["secondaryAggregation.perSeriesAligner"][0])
+		assert.Equal(t, "+60s", queries[0].Params["secondaryAggregation.alignmentPeriod"][0])
+		assert.Equal(t, "metric.label.labelname", queries[0].Params["secondaryAggregation.groupByFields"][0])
+
+		queries[0].Params.Set("resourceType", "a/resource/type")
+		dl := queries[0].buildDeepLink()
+
+		expectedTimeSelection := map[string]string{
+			"timeRange": "custom",
+			"start":     "2018-03-15T13:00:00Z",
+			"end":       "2018-03-15T13:34:00Z",
+		}
+		expectedTimeSeriesFilter := map[string]interface{}{
+			"minAlignmentPeriod":     `60s`,
+			"crossSeriesReducer":     "REDUCE_SUM",
+			"perSeriesAligner":       "ALIGN_RATE",
+			"filter":                 "resource.type=\"a/resource/type\" metric.type=\"a/metric/type\"",
+			"groupByFields":          []interface{}{"metric.label.labelname"},
+			"secondaryGroupByFields": []interface{}{"metric.label.labelname"},
+		}
+		verifyDeepLink(t, dl, expectedTimeSelection, expectedTimeSeriesFilter)
 	})
 
-	t.Run("when building filter string", func(t *testing.T) {
-		t.Run("and there's no regex operator", func(t *testing.T) {
-			t.Run("and there are wildcards in a filter value", func(t *testing.T) {
-				filterParts := []string{"zone", "=", "*-central1*"}
-				value := buildFilterString("somemetrictype", filterParts)
-				assert.Equal(t, `metric.type="somemetrictype" zone=has_substring("-central1")`, value)
-			})
+	t.Run("and query preprocessor is set to rate and secondary group bys exist", func(t *testing.T) {
+		req := baseReq()
+		req.Queries[0].JSON = json.RawMessage(`{
+			"metricType":         "a/metric/type",
+			"crossSeriesReducer": "REDUCE_SUM",
+			"perSeriesAligner":   "ALIGN_MEAN",
+			"alignmentPeriod":    "+60s",
+			"groupBys":           ["metric.label.instance_name", "resource.label.zone"],
+			"secondaryGroupBys":  ["resource.label.zone"],
+			"view":               "FULL",
+			"preprocessor":       "rate"
+		}`)
 
-			t.Run("and there are no wildcards in any filter value", func(t *testing.T) {
-				filterParts := []string{"zone", "!=", "us-central1-a"}
-				value := buildFilterString("somemetrictype", filterParts)
-				assert.Equal(t, `metric.type="somemetrictype" zone!="us-central1-a"`, value)
-			})
-		})
+		qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+		require.NoError(t, err)
+		queries := getCloudMonitoringQueriesFromInterface(t, qes)
 
-		t.Run("and there is a regex operator", func(t *testing.T) {
-			filterParts := []string{"zone", "=~", "us-central1-a~"}
-			value := buildFilterString("somemetrictype", filterParts)
-			assert.NotContains(t, value, `=~`)
-			assert.Contains(t, value, `zone=`)
+		assert.Equal(t, 1, len(queries))
+		assert.Equal(t, "ALIGN_RATE", queries[0].Params["aggregation.perSeriesAligner"][0])
+		assert.Equal(t, []string{"metric.label.instance_name", "resource.label.zone"}, queries[0].Params["aggregation.groupByFields"])
+		assert.Equal(t, []string{"resource.label.zone"}, queries[0].Params["secondaryAggregation.groupByFields"])
+	})
 
-			assert.Contains(t, value, `zone=monitoring.regex.full_match("us-central1-a~")`)
-		})
+	t.Run("and query preprocessor is set to rate and secondary group bys are empty", func(t *testing.T) {
+		req := baseReq()
+		req.Queries[0].JSON = json.RawMessage(`{
+			"metricType":         "a/metric/type",
+			"crossSeriesReducer": "REDUCE_SUM",
+			"perSeriesAligner":   "ALIGN_MEAN",
+			"alignmentPeriod":    "+60s",
+			"groupBys":           ["metric.label.instance_name"],
+			"secondaryGroupBys":  [],
+			"view":               "FULL",
+			"preprocessor":       "rate"
+		}`)
+
+		qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+		require.NoError(t, err)
+		queries := getCloudMonitoringQueriesFromInterface(t, qes)
+
+		assert.Equal(t, 1, len(queries))
+		assert.Equal(t, []string{"metric.label.instance_name"}, queries[0].Params["aggregation.groupByFields"])
+		assert.Equal(t, []string{"metric.label.instance_name"}, queries[0].Params["secondaryAggregation.groupByFields"])
 	})
 
-	t.Run("and query preprocessor is not defined", func(t *testing.T) {
+	t.Run("and query preprocessor is set to delta and there's no group bys", func(t *testing.T) {
 		req := baseReq()
 		req.Queries[0].JSON = json.RawMessage(`{
 			"metricType":         "a/metric/type",
 			"crossSeriesReducer": "REDUCE_MIN",
 			"perSeriesAligner":   "REDUCE_SUM",
 			"alignmentPeriod":    "+60s",
-			"groupBys":           ["labelname"],
-			"view":               "FULL"
+			"groupBys":           [],
+			"view":               "FULL",
+			"preprocessor":       "delta"
 		}`)
 
-		qes, err := service.buildQueryExecutors(slog, req)
+		qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
 		require.NoError(t, err)
 		queries := getCloudMonitoringQueriesFromInterface(t, qes)
 
 		assert.Equal(t, 1, len(queries))
-		assert.Equal(t, "REDUCE_MIN", queries[0].Params["aggregation.crossSeriesReducer"][0])
-		assert.Equal(t, "REDUCE_SUM", queries[0].Params["aggregation.perSeriesAligner"][0])
+		assert.Equal(t, "REDUCE_NONE", queries[0].Params["aggregation.crossSeriesReducer"][0])
+		assert.Equal(t, "ALIGN_DELTA", queries[0].Params["aggregation.perSeriesAligner"][0])
 		assert.Equal(t, "+60s", queries[0].Params["aggregation.alignmentPeriod"][0])
-		assert.Equal(t, "labelname", queries[0].Params["aggregation.groupByFields"][0])
 
-		assert.NotContains(t, queries[0].Params, "secondaryAggregation.crossSeriesReducer")
-		assert.NotContains(t, "REDUCE_SUM", queries[0].Params, "secondaryAggregation.perSeriesAligner")
-		assert.NotContains(t, "+60s", queries[0].Params, "secondaryAggregation.alignmentPeriod")
-		assert.NotContains(t, "labelname", queries[0].Params, "secondaryAggregation.groupByFields")
+		assert.Equal(t, "REDUCE_MIN", queries[0].Params["secondaryAggregation.crossSeriesReducer"][0])
+		assert.Equal(t, "REDUCE_SUM", queries[0].Params["secondaryAggregation.perSeriesAligner"][0])
+		assert.Equal(t, "+60s", queries[0].Params["secondaryAggregation.alignmentPeriod"][0])
 	})
 
-	t.Run("and query preprocessor is set to none", func(t *testing.T) {
+	t.Run("and query preprocessor is set to delta and group bys exist", func(t *testing.T) {
 		req := baseReq()
 		req.Queries[0].JSON = json.RawMessage(`{
 			"metricType":         "a/metric/type",
 			"crossSeriesReducer": "REDUCE_MIN",
 			"perSeriesAligner":   "REDUCE_SUM",
 			"alignmentPeriod":    "+60s",
-			"groupBys":           ["labelname"],
+			"groupBys":           ["metric.label.labelname"],
 			"view":               "FULL",
-			"preprocessor":       "none"
+			"preprocessor":       "delta"
 		}`)
 
-		qes, err := service.buildQueryExecutors(slog, req)
+		qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
 		require.NoError(t, err)
 		queries := getCloudMonitoringQueriesFromInterface(t, qes)
 
 		assert.Equal(t, 1, len(queries))
 		assert.Equal(t, "REDUCE_MIN", queries[0].Params["aggregation.crossSeriesReducer"][0])
-		assert.Equal(t, "REDUCE_SUM", queries[0].Params["aggregation.perSeriesAligner"][0])
+		assert.Equal(t, "ALIGN_DELTA", queries[0].Params["aggregation.perSeriesAligner"][0])
 		assert.Equal(t, "+60s", queries[0].Params["aggregation.alignmentPeriod"][0])
-		assert.Equal(t, "labelname", queries[0].Params["aggregation.groupByFields"][0])
+		assert.Equal(t, "metric.label.labelname", queries[0].Params["aggregation.groupByFields"][0])
 
-		assert.NotContains(t, queries[0].Params, "secondaryAggregation.crossSeriesReducer")
-		assert.NotContains(t, "REDUCE_SUM", queries[0].Params, "secondaryAggregation.perSeriesAligner")
-		assert.NotContains(t, "+60s", queries[0].Params, "secondaryAggregation.alignmentPeriod")
-		assert.NotContains(t, "labelname", queries[0].Params, "secondaryAggregation.groupByFields")
+		assert.Equal(t, "REDUCE_MIN", queries[0].Params["secondaryAggregation.crossSeriesReducer"][0])
+		assert.Equal(t, "REDUCE_SUM", queries[0].Params["secondaryAggregation.perSeriesAligner"][0])
+		assert.Equal(t, "+60s", queries[0].Params["secondaryAggregation.alignmentPeriod"][0])
+		assert.Equal(t, "metric.label.labelname", queries[0].Params["secondaryAggregation.groupByFields"][0])
 	})
 
-	t.Run("and query preprocessor is set to rate and there's no group bys", func(t *testing.T) {
+	t.Run("and query preprocessor is set to cumulative and there's no group bys", func(t *testing.T) {
 		req := baseReq()
 		req.Queries[0].JSON = json.RawMessage(`{
 			"metricType":         "a/metric/type",
-			"crossSeriesReducer": "REDUCE_SUM",
-			"perSeriesAligner":   "REDUCE_MIN",
+			"crossSeriesReducer": "REDUCE_MIN",
+			"perSeriesAligner":   "REDUCE_SUM",
 			"alignmentPeriod":    "+60s",
 			"groupBys":           [],
 			"view":               "FULL",
-			"preprocessor":       "rate"
+			"preprocessor":       "cumulative"
 		}`)
 
-		qes, err := service.buildQueryExecutors(slog, req)
+		qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
 		require.NoError(t, err)
 		queries := getCloudMonitoringQueriesFromInterface(t, qes)
 
 		assert.Equal(t, 1, len(queries))
 		assert.Equal(t, "REDUCE_NONE", queries[0].Params["aggregation.crossSeriesReducer"][0])
-		assert.Equal(t, "ALIGN_RATE", queries[0].Params["aggregation.perSeriesAligner"][0])
+		assert.Equal(t, "ALIGN_CUMULATIVE", queries[0].Params["aggregation.perSeriesAligner"][0])
 		assert.Equal(t, "+60s", queries[0].Params["aggregation.alignmentPeriod"][0])
 
-		assert.Equal(t, "REDUCE_SUM", queries[0].Params["secondaryAggregation.crossSeriesReducer"][0])
-		assert.Equal(t, "REDUCE_MIN", queries[0].Params["secondaryAggregation.perSeriesAligner"][0])
+		assert.Equal(t, "REDUCE_MIN", queries[0].Params["secondaryAggregation.crossSeriesReducer"][0])
+		assert.Equal(t, "REDUCE_SUM", queries[0].Params["secondaryAggregation.perSeriesAligner"][0])
 		assert.Equal(t, "+60s", queries[0].Params["secondaryAggregation.alignmentPeriod"][0])
 	})
 
-	t.Run("and query preprocessor is set to rate and group bys exist", func(t *testing.T) {
+	t.Run("and query preprocessor is set to cumulative and group bys exist", func(t *testing.T) {
 		req := baseReq()
 		req.Queries[0].JSON = json.RawMessage(`{
 			"metricType":         "a/metric/type",
-			"crossSeriesReducer": "REDUCE_SUM",
-			"perSeriesAligner":   "REDUCE_MIN",
+			"crossSeriesReducer": "REDUCE_MIN",
+			"perSeriesAligner":   "REDUCE_SUM",
 			"alignmentPeriod":    "+60s",
-			"groupBys":           ["labelname"],
+			"groupBys":           ["metric.label.labelname"],
 			"view":               "FULL",
-			"preprocessor":       "rate"
+			"preprocessor":       "cumulative"
 		}`)
 
-		qes, err := service.buildQueryExecutors(slog, req)
+		qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
 		require.NoError(t, err)
 		queries := getCloudMonitoringQueriesFromInterface(t, qes)
 
 		assert.Equal(t, 1, len(queries))
-		assert.Equal(t, "REDUCE_SUM", queries[0].Params["aggregation.crossSeriesReducer"][0])
-		assert.Equal(t, "ALIGN_RATE", queries[0].Params["aggregation.perSeriesAligner"][0])
+		assert.Equal(t, "REDUCE_MIN", queries[0].Params["aggregation.crossSeriesReducer"][0])
+		assert.Equal(t, "ALIGN_CUMULATIVE", queries[0].Params["aggregation.perSeriesAligner"][0])
 		assert.Equal(t, "+60s", queries[0].Params["aggregation.alignmentPeriod"][0])
-		assert.Equal(t, "labelname", queries[0].Params["aggregation.groupByFields"][0])
+		assert.Equal(t, "metric.label.labelname", queries[0].Params["aggregation.groupByFields"][0])
 
-		assert.Equal(t, "REDUCE_SUM", queries[0].Params["secondaryAggregation.crossSeriesReducer"][0])
-		assert.Equal(t, "REDUCE_MIN", queries[0].Params["secondaryAggregation.perSeriesAligner"][0])
+		assert.Equal(t, "REDUCE_MIN", queries[0].Params["secondaryAggregation.crossSeriesReducer"][0])
+		assert.Equal(t, "REDUCE_SUM", queries[0].Params["secondaryAggregation.perSeriesAligner"][0])
 		assert.Equal(t, "+60s", queries[0].Params["secondaryAggregation.alignmentPeriod"][0])
-		assert.Equal(t, "labelname", queries[0].Params["secondaryAggregation.groupByFields"][0])
+		assert.Equal(t, "metric.label.labelname", queries[0].Params["secondaryAggregation.groupByFields"][0])
 	})
 
-	t.Run("and query preprocessor is set to delta and there's no group bys", func(t *testing.T) {
+	t.Run("and query preprocessor is set to percentChange and there's no group bys", func(t *testing.T) {
 		req := baseReq()
 		req.Queries[0].JSON = json.RawMessage(`{
 			"metricType":         "a/metric/type",
-			"crossSeriesReducer": "REDUCE_MIN",
-			"perSeriesAligner":   "REDUCE_SUM",
+			"crossSeriesReducer": "REDUCE_MEAN",
+			"perSeriesAligner":   "ALIGN_MEAN",
 			"alignmentPeriod":    "+60s",
 			"groupBys":           [],
 			"view":               "FULL",
-			"preprocessor":       "delta"
+			"preprocessor":       "percentChange"
 		}`)
 
-		qes, err := service.buildQueryExecutors(slog, req)
+		qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
 		require.NoError(t, err)
 		queries := getCloudMonitoringQueriesFromInterface(t, qes)
 
 		assert.Equal(t, 1, len(queries))
 		assert.Equal(t, "REDUCE_NONE", queries[0].Params["aggregation.crossSeriesReducer"][0])
-		assert.Equal(t, "ALIGN_DELTA", queries[0].Params["aggregation.perSeriesAligner"][0])
+		assert.Equal(t, "ALIGN_PERCENT_CHANGE", queries[0].Params["aggregation.perSeriesAligner"][0])
 		assert.Equal(t, "+60s", queries[0].Params["aggregation.alignmentPeriod"][0])
 
-		assert.Equal(t, "REDUCE_MIN", queries[0].Params["secondaryAggregation.crossSeriesReducer"][0])
-		assert.Equal(t, "REDUCE_SUM", queries[0].Params["secondaryAggregation.perSeriesAligner"][0])
+		assert.Equal(t, "REDUCE_MEAN", queries[0].Params["secondaryAggregation.crossSeriesReducer"][0])
+		assert.Equal(t, "ALIGN_MEAN", queries[0].Params["secondaryAggregation.perSeriesAligner"][0])
 		assert.Equal(t, "+60s", queries[0].Params["secondaryAggregation.alignmentPeriod"][0])
 	})
 
-	t.Run("and query preprocessor is set to delta and group bys exist", func(t *testing.T) {
+	t.Run("and query preprocessor is set to percentChange and group bys exist", func(t *testing.T) {
 		req := baseReq()
 		req.Queries[0].JSON = json.RawMessage(`{
 			"metricType":         "a/metric/type",
-			"crossSeriesReducer": "REDUCE_MIN",
-			"perSeriesAligner":   "REDUCE_SUM",
+			"crossSeriesReducer": "REDUCE_MEAN",
+			"perSeriesAligner":   "ALIGN_MEAN",
 			"alignmentPeriod":    "+60s",
-			"groupBys":           ["labelname"],
+			"groupBys":           ["metric.label.labelname"],
 			"view":               "FULL",
-			"preprocessor":       "delta"
+			"preprocessor":       "percentChange"
 		}`)
 
-		qes, err := service.buildQueryExecutors(slog, req)
+		qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
 		require.NoError(t, err)
 		queries := getCloudMonitoringQueriesFromInterface(t, qes)
 
 		assert.Equal(t, 1, len(queries))
-		assert.Equal(t, "REDUCE_MIN", queries[0].Params["aggregation.crossSeriesReducer"][0])
-		assert.Equal(t, "ALIGN_DELTA", queries[0].Params["aggregation.perSeriesAligner"][0])
+		assert.Equal(t, "REDUCE_MEAN", queries[0].Params["aggregation.crossSeriesReducer"][0])
+		assert.Equal(t, "ALIGN_PERCENT_CHANGE", queries[0].Params["aggregation.perSeriesAligner"][0])
 		assert.Equal(t, "+60s", queries[0].Params["aggregation.alignmentPeriod"][0])
-		assert.Equal(t, "labelname", queries[0].Params["aggregation.groupByFields"][0])
+		assert.Equal(t, "metric.label.labelname", queries[0].Params["aggregation.groupByFields"][0])
 
-		assert.Equal(t, "REDUCE_MIN", queries[0].Params["secondaryAggregation.crossSeriesReducer"][0])
-		assert.Equal(t, "REDUCE_SUM", queries[0].Params["secondaryAggregation.perSeriesAligner"][0])
+		assert.Equal(t, "REDUCE_MEAN", queries[0].Params["secondaryAggregation.crossSeriesReducer"][0])
+		assert.Equal(t, "ALIGN_MEAN", queries[0].Params["secondaryAggregation.perSeriesAligner"][0])
 		assert.Equal(t, "+60s", queries[0].Params["secondaryAggregation.alignmentPeriod"][0])
-		assert.Equal(t, "labelname", queries[0].Params["secondaryAggregation.groupByFields"][0])
+		assert.Equal(t, "metric.label.labelname", queries[0].Params["secondaryAggregation.groupByFields"][0])
+	})
+
+	t.Run("when generating cache keys", func(t *testing.T) {
+		buildKey := func(t *testing.T, queryJSON string) string {
+			t.Helper()
+			req := baseReq()
+			req.Queries[0].JSON = json.RawMessage(queryJSON)
+			qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+			require.NoError(t, err)
+			require.Len(t, qes, 1)
+			return qes[0].CacheKey()
+		}
+
+		t.Run("identical metric queries produce the same key", func(t *testing.T) {
+			query := `{"metricType": "a/metric/type", "filters": ["key", "=", "value"], "view": "FULL"}`
+			assert.Equal(t, buildKey(t, query), buildKey(t, query))
+		})
+
+		t.Run("a changed filter changes the key", func(t *testing.T) {
+			assert.NotEqual(t,
+				buildKey(t, `{"metricType": "a/metric/type", "filters": ["key", "=", "value"], "view": "FULL"}`),
+				buildKey(t, `{"metricType": "a/metric/type", "filters": ["key", "=", "other"], "view": "FULL"}`),
+			)
+		})
+
+		t.Run("identical MQL queries produce the same key and a changed query changes it", func(t *testing.T) {
+			query := `{"queryType": "metrics", "metricQuery": {"editorMode": "mql", "projectName": "test-proj", "query": "fetch gce_instance"}}`
+			changed := `{"queryType": "metrics", "metricQuery": {"editorMode": "mql", "projectName": "test-proj", "query": "fetch gae_app"}}`
+			assert.Equal(t, buildKey(t, query), buildKey(t, query))
+			assert.NotEqual(t, buildKey(t, query), buildKey(t, changed))
+		})
+
+		t.Run("the key doesn't change when running the query changes it", func(t *testing.T) {
+			req := baseReq()
+			req.Queries[0].JSON = json.RawMessage(`{"metricType": "a/metric/type", "view": "FULL"}`)
+			qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+			require.NoError(t, err)
+			queries := getCloudMonitoringQueriesFromInterface(t, qes)
+			key := queries[0].CacheKey()
+			queries[0].applyCumulativeAlignerDefault(metricDescriptor{MetricKind: "CUMULATIVE", ValueType: "INT64"})
+			require.Equal(t, alignRate, queries[0].Params.Get("aggregation.perSeriesAligner"))
+			assert.Equal(t, key, queries[0].CacheKey())
+
+			req.Queries[0].JSON = json.RawMessage(`{"queryType": "metrics", "metricQuery": {"editorMode": "mql", "projectName": "test-proj", "query": "fetch gce_instance | within 1h"}}`)
+			qes, err = service.buildQueryExecutors(slog, req, datasourceInfo{})
+			require.NoError(t, err)
+			mql, ok := qes[0].(*cloudMonitoringTimeSeriesQuery)
+			require.True(t, ok)
+			key = mql.CacheKey()
+			mql.removeWithinClauses()
+			require.Equal(t, "fetch gce_instance", mql.Query)
+			assert.Equal(t, key, mql.CacheKey())
+		})
+	})
+
+	t.Run("and an SLO query has a preprocessor", func(t *testing.T) {
+		t.Run("the preprocessor aligns the compliance and the selector's aligner becomes secondary", func(t *testing.T) {
+			req := baseReq()
+			req.Queries[0].JSON = json.RawMessage(`{
+				"queryType": "slo",
+				"sloQuery": {
+					"projectName":     "test-proj",
+					"alignmentPeriod": "+60s",
+					"selectorName":    "select_slo_compliance",
+					"serviceId":       "test-service",
+					"sloId":           "test-slo",
+					"preprocessor":    "rate"
+				}
+			}`)
+
+			qes, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+			require.NoError(t, err)
+			queries := getCloudMonitoringQueriesFromInterface(t, qes)
+
+			require.Len(t, queries, 1)
+			assert.Equal(t, "ALIGN_RATE", queries[0].Params.Get("aggregation.perSeriesAligner"))
+			assert.Equal(t, "+60s", queries[0].Params.Get("aggregation.alignmentPeriod"))
+			assert.Equal(t, "ALIGN_NEXT_OLDER", queries[0].Params.Get("secondaryAggregation.perSeriesAligner"))
+			assert.Equal(t, "+60s", queries[0].Params.Get("secondaryAggregation.alignmentPeriod"))
+		})
+
+		t.Run("a preprocessor on the health selector returns an error", func(t *testing.T) {
+			req := baseReq()
+			req.Queries[0].JSON = json.RawMessage(`{
+				"queryType": "slo",
+				"sloQuery": {
+					"projectName":  "test-proj",
+					"selectorName": "select_slo_health",
+					"serviceId":    "test-service",
+					"sloId":        "test-slo",
+					"preprocessor": "rate"
+				}
+			}`)
+
+			_, err := service.buildQueryExecutors(slog, req, datasourceInfo{})
+			require.Error(t, err)
+			assert.Equal(t, "invalid SLO query: the rate preprocessor can't be used with select_slo_health", err.Error())
+		})
 	})
 }
 
@@ -959,6 +2424,25 @@ func baseReq() *backend.QueryDataRequest {
 }
 
 func TestCheckHealth(t *testing.T) {
+	t.Run("and the credentials file can't be read should return an error", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "missing.json")
+		im := datasource.NewInstanceManager(func(s backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
+			return &datasourceInfo{
+				authenticationType:  jwtAuthentication,
+				credentialsFilePath: path,
+			}, nil
+		})
+		service := &Service{im: im}
+		res, err := service.CheckHealth(context.Background(), &backend.CheckHealthRequest{
+			PluginContext: backend.PluginContext{
+				DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{},
+			},
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, backend.HealthStatusError, res.Status)
+		assert.Contains(t, res.Message, "failed to load credentials file")
+		assert.NotContains(t, res.Message, path)
+	})
 	t.Run("and using GCE authentation should return proper error", func(t *testing.T) {
 		im := datasource.NewInstanceManager(func(s backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
 			return &datasourceInfo{
@@ -982,4 +2466,202 @@ func TestCheckHealth(t *testing.T) {
 			Message: "not found!",
 		}, res)
 	})
+	t.Run("and the API denies access should return the upstream message", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/v3/projects/test-proj/metricDescriptors", r.URL.Path)
+			w.WriteHeader(http.StatusForbidden)
+			_, err := w.Write([]byte(`{"error": {"code": 403, "message": "Permission monitoring.metricDescriptors.list denied (or the resource may not exist).", "status": "PERMISSION_DENIED"}}`))
+			require.NoError(t, err)
+		}))
+		defer srv.Close()
+		im := datasource.NewInstanceManager(func(s backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
+			return &datasourceInfo{
+				authenticationType: jwtAuthentication,
+				defaultProject:     "test-proj",
+				services: map[string]datasourceService{
+					cloudMonitor: {url: srv.URL, client: srv.Client()},
+				},
+			}, nil
+		})
+		service := &Service{im: im}
+		res, err := service.CheckHealth(context.Background(), &backend.CheckHealthRequest{
+			PluginContext: backend.PluginContext{
+				DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{},
+			},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, backend.HealthStatusError, res.Status)
+		assert.Equal(t, "403 Forbidden: Permission monitoring.metricDescriptors.list denied (or the resource may not exist).", res.Message)
+	})
+
+	t.Run("and the API responds successfully should return ok", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "1", r.URL.Query().Get("pageSize"))
+			_, err := w.Write([]byte(`{"metricDescriptors": []}`))
+			require.NoError(t, err)
+		}))
+		defer srv.Close()
+		im := datasource.NewInstanceManager(func(s backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
+			return &datasourceInfo{
+				authenticationType: jwtAuthentication,
+				defaultProject:     "test-proj",
+				services: map[string]datasourceService{
+					cloudMonitor: {url: srv.URL, client: srv.Client()},
+				},
+			}, nil
+		})
+		service := &Service{im: im}
+		res, err := service.CheckHealth(context.Background(), &backend.CheckHealthRequest{
+			PluginContext: backend.PluginContext{
+				DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{},
+			},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, backend.HealthStatusOk, res.Status)
+	})
+	t.Run("and the API endpoint override is not https should return an error", func(t *testing.T) {
+		im := datasource.NewInstanceManager(func(s backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
+			return &datasourceInfo{
+				authenticationType: jwtAuthentication,
+				defaultProject:     "test-proj",
+				apiEndpoint:        "http://monitoring.example.com",
+			}, nil
+		})
+		service := &Service{im: im}
+		res, err := service.CheckHealth(context.Background(), &backend.CheckHealthRequest{
+			PluginContext: backend.PluginContext{
+				DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{},
+			},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, backend.HealthStatusError, res.Status)
+		assert.Contains(t, res.Message, "invalid API endpoint")
+	})
+}
+
+func TestNewInstanceSettings(t *testing.T) {
+	t.Run("uses the public endpoint by default", func(t *testing.T) {
+		instance, err := newInstanceSettings(httpclient.NewProvider(), "")(backend.DataSourceInstanceSettings{
+			JSONData: json.RawMessage(`{"authenticationType": "gce"}`),
+		})
+		require.NoError(t, err)
+		dsInfo, ok := instance.(*datasourceInfo)
+		require.True(t, ok)
+
+		req, err := (&Service{}).createRequest(slog, dsInfo, "/v3/projects/test-proj/timeSeries", nil)
+		require.NoError(t, err)
+		assert.Equal(t, "https://monitoring.googleapis.com/v3/projects/test-proj/timeSeries", req.URL.String())
+	})
+
+	t.Run("parses the minimum alignment period", func(t *testing.T) {
+		tests := map[string]time.Duration{
+			"15s":   15 * time.Second,
+			"+30s":  30 * time.Second,
+			"500ms": time.Second,
+		}
+		for value, expected := range tests {
+			instance, err := newInstanceSettings(httpclient.NewProvider(), "")(backend.DataSourceInstanceSettings{
+				JSONData: json.RawMessage(fmt.Sprintf(`{"authenticationType": "gce", "minAlignmentPeriod": %q}`, value)),
+			})
+			require.NoError(t, err)
+			dsInfo, ok := instance.(*datasourceInfo)
+			require.True(t, ok)
+			assert.Equal(t, expected, dsInfo.minAlignmentPeriod, value)
+		}
+
+		_, err := newInstanceSettings(httpclient.NewProvider(), "")(backend.DataSourceInstanceSettings{
+			JSONData: json.RawMessage(`{"authenticationType": "gce", "minAlignmentPeriod": "fifteen seconds"}`),
+		})
+		require.Error(t, err)
+
+		_, err = newInstanceSettings(httpclient.NewProvider(), "")(backend.DataSourceInstanceSettings{
+			JSONData: json.RawMessage(`{"authenticationType": "gce", "minAlignmentPeriod": 15}`),
+		})
+		require.Error(t, err)
+	})
+
+	t.Run("uses the API endpoint override when set", func(t *testing.T) {
+		instance, err := newInstanceSettings(httpclient.NewProvider(), "")(backend.DataSourceInstanceSettings{
+			JSONData: json.RawMessage(`{"authenticationType": "gce", "apiEndpoint": "https://monitoring.us-central1.rep.googleapis.com/"}`),
+		})
+		require.NoError(t, err)
+		dsInfo, ok := instance.(*datasourceInfo)
+		require.True(t, ok)
+
+		req, err := (&Service{}).createRequest(slog, dsInfo, "/v3/projects/test-proj/timeSeries", nil)
+		require.NoError(t, err)
+		assert.Equal(t, "https://monitoring.us-central1.rep.googleapis.com/v3/projects/test-proj/timeSeries", req.URL.String())
+		assert.Equal(t, routes[resourceManager].url, dsInfo.services[resourceManager].url)
+	})
+
+	t.Run("only accepts credentials files in the credentials files directory", func(t *testing.T) {
+		dir := t.TempDir()
+		newInstance := func(credentialsFilesDir string, credentialsFilePath string) (*datasourceInfo, error) {
+			instance, err := newInstanceSettings(httpclient.NewProvider(), credentialsFilesDir)(backend.DataSourceInstanceSettings{
+				JSONData: json.RawMessage(fmt.Sprintf(`{"authenticationType": "jwt", "credentialsFilePath": %q}`, credentialsFilePath)),
+			})
+			if err != nil {
+				return nil, err
+			}
+			return instance.(*datasourceInfo), nil
+		}
+
+		dsInfo, err := newInstance(dir, "sa.json")
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(dir, "sa.json"), dsInfo.credentialsFilePath)
+
+		dsInfo, err = newInstance(dir, filepath.Join(dir, "team", "sa.json"))
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(dir, "team", "sa.json"), dsInfo.credentialsFilePath)
+
+		for _, path := range []string{"/etc/passwd", "../sa.json", filepath.Join(dir, "..", "sa.json"), dir} {
+			_, err := newInstance(dir, path)
+			require.Error(t, err, path)
+			assert.NotContains(t, err.Error(), path)
+		}
+
+		_, err = newInstance("", filepath.Join(dir, "sa.json"))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "credentials files are not enabled")
+	})
+
+	t.Run("rejects an invalid API endpoint override", func(t *testing.T) {
+		for _, apiEndpoint := range []string{"http://monitoring.example.com", "https://proxy.example.com/monitoring", "https://monitoring.example.com?x=1"} {
+			_, err := newInstanceSettings(httpclient.NewProvider(), "")(backend.DataSourceInstanceSettings{
+				JSONData: json.RawMessage(fmt.Sprintf(`{"authenticationType": "gce", "apiEndpoint": %q}`, apiEndpoint)),
+			})
+			require.Error(t, err, apiEndpoint)
+			assert.Contains(t, err.Error(), "invalid API endpoint", apiEndpoint)
+		}
+	})
+}
+
+func TestBucketBounds(t *testing.T) {
+	t.Run("exponential bounds", func(t *testing.T) {
+		bounds := computeExponentialBounds(2, 1.5, 3)
+		assert.Equal(t, []float64{1.5, 3, 6, 12}, bounds)
+	})
+
+	t.Run("linear bounds", func(t *testing.T) {
+		bounds := computeLinearBounds(1, 0.5, 3)
+		assert.Equal(t, []float64{1, 1.5, 2, 2.5}, bounds)
+		assert.Nil(t, computeLinearBounds(1, 0.5, -1))
+	})
+
+	t.Run("explicit bounds are used as they are", func(t *testing.T) {
+		bucketOptions := cloudMonitoringBucketOptions{ExplicitBuckets: &struct {
+			Bounds []float64 `json:"bounds"`
+		}{Bounds: []float64{0.5, 2, 10}}}
+
+		labels := make([]string, 0, 5)
+		for i := 0; i < 5; i++ {
+			labels = append(labels, calcBucketBound(bucketOptions, i))
+		}
+		assert.Equal(t, []string{"0", "2", "10", "10+", "10+"}, labels)
+	})
+
+	t.Run("exponential bounds without finite buckets", func(t *testing.T) {
+		assert.Equal(t, []float64{10}, computeExponentialBounds(3, 10, 0))
+		assert.Nil(t, computeExponentialBounds(3, 10, -1))
+	})
 }
@@ -0,0 +1,13 @@
+package cloudmonitoring
+
+import "errors"
+
+var (
+	ErrInvalidQuery           = errors.New("could not unmarshal CloudMonitoringQuery json")
+	ErrUnsupportedQueryType   = errors.New("unsupported query type")
+	ErrMissingMetricType      = errors.New("missing metric type")
+	ErrInvalidAlignmentPeriod = errors.New("invalid alignment period")
+	ErrInvalidLookbackPeriod  = errors.New("invalid lookback period")
+	ErrInvalidFillMissing     = errors.New("invalid fill missing mode")
+	ErrInvalidGroupBy         = errors.New("invalid group by field")
+)
@@ -1,10 +1,23 @@
 package cloudmonitoring
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/grafana/grafana-google-sdk-go/pkg/tokenprovider"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/jwt"
+	"google.golang.org/api/impersonate"
+
 	infrahttp "github.com/grafana/grafana/pkg/infra/httpclient"
 )
 
@@ -33,6 +46,15 @@ var routes = map[string]routeInfo{
 }
 
 func getMiddleware(model *datasourceInfo, routePath string) (httpclient.Middleware, error) {
+	provider, err := getTokenProvider(model, routePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return tokenprovider.AuthMiddleware(provider), nil
+}
+
+func getTokenProvider(model *datasourceInfo, routePath string) (tokenprovider.TokenProvider, error) {
 	providerConfig := tokenprovider.Config{
 		RoutePath:         routePath,
 		RouteMethod:       routes[routePath].method,
@@ -46,15 +68,208 @@ func getMiddleware(model *datasourceInfo, routePath string) (httpclient.Middlewa
 	case gceAuthentication:
 		provider = tokenprovider.NewGceAccessTokenProvider(providerConfig)
 	case jwtAuthentication:
-		providerConfig.JwtTokenConfig = &tokenprovider.JwtTokenConfig{
-			Email:      model.clientEmail,
-			URI:        model.tokenUri,
-			PrivateKey: []byte(model.decryptedSecureJSONData["privateKey"]),
+		// a mounted credentials file takes the place of the key stored with the datasource
+		if model.credentialsFilePath != "" {
+			provider = &credentialsFileTokenProvider{
+				path:   model.credentialsFilePath,
+				scopes: routes[routePath].scopes,
+			}
+			break
+		}
+		tokens := model.jwtTokens
+		if tokens == nil {
+			tokens = newJWTTokenCache()
+		}
+		provider = &jwtTokenProvider{
+			route:  routePath,
+			tokens: tokens,
+			config: &jwt.Config{
+				Email:      model.clientEmail,
+				PrivateKey: []byte(model.decryptedSecureJSONData["privateKey"]),
+				TokenURL:   model.tokenUri,
+				Scopes:     routes[routePath].scopes,
+			},
+		}
+	case impersonationAuthentication:
+		if model.targetPrincipal == "" {
+			return nil, fmt.Errorf("a target principal is required for %s authentication", impersonationAuthentication)
+		}
+		provider = &impersonationTokenProvider{
+			targetPrincipal: model.targetPrincipal,
+			scopes:          routes[routePath].scopes,
 		}
-		provider = tokenprovider.NewJwtAccessTokenProvider(providerConfig)
 	}
 
-	return tokenprovider.AuthMiddleware(provider), nil
+	return provider, nil
+}
+
+// newImpersonatedTokenSource returns a token source impersonating the configured service account,
+// using the application default credentials as base identity. Stubbable by tests.
+var newImpersonatedTokenSource = func(ctx context.Context, config impersonate.CredentialsConfig) (oauth2.TokenSource, error) {
+	return impersonate.CredentialsTokenSource(ctx, config)
+}
+
+// impersonationTokenProvider generates short-lived access tokens for a target service account
+// through the IAM Credentials generateAccessToken API
+type impersonationTokenProvider struct {
+	targetPrincipal string
+	scopes          []string
+
+	mu          sync.Mutex
+	tokenSource oauth2.TokenSource
+}
+
+func (provider *impersonationTokenProvider) GetAccessToken(_ context.Context) (string, error) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	if provider.tokenSource == nil {
+		// the token source outlives the request, so it must not be bound to the request context
+		tokenSource, err := newImpersonatedTokenSource(context.Background(), impersonate.CredentialsConfig{
+			TargetPrincipal: provider.targetPrincipal,
+			Scopes:          provider.scopes,
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to impersonate %s: %w", provider.targetPrincipal, err)
+		}
+		provider.tokenSource = tokenSource
+	}
+
+	token, err := provider.tokenSource.Token()
+	if err != nil {
+		return "", fmt.Errorf("failed to impersonate %s: %w", provider.targetPrincipal, err)
+	}
+	return token.AccessToken, nil
+}
+
+// errCredentialsFile is returned for any credentials file that can't be used. The path and the
+// cause are only logged, so datasource editors can't probe the files on the Grafana server.
+var errCredentialsFile = errors.New("failed to load credentials file")
+
+// resolveCredentialsFilePath returns the cleaned path of a credentials file, which must be inside
+// the credentials files directory configured by the server admin
+func resolveCredentialsFilePath(dir string, path string) (string, error) {
+	if dir == "" {
+		return "", errors.New("credentials files are not enabled on this Grafana server")
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", errCredentialsFile
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	path = filepath.Clean(path)
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New("the credentials file must be in the credentials files directory of the Grafana server")
+	}
+	return path, nil
+}
+
+// newCredentialsFileTokenSource returns a token source for the application default credentials
+// file at path. Stubbable by tests.
+var newCredentialsFileTokenSource = func(ctx context.Context, path string, scopes []string) (oauth2.TokenSource, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		slog.Warn("Failed to read credentials file", "path", path, "error", err)
+		return nil, errCredentialsFile
+	}
+
+	credentials, err := google.CredentialsFromJSON(ctx, data, scopes...)
+	if err != nil {
+		slog.Warn("Failed to parse credentials file", "path", path, "error", err)
+		return nil, errCredentialsFile
+	}
+	return credentials.TokenSource, nil
+}
+
+// credentialsFileTokenProvider generates access tokens from an application default credentials
+// file mounted on the Grafana server
+type credentialsFileTokenProvider struct {
+	path   string
+	scopes []string
+
+	mu          sync.Mutex
+	tokenSource oauth2.TokenSource
+}
+
+func (provider *credentialsFileTokenProvider) GetAccessToken(_ context.Context) (string, error) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	if provider.tokenSource == nil {
+		// the token source outlives the request, so it must not be bound to the request context
+		tokenSource, err := newCredentialsFileTokenSource(context.Background(), provider.path, provider.scopes)
+		if err != nil {
+			return "", err
+		}
+		provider.tokenSource = tokenSource
+	}
+
+	token, err := provider.tokenSource.Token()
+	if err != nil {
+		return "", fmt.Errorf("failed to get access token from credentials file: %w", err)
+	}
+	return token.AccessToken, nil
+}
+
+// jwtTokenRefreshMargin is how long before its expiry a cached JWT access token is refreshed
+const jwtTokenRefreshMargin = time.Minute
+
+// newJWTTokenSource returns a token source minting access tokens with the service account key.
+// Stubbable by tests.
+var newJWTTokenSource = func(ctx context.Context, config *jwt.Config) oauth2.TokenSource {
+	return config.TokenSource(ctx)
+}
+
+// jwtTokenCache holds the access tokens of a datasource instance by route, as the routes request
+// different scopes. A single lock makes concurrent queries wait for one refresh instead of each
+// minting their own token.
+type jwtTokenCache struct {
+	mu     sync.Mutex
+	tokens map[string]*oauth2.Token
+}
+
+func newJWTTokenCache() *jwtTokenCache {
+	return &jwtTokenCache{tokens: map[string]*oauth2.Token{}}
+}
+
+// jwtTokenProvider gets the access token of a route from the cache of the datasource instance,
+// it's refreshed shortly before it expires
+type jwtTokenProvider struct {
+	route  string
+	config *jwt.Config
+	tokens *jwtTokenCache
+}
+
+func (provider *jwtTokenProvider) GetAccessToken(ctx context.Context) (string, error) {
+	provider.tokens.mu.Lock()
+	defer provider.tokens.mu.Unlock()
+
+	if token := provider.tokens.tokens[provider.route]; token != nil && token.Expiry.After(time.Now().Add(jwtTokenRefreshMargin)) {
+		return token.AccessToken, nil
+	}
+
+	token, err := newJWTTokenSource(ctx, provider.config).Token()
+	if err != nil {
+		return "", fmt.Errorf("failed to get access token for %s: %w", provider.config.Email, err)
+	}
+	provider.tokens.tokens[provider.route] = token
+	return token.AccessToken, nil
+}
+
+const quotaProjectMiddlewareName = "cloudmonitoring-quota-project"
+
+// quotaProjectMiddleware bills the quota of the requests to the given project instead of the
+// project of the credentials
+func quotaProjectMiddleware(quotaProject string) httpclient.Middleware {
+	return httpclient.NamedMiddlewareFunc(quotaProjectMiddlewareName, func(opts httpclient.Options, next http.RoundTripper) http.RoundTripper {
+		return httpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			req.Header.Set("X-Goog-User-Project", quotaProject)
+			return next.RoundTrip(req)
+		})
+	})
 }
 
 func newHTTPClient(model *datasourceInfo, opts httpclient.Options, clientProvider infrahttp.Provider, route string) (*http.Client, error) {
@@ -64,5 +279,13 @@ func newHTTPClient(model *datasourceInfo, opts httpclient.Options, clientProvide
 	}
 
 	opts.Middlewares = append(opts.Middlewares, m)
+	// the TLS settings are meant for a custom Monitoring API endpoint, such as an internal proxy.
+	// The other routes always use the system trust store.
+	if route != cloudMonitor {
+		opts.TLS = nil
+	}
+	if route == cloudMonitor && model.quotaProject != "" {
+		opts.Middlewares = append(opts.Middlewares, quotaProjectMiddleware(model.quotaProject))
+	}
 	return clientProvider.New(opts)
 }
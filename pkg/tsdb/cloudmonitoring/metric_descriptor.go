@@ -0,0 +1,102 @@
+package cloudmonitoring
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// descriptorCacheTTL is how long metric descriptors are cached per datasource instance
+const descriptorCacheTTL = 5 * time.Minute
+
+// alignerRequirements lists the metric kinds and value types an aligner can be applied to.
+// Aligners that aren't listed, or an empty list, aren't restricted.
+// https://cloud.google.com/monitoring/api/ref_v3/rest/v3/projects.alertPolicies#Aligner
+var alignerRequirements = map[string]struct {
+	metricKinds []string
+	valueTypes  []string
+}{
+	"ALIGN_DELTA":          {metricKinds: []string{"DELTA", "CUMULATIVE"}, valueTypes: []string{"INT64", "DOUBLE", "MONEY", "DISTRIBUTION"}},
+	"ALIGN_RATE":           {metricKinds: []string{"DELTA", "CUMULATIVE"}, valueTypes: []string{"INT64", "DOUBLE", "MONEY"}},
+	"ALIGN_INTERPOLATE":    {metricKinds: []string{"GAUGE"}, valueTypes: []string{"INT64", "DOUBLE", "MONEY"}},
+	"ALIGN_MIN":            {valueTypes: []string{"INT64", "DOUBLE", "MONEY"}},
+	"ALIGN_MAX":            {valueTypes: []string{"INT64", "DOUBLE", "MONEY"}},
+	"ALIGN_MEAN":           {valueTypes: []string{"INT64", "DOUBLE", "MONEY", "DISTRIBUTION"}},
+	"ALIGN_SUM":            {valueTypes: []string{"INT64", "DOUBLE", "MONEY", "DISTRIBUTION"}},
+	"ALIGN_STDDEV":         {valueTypes: []string{"INT64", "DOUBLE", "MONEY", "DISTRIBUTION"}},
+	"ALIGN_COUNT_TRUE":     {valueTypes: []string{"BOOL"}},
+	"ALIGN_COUNT_FALSE":    {valueTypes: []string{"BOOL"}},
+	"ALIGN_FRACTION_TRUE":  {valueTypes: []string{"BOOL"}},
+	"ALIGN_PERCENTILE_99":  {valueTypes: []string{"DISTRIBUTION"}},
+	"ALIGN_PERCENTILE_95":  {valueTypes: []string{"DISTRIBUTION"}},
+	"ALIGN_PERCENTILE_50":  {valueTypes: []string{"DISTRIBUTION"}},
+	"ALIGN_PERCENTILE_05":  {valueTypes: []string{"DISTRIBUTION"}},
+	"ALIGN_PERCENT_CHANGE": {valueTypes: []string{"INT64", "DOUBLE", "MONEY"}},
+}
+
+// validateAligner returns an error when the per series aligner can't be applied to a metric
+// with the given descriptor. Unknown aligners are left for the API to validate.
+func validateAligner(aligner string, descriptor metricDescriptor) error {
+	requirements, ok := alignerRequirements[aligner]
+	if !ok {
+		return nil
+	}
+
+	if len(requirements.metricKinds) > 0 && descriptor.MetricKind != "" && !containsLabel(requirements.metricKinds, descriptor.MetricKind) {
+		return fmt.Errorf("aligner %s can't be used with %s metric %s, it requires a metric of kind %s",
+			aligner, descriptor.MetricKind, descriptor.Type, strings.Join(requirements.metricKinds, " or "))
+	}
+
+	if len(requirements.valueTypes) > 0 && descriptor.ValueType != "" && !containsLabel(requirements.valueTypes, descriptor.ValueType) {
+		return fmt.Errorf("aligner %s can't be used with %s metric %s, it requires a value type of %s",
+			aligner, descriptor.ValueType, descriptor.Type, strings.Join(requirements.valueTypes, " or "))
+	}
+
+	return nil
+}
+
+// getMetricDescriptor fetches the descriptor of a single metric type, descriptors are cached
+// per project and metric type
+func getMetricDescriptor(ctx context.Context, dsInfo datasourceInfo, projectName, metricType string) (metricDescriptor, error) {
+	cacheKey := projectName + "/" + metricType
+	if dsInfo.descriptorCache != nil {
+		if cached, ok := dsInfo.descriptorCache.Get(cacheKey); ok {
+			return cached.(metricDescriptor), nil
+		}
+	}
+
+	u := dsInfo.services[cloudMonitor].url + path.Join("/v3/projects", projectName, "metricDescriptors", metricType)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return metricDescriptor{}, err
+	}
+
+	res, err := dsInfo.services[cloudMonitor].client.Do(req)
+	if err != nil {
+		return metricDescriptor{}, err
+	}
+	defer func() {
+		if err := res.Body.Close(); err != nil {
+			slog.Warn("Failed to close response body", "err", err)
+		}
+	}()
+
+	if res.StatusCode != http.StatusOK {
+		return metricDescriptor{}, fmt.Errorf("failed to get metric descriptor for %s: %s", metricType, res.Status)
+	}
+
+	var descriptor metricDescriptor
+	if err := json.NewDecoder(res.Body).Decode(&descriptor); err != nil {
+		return metricDescriptor{}, err
+	}
+
+	if dsInfo.descriptorCache != nil {
+		dsInfo.descriptorCache.Set(cacheKey, descriptor, descriptorCacheTTL)
+	}
+
+	return descriptor, nil
+}
@@ -0,0 +1,293 @@
+package cloudmonitoring
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/localcache"
+	"github.com/grafana/grafana/pkg/infra/tracing"
+)
+
+func TestValidateAligner(t *testing.T) {
+	t.Run("rate on a gauge metric is rejected", func(t *testing.T) {
+		err := validateAligner("ALIGN_RATE", metricDescriptor{Type: "a/gauge", MetricKind: "GAUGE", ValueType: "DOUBLE"})
+		require.Error(t, err)
+		assert.Equal(t, "aligner ALIGN_RATE can't be used with GAUGE metric a/gauge, it requires a metric of kind DELTA or CUMULATIVE", err.Error())
+	})
+
+	t.Run("rate on a cumulative metric is accepted", func(t *testing.T) {
+		assert.NoError(t, validateAligner("ALIGN_RATE", metricDescriptor{Type: "a/counter", MetricKind: "CUMULATIVE", ValueType: "INT64"}))
+	})
+
+	t.Run("fraction true on a double metric is rejected", func(t *testing.T) {
+		err := validateAligner("ALIGN_FRACTION_TRUE", metricDescriptor{Type: "a/gauge", MetricKind: "GAUGE", ValueType: "DOUBLE"})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "it requires a value type of BOOL")
+	})
+
+	t.Run("unknown aligners are not validated", func(t *testing.T) {
+		assert.NoError(t, validateAligner("ALIGN_SOMETHING_NEW", metricDescriptor{MetricKind: "GAUGE", ValueType: "DOUBLE"}))
+	})
+}
+
+func TestTimeSeriesFilterAlignerValidation(t *testing.T) {
+	runQuery := func(t *testing.T, aligner string, descriptorStatus int) *backend.DataResponse {
+		t.Helper()
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/v3/projects/test-proj/metricDescriptors/compute.googleapis.com/instance/cpu/utilization" {
+				w.WriteHeader(descriptorStatus)
+				_, _ = w.Write([]byte(`{"type": "compute.googleapis.com/instance/cpu/utilization", "metricKind": "GAUGE", "valueType": "DOUBLE"}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"timeSeries": []}`))
+		}))
+		t.Cleanup(srv.Close)
+
+		dsInfo := datasourceInfo{
+			services: map[string]datasourceService{
+				cloudMonitor: {url: srv.URL, client: srv.Client()},
+			},
+		}
+		query := &cloudMonitoringTimeSeriesFilter{
+			RefID:       "A",
+			ProjectName: "test-proj",
+			MetricType:  "compute.googleapis.com/instance/cpu/utilization",
+			Params:      url.Values{"aggregation.perSeriesAligner": []string{aligner}},
+			logger:      slog,
+		}
+
+		dr, _, _, err := query.run(context.Background(), baseReq(), &Service{}, dsInfo, tracing.InitializeTracerForTest())
+		require.NoError(t, err)
+		return dr
+	}
+
+	t.Run("an illegal aligner fails the query", func(t *testing.T) {
+		dr := runQuery(t, "ALIGN_RATE", http.StatusOK)
+		require.Error(t, dr.Error)
+		assert.Contains(t, dr.Error.Error(), "requires a metric of kind DELTA or CUMULATIVE")
+	})
+
+	t.Run("a legal aligner runs the query", func(t *testing.T) {
+		dr := runQuery(t, "ALIGN_MEAN", http.StatusOK)
+		assert.NoError(t, dr.Error)
+	})
+
+	t.Run("an unavailable descriptor does not block the query", func(t *testing.T) {
+		dr := runQuery(t, "ALIGN_RATE", http.StatusForbidden)
+		assert.NoError(t, dr.Error)
+	})
+}
+
+func TestTimeSeriesFilterDescriptorFieldConfig(t *testing.T) {
+	runQuery := func(t *testing.T, unit string, description string) *backend.DataResponse {
+		t.Helper()
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/v3/projects/test-proj/metricDescriptors/compute.googleapis.com/instance/network/received_bytes_count" {
+				_, _ = w.Write([]byte(`{"type": "compute.googleapis.com/instance/network/received_bytes_count", "metricKind": "DELTA", "valueType": "INT64", "unit": "` + unit + `", "description": "` + description + `"}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"timeSeries": [{"metric": {"type": "compute.googleapis.com/instance/network/received_bytes_count"}, "resource": {"type": "gce_instance"}, "valueType": "INT64", "points": []}]}`))
+		}))
+		t.Cleanup(srv.Close)
+
+		dsInfo := datasourceInfo{
+			services: map[string]datasourceService{
+				cloudMonitor: {url: srv.URL, client: srv.Client()},
+			},
+		}
+		query := &cloudMonitoringTimeSeriesFilter{
+			RefID:       "A",
+			ProjectName: "test-proj",
+			MetricType:  "compute.googleapis.com/instance/network/received_bytes_count",
+			Params:      url.Values{},
+			logger:      slog,
+		}
+
+		dr, resp, executedQueryString, err := query.run(context.Background(), baseReq(), &Service{}, dsInfo, tracing.InitializeTracerForTest())
+		require.NoError(t, err)
+		require.NoError(t, dr.Error)
+		require.NoError(t, query.parseResponse(dr, resp, executedQueryString))
+		require.Len(t, dr.Frames, 1)
+		return dr
+	}
+
+	t.Run("a known unit is mapped to the field config", func(t *testing.T) {
+		dr := runQuery(t, "By", "")
+		assert.Equal(t, "bytes", dr.Frames[0].Fields[1].Config.Unit)
+	})
+
+	t.Run("an unknown unit is left unset", func(t *testing.T) {
+		dr := runQuery(t, "{packets}", "")
+		assert.Equal(t, "", dr.Frames[0].Fields[1].Config.Unit)
+	})
+
+	t.Run("the description is set on the field config", func(t *testing.T) {
+		dr := runQuery(t, "By", "Count of bytes received from the network.")
+		assert.Equal(t, "Count of bytes received from the network.", dr.Frames[0].Fields[1].Config.Description)
+	})
+
+	t.Run("a long description is truncated", func(t *testing.T) {
+		dr := runQuery(t, "By", strings.Repeat("a", 300))
+		description := dr.Frames[0].Fields[1].Config.Description
+		assert.Equal(t, maxFieldDescriptionLength, len([]rune(description)))
+		assert.True(t, strings.HasSuffix(description, "…"))
+	})
+}
+
+func TestTimeSeriesFilterDescriptorFrameMeta(t *testing.T) {
+	runQuery := func(t *testing.T, descriptorStatus int) *backend.DataResponse {
+		t.Helper()
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/v3/projects/test-proj/metricDescriptors/compute.googleapis.com/instance/cpu/utilization" {
+				w.WriteHeader(descriptorStatus)
+				_, _ = w.Write([]byte(`{"type": "compute.googleapis.com/instance/cpu/utilization", "metricKind": "GAUGE", "valueType": "DOUBLE"}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"timeSeries": [{"metric": {"type": "compute.googleapis.com/instance/cpu/utilization"}, "resource": {"type": "gce_instance"}, "valueType": "DOUBLE", "points": []}]}`))
+		}))
+		t.Cleanup(srv.Close)
+
+		dsInfo := datasourceInfo{
+			services: map[string]datasourceService{
+				cloudMonitor: {url: srv.URL, client: srv.Client()},
+			},
+		}
+		query := &cloudMonitoringTimeSeriesFilter{
+			RefID:       "A",
+			ProjectName: "test-proj",
+			MetricType:  "compute.googleapis.com/instance/cpu/utilization",
+			Params:      url.Values{},
+			logger:      slog,
+		}
+
+		dr, resp, executedQueryString, err := query.run(context.Background(), baseReq(), &Service{}, dsInfo, tracing.InitializeTracerForTest())
+		require.NoError(t, err)
+		require.NoError(t, dr.Error)
+		require.NoError(t, query.parseResponse(dr, resp, executedQueryString))
+		require.Len(t, dr.Frames, 1)
+		require.NotNil(t, dr.Frames[0].Meta)
+		return dr
+	}
+
+	t.Run("the metric kind and value type are set on the frame meta", func(t *testing.T) {
+		dr := runQuery(t, http.StatusOK)
+		custom, ok := dr.Frames[0].Meta.Custom.(map[string]interface{})
+		require.True(t, ok)
+		assert.Equal(t, "GAUGE", custom["metricKind"])
+		assert.Equal(t, "DOUBLE", custom["valueType"])
+	})
+
+	t.Run("the metric kind and value type are not set without a descriptor", func(t *testing.T) {
+		dr := runQuery(t, http.StatusForbidden)
+		custom, ok := dr.Frames[0].Meta.Custom.(map[string]interface{})
+		require.True(t, ok)
+		assert.NotContains(t, custom, "metricKind")
+		assert.NotContains(t, custom, "valueType")
+	})
+}
+
+func TestTimeSeriesFilterCumulativeAlignerDefault(t *testing.T) {
+	runQuery := func(t *testing.T, metricKind string, defaultAligner bool) (*backend.DataResponse, string) {
+		t.Helper()
+		requestedAligner := ""
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/v3/projects/test-proj/metricDescriptors/compute.googleapis.com/instance/network/received_bytes_count" {
+				_, _ = w.Write([]byte(`{"type": "compute.googleapis.com/instance/network/received_bytes_count", "metricKind": "` + metricKind + `", "valueType": "INT64"}`))
+				return
+			}
+			requestedAligner = r.URL.Query().Get("aggregation.perSeriesAligner")
+			_, _ = w.Write([]byte(`{"timeSeries": [{"metric": {"type": "compute.googleapis.com/instance/network/received_bytes_count"}, "resource": {"type": "gce_instance"}, "valueType": "INT64", "points": []}]}`))
+		}))
+		t.Cleanup(srv.Close)
+
+		dsInfo := datasourceInfo{
+			services: map[string]datasourceService{
+				cloudMonitor: {url: srv.URL, client: srv.Client()},
+			},
+		}
+		query := &cloudMonitoringTimeSeriesFilter{
+			RefID:          "A",
+			ProjectName:    "test-proj",
+			MetricType:     "compute.googleapis.com/instance/network/received_bytes_count",
+			Params:         url.Values{"aggregation.perSeriesAligner": []string{"ALIGN_MEAN"}},
+			logger:         slog,
+			defaultAligner: defaultAligner,
+		}
+
+		dr, resp, executedQueryString, err := query.run(context.Background(), baseReq(), &Service{}, dsInfo, tracing.InitializeTracerForTest())
+		require.NoError(t, err)
+		require.NoError(t, dr.Error)
+		require.NoError(t, query.parseResponse(dr, resp, executedQueryString))
+		require.Len(t, dr.Frames, 1)
+		return dr, requestedAligner
+	}
+
+	t.Run("a cumulative metric without an aligner is aligned with a rate", func(t *testing.T) {
+		dr, aligner := runQuery(t, "CUMULATIVE", true)
+		assert.Equal(t, "ALIGN_RATE", aligner)
+		require.NotNil(t, dr.Frames[0].Meta)
+		require.Len(t, dr.Frames[0].Meta.Notices, 1)
+		assert.Equal(t, data.NoticeSeverityInfo, dr.Frames[0].Meta.Notices[0].Severity)
+		assert.Contains(t, dr.Frames[0].Meta.Notices[0].Text, "aligned with ALIGN_RATE instead of ALIGN_MEAN")
+	})
+
+	t.Run("a cumulative metric with a selected aligner keeps it", func(t *testing.T) {
+		dr, aligner := runQuery(t, "CUMULATIVE", false)
+		assert.Equal(t, "ALIGN_MEAN", aligner)
+		assert.Empty(t, dr.Frames[0].Meta.Notices)
+	})
+
+	t.Run("a gauge metric without an aligner keeps the default", func(t *testing.T) {
+		dr, aligner := runQuery(t, "GAUGE", true)
+		assert.Equal(t, "ALIGN_MEAN", aligner)
+		assert.Empty(t, dr.Frames[0].Meta.Notices)
+	})
+}
+
+func TestGetMetricDescriptorCache(t *testing.T) {
+	descriptorRequests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/metricDescriptors/compute.googleapis.com/instance/cpu/utilization") {
+			descriptorRequests++
+			_, _ = w.Write([]byte(`{"type": "compute.googleapis.com/instance/cpu/utilization", "metricKind": "GAUGE", "valueType": "DOUBLE", "unit": "10^2.%"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"timeSeries": []}`))
+	}))
+	defer srv.Close()
+
+	dsInfo := datasourceInfo{
+		services: map[string]datasourceService{
+			cloudMonitor: {url: srv.URL, client: srv.Client()},
+		},
+		descriptorCache: localcache.New(descriptorCacheTTL, descriptorCacheTTL),
+	}
+
+	for i := 0; i < 2; i++ {
+		query := &cloudMonitoringTimeSeriesFilter{
+			RefID:       "A",
+			ProjectName: "test-proj",
+			MetricType:  "compute.googleapis.com/instance/cpu/utilization",
+			Params:      url.Values{"aggregation.perSeriesAligner": []string{"ALIGN_MEAN"}},
+			logger:      slog,
+		}
+		dr, _, _, err := query.run(context.Background(), baseReq(), &Service{}, dsInfo, tracing.InitializeTracerForTest())
+		require.NoError(t, err)
+		require.NoError(t, dr.Error)
+	}
+
+	assert.Equal(t, 1, descriptorRequests)
+
+	_, err := getMetricDescriptor(context.Background(), dsInfo, "other-proj", "compute.googleapis.com/instance/cpu/utilization")
+	require.NoError(t, err)
+	assert.Equal(t, 2, descriptorRequests)
+}
@@ -0,0 +1,74 @@
+package cloudmonitoring
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "grafana"
+	metricsSubsystem = "cloudmonitoring"
+
+	queryStatusSuccess = "success"
+	queryStatusError   = "error"
+)
+
+var (
+	queryDurationSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "query_duration_seconds",
+			Help:      "Duration of Cloud Monitoring queries, including paging and retries",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"query_type", "status"},
+	)
+	queriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "queries_total",
+			Help:      "A counter for Cloud Monitoring queries by query type and outcome",
+		},
+		[]string{"query_type", "status"},
+	)
+
+	registerMetricsOnce sync.Once
+)
+
+// registerMetrics registers the query metrics once. The plugin SDK serves the metrics of
+// backend plugins from the default registry, so that's the registry the service passes in.
+func registerMetrics(reg prometheus.Registerer) {
+	registerMetricsOnce.Do(func() {
+		reg.MustRegister(queryDurationSeconds, queriesTotal)
+	})
+}
+
+// observeQuery records the duration and outcome of an executed query
+func observeQuery(queryExecutor cloudMonitoringQueryExecutor, start time.Time, failed bool) {
+	status := queryStatusSuccess
+	if failed {
+		status = queryStatusError
+	}
+
+	queryType := executorQueryType(queryExecutor)
+	queryDurationSeconds.WithLabelValues(queryType, status).Observe(time.Since(start).Seconds())
+	queriesTotal.WithLabelValues(queryType, status).Inc()
+}
+
+func executorQueryType(queryExecutor cloudMonitoringQueryExecutor) string {
+	switch e := queryExecutor.(type) {
+	case *cloudMonitoringTimeSeriesQuery:
+		return mqlEditorMode
+	case *cloudMonitoringTimeSeriesFilter:
+		if e.Selector != "" {
+			return sloQueryType
+		}
+		return metricQueryType
+	default:
+		return "unknown"
+	}
+}
@@ -6,6 +6,8 @@ const (
 	PreprocessorTypeNone preprocessorType = iota
 	PreprocessorTypeRate
 	PreprocessorTypeDelta
+	PreprocessorTypeCumulative
+	PreprocessorTypePercentChange
 )
 
 func toPreprocessorType(preprocessorTypeString string) preprocessorType {
@@ -16,7 +18,25 @@ func toPreprocessorType(preprocessorTypeString string) preprocessorType {
 		return PreprocessorTypeRate
 	case "delta":
 		return PreprocessorTypeDelta
+	case "cumulative":
+		return PreprocessorTypeCumulative
+	case "percentChange":
+		return PreprocessorTypePercentChange
 	default:
 		return PreprocessorTypeNone
 	}
 }
+
+// aligner returns the per series aligner the preprocessor aligns the primary aggregation with
+func (p preprocessorType) aligner() string {
+	switch p {
+	case PreprocessorTypeDelta:
+		return "ALIGN_DELTA"
+	case PreprocessorTypeCumulative:
+		return "ALIGN_CUMULATIVE"
+	case PreprocessorTypePercentChange:
+		return "ALIGN_PERCENT_CHANGE"
+	default:
+		return alignRate
+	}
+}
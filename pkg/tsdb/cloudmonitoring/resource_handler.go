@@ -4,22 +4,36 @@ import (
 	"bytes"
 	"compress/flate"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"path"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/andybalholm/brotli"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
 )
 
 // nameExp matches the part after the last '/' symbol
 var nameExp = regexp.MustCompile(`([^\/]*)\/*$`)
 
-const resourceManagerPath = "/v1/projects"
+const (
+	resourceManagerPath = "/v1/projects"
+	// time range used when probing time series headers for label discovery
+	headersProbeRange = time.Hour
+	labelKeysCacheTTL = time.Minute
+)
+
+// maxLabelValues is the maximum number of distinct values returned for a label
+var maxLabelValues = 1000
 
 type processResponse func(body []byte) ([]json.RawMessage, string, error)
 
@@ -30,6 +44,12 @@ func (s *Service) newResourceMux() *http.ServeMux {
 	mux.HandleFunc("/services/", s.handleResourceReq(cloudMonitor, processServices))
 	mux.HandleFunc("/slo-services/", s.handleResourceReq(cloudMonitor, processSLOs))
 	mux.HandleFunc("/projects", s.handleResourceReq(resourceManager, processProjects))
+	mux.HandleFunc("/metricTypes", s.handleMetricTypes)
+	mux.HandleFunc("/metricLabels", s.handleMetricLabels)
+	mux.HandleFunc("/metricLabelValues", s.handleMetricLabelValues)
+	mux.HandleFunc("/sloServices", s.handleSLOServices)
+	mux.HandleFunc("/slos", s.handleSLOs)
+	mux.HandleFunc("/inspectQuery", s.handleInspectQuery)
 	return mux
 }
 
@@ -59,6 +79,347 @@ func (s *Service) handleResourceReq(subDataSource string, responseFn processResp
 	}
 }
 
+// handleMetricTypes lists the metric types of a project as template variable values.
+// The optional filter parameter is passed as is to the metricDescriptors.list endpoint,
+// the optional serviceName parameter limits the metric types to those of a single service
+func (s *Service) handleMetricTypes(rw http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	projectName := query.Get("projectName")
+	if projectName == "" {
+		writeResponse(rw, http.StatusBadRequest, "missing projectName parameter")
+		return
+	}
+	if !validPathSegment(projectName) {
+		writeResponse(rw, http.StatusBadRequest, "invalid projectName parameter")
+		return
+	}
+
+	var filters []string
+	if filter := query.Get("filter"); filter != "" {
+		filters = append(filters, filter)
+	}
+	if serviceName := query.Get("serviceName"); serviceName != "" {
+		filters = append(filters, buildServiceMetricTypeFilter(serviceName))
+	}
+
+	params := url.Values{}
+	if len(filters) > 0 {
+		params.Set("filter", strings.Join(filters, " AND "))
+	}
+
+	client, code, err := s.setResourceRequestTarget(req, cloudMonitor, path.Join("/v3/projects", projectName, "metricDescriptors"), params)
+	if err != nil {
+		writeResponse(rw, code, fmt.Sprintf("unexpected error %v", err))
+		return
+	}
+	getResources(rw, req, client, processMetricTypes)
+}
+
+// validPathSegment checks that a request parameter can only be used as a single segment of
+// an API path, path.Join would otherwise resolve it to another resource
+func validPathSegment(value string) bool {
+	return !strings.Contains(value, "/") && !strings.Contains(value, "..")
+}
+
+// buildServiceMetricTypeFilter matches the metric types of a Google Cloud service, e.g. compute
+func buildServiceMetricTypeFilter(serviceName string) string {
+	return "metric.type = " + interpolateFilterWildcards(serviceName+".googleapis.com*")
+}
+
+// handleSLOServices lists the services of a project as template variable values
+func (s *Service) handleSLOServices(rw http.ResponseWriter, req *http.Request) {
+	projectName := req.URL.Query().Get("projectName")
+	if projectName == "" {
+		writeResponse(rw, http.StatusBadRequest, "missing projectName parameter")
+		return
+	}
+	if !validPathSegment(projectName) {
+		writeResponse(rw, http.StatusBadRequest, "invalid projectName parameter")
+		return
+	}
+
+	client, code, err := s.setResourceRequestTarget(req, cloudMonitor, path.Join("/v3/projects", projectName, "services"), url.Values{})
+	if err != nil {
+		writeResponse(rw, code, fmt.Sprintf("unexpected error %v", err))
+		return
+	}
+	getResources(rw, req, client, processServiceValues)
+}
+
+// handleSLOs lists the service level objectives of a service as template variable values
+func (s *Service) handleSLOs(rw http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	projectName := query.Get("projectName")
+	serviceID := query.Get("serviceId")
+	if projectName == "" || serviceID == "" {
+		writeResponse(rw, http.StatusBadRequest, "missing projectName or serviceId parameter")
+		return
+	}
+	if !validPathSegment(projectName) || !validPathSegment(serviceID) {
+		writeResponse(rw, http.StatusBadRequest, "invalid projectName or serviceId parameter")
+		return
+	}
+
+	target := path.Join("/v3/projects", projectName, "services", serviceID, "serviceLevelObjectives")
+	client, code, err := s.setResourceRequestTarget(req, cloudMonitor, target, url.Values{})
+	if err != nil {
+		writeResponse(rw, code, fmt.Sprintf("unexpected error %v", err))
+		return
+	}
+	getResources(rw, req, client, processSLOValues)
+}
+
+// handleMetricLabels lists the metric and resource label keys observed for a metric type
+// so that they can be used as group bys. Results are cached per project and metric type
+func (s *Service) handleMetricLabels(rw http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	projectName := query.Get("projectName")
+	metricType := query.Get("metricType")
+	if projectName == "" || metricType == "" {
+		writeResponse(rw, http.StatusBadRequest, "missing projectName or metricType parameter")
+		return
+	}
+	if !validPathSegment(projectName) {
+		writeResponse(rw, http.StatusBadRequest, "invalid projectName parameter")
+		return
+	}
+
+	dsInfo, err := s.getDataSourceFromHTTPReq(req)
+	if err != nil {
+		writeResponse(rw, http.StatusBadRequest, fmt.Sprintf("unexpected error %v", err))
+		return
+	}
+
+	cacheKey := fmt.Sprintf("%s/%s", projectName, metricType)
+	if cached, ok := dsInfo.labelKeysCache.Get(cacheKey); ok {
+		writeResponseBytes(rw, http.StatusOK, cached.([]byte))
+		return
+	}
+
+	series, err := probeTimeSeriesHeaders(req.Context(), dsInfo, projectName, metricType)
+	if err != nil {
+		writeResponse(rw, http.StatusInternalServerError, fmt.Sprintf("unexpected error %v", err))
+		return
+	}
+
+	keys := map[string]struct{}{}
+	for _, ts := range series {
+		for key := range ts.Metric.Labels {
+			keys["metric.label."+key] = struct{}{}
+		}
+		for key := range ts.Resource.Labels {
+			keys["resource.label."+key] = struct{}{}
+		}
+	}
+	sortedKeys := make([]string, 0, len(keys))
+	for key := range keys {
+		sortedKeys = append(sortedKeys, key)
+	}
+	sort.Strings(sortedKeys)
+
+	results := make([]metricFindValue, 0, len(sortedKeys))
+	for _, key := range sortedKeys {
+		results = append(results, metricFindValue{Text: key, Value: key})
+	}
+	body, err := json.Marshal(results)
+	if err != nil {
+		writeResponse(rw, http.StatusInternalServerError, fmt.Sprintf("response marshaling error %v", err))
+		return
+	}
+
+	dsInfo.labelKeysCache.Set(cacheKey, body, labelKeysCacheTTL)
+	writeResponseBytes(rw, http.StatusOK, body)
+}
+
+// handleMetricLabelValues lists the distinct values observed for a metric or resource label
+// of a metric type, e.g. resource.label.zone, as template variable values
+func (s *Service) handleMetricLabelValues(rw http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	projectName := query.Get("projectName")
+	metricType := query.Get("metricType")
+	labelKey := query.Get("labelKey")
+	if projectName == "" || metricType == "" || labelKey == "" {
+		writeResponse(rw, http.StatusBadRequest, "missing projectName, metricType or labelKey parameter")
+		return
+	}
+	if !validPathSegment(projectName) {
+		writeResponse(rw, http.StatusBadRequest, "invalid projectName parameter")
+		return
+	}
+
+	var labelsOf func(ts timeSeries) map[string]string
+	switch {
+	case strings.HasPrefix(labelKey, "metric.label."):
+		labelsOf = func(ts timeSeries) map[string]string { return ts.Metric.Labels }
+	case strings.HasPrefix(labelKey, "resource.label."):
+		labelsOf = func(ts timeSeries) map[string]string { return ts.Resource.Labels }
+	default:
+		writeResponse(rw, http.StatusBadRequest, fmt.Sprintf("unsupported label key %q, expected a metric.label. or resource.label. key", labelKey))
+		return
+	}
+	key := labelKey[strings.LastIndex(labelKey, ".")+1:]
+
+	dsInfo, err := s.getDataSourceFromHTTPReq(req)
+	if err != nil {
+		writeResponse(rw, http.StatusBadRequest, fmt.Sprintf("unexpected error %v", err))
+		return
+	}
+
+	series, err := probeTimeSeriesHeaders(req.Context(), dsInfo, projectName, metricType)
+	if err != nil {
+		writeResponse(rw, http.StatusInternalServerError, fmt.Sprintf("unexpected error %v", err))
+		return
+	}
+
+	values := map[string]struct{}{}
+	for _, ts := range series {
+		if value, ok := labelsOf(ts)[key]; ok {
+			values[value] = struct{}{}
+		}
+	}
+	sortedValues := make([]string, 0, len(values))
+	for value := range values {
+		sortedValues = append(sortedValues, value)
+	}
+	sort.Strings(sortedValues)
+	if len(sortedValues) > maxLabelValues {
+		sortedValues = sortedValues[:maxLabelValues]
+	}
+
+	results := make([]metricFindValue, 0, len(sortedValues))
+	for _, value := range sortedValues {
+		results = append(results, metricFindValue{Text: value, Value: value})
+	}
+	body, err := json.Marshal(results)
+	if err != nil {
+		writeResponse(rw, http.StatusInternalServerError, fmt.Sprintf("response marshaling error %v", err))
+		return
+	}
+
+	writeResponseBytes(rw, http.StatusOK, body)
+}
+
+// handleInspectQuery builds the queries of a request the same way a query request would, and
+// returns what would be sent to the Cloud Monitoring API without executing them. The request body
+// has the same shape as a query request, with from and to in epoch milliseconds.
+func (s *Service) handleInspectQuery(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeResponse(rw, http.StatusMethodNotAllowed, "only POST requests are supported")
+		return
+	}
+
+	var body inspectQueryRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeResponse(rw, http.StatusBadRequest, fmt.Sprintf("invalid request body %v", err))
+		return
+	}
+	from, fromErr := strconv.ParseInt(body.From, 10, 64)
+	to, toErr := strconv.ParseInt(body.To, 10, 64)
+	if fromErr != nil || toErr != nil {
+		writeResponse(rw, http.StatusBadRequest, "from and to must be epoch milliseconds")
+		return
+	}
+	if len(body.Queries) == 0 {
+		writeResponse(rw, http.StatusBadRequest, "missing queries")
+		return
+	}
+
+	dsInfo, err := s.getDataSourceFromHTTPReq(req)
+	if err != nil || dsInfo == nil {
+		writeResponse(rw, http.StatusBadRequest, fmt.Sprintf("unexpected error %v", err))
+		return
+	}
+
+	queryReq := &backend.QueryDataRequest{}
+	timeRange := backend.TimeRange{From: time.UnixMilli(from), To: time.UnixMilli(to)}
+	for _, rawQuery := range body.Queries {
+		var query struct {
+			RefID         string `json:"refId"`
+			IntervalMS    int64  `json:"intervalMs"`
+			MaxDataPoints int64  `json:"maxDataPoints"`
+		}
+		if err := json.Unmarshal(rawQuery, &query); err != nil {
+			writeResponse(rw, http.StatusBadRequest, fmt.Sprintf("invalid query %v", err))
+			return
+		}
+		queryReq.Queries = append(queryReq.Queries, backend.DataQuery{
+			RefID:         query.RefID,
+			TimeRange:     timeRange,
+			Interval:      time.Duration(query.IntervalMS) * time.Millisecond,
+			MaxDataPoints: query.MaxDataPoints,
+			JSON:          rawQuery,
+		})
+	}
+
+	executors, err := s.buildQueryExecutors(slog, queryReq, *dsInfo)
+	if err != nil {
+		writeResponse(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	results := make([]inspectedQuery, 0, len(executors))
+	for _, executor := range executors {
+		switch e := executor.(type) {
+		case *cloudMonitoringTimeSeriesFilter:
+			results = append(results, inspectedQuery{
+				RefID:  e.RefID,
+				Path:   path.Join("/v3/projects", e.ProjectName, "timeSeries"),
+				Target: e.Target,
+				Params: e.Params,
+			})
+		case *cloudMonitoringTimeSeriesQuery:
+			results = append(results, inspectedQuery{
+				RefID: e.RefID,
+				Path:  path.Join("/v3/projects", e.ProjectName, "timeSeries:query"),
+				Query: e.Query,
+			})
+		}
+	}
+	encoded, err := json.Marshal(results)
+	if err != nil {
+		writeResponse(rw, http.StatusInternalServerError, fmt.Sprintf("response marshaling error %v", err))
+		return
+	}
+
+	writeResponseBytes(rw, http.StatusOK, encoded)
+}
+
+// probeTimeSeriesHeaders lists the recent time series of a metric type without their points
+func probeTimeSeriesHeaders(ctx context.Context, dsInfo *datasourceInfo, projectName string, metricType string) ([]timeSeries, error) {
+	now := time.Now().UTC()
+	filter, err := buildFilterString(metricType, nil, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	params.Set("filter", filter)
+	params.Set("interval.startTime", now.Add(-headersProbeRange).Format(time.RFC3339))
+	params.Set("interval.endTime", now.Format(time.RFC3339))
+	params.Set("view", "HEADERS")
+
+	u, err := url.Parse(dsInfo.services[cloudMonitor].url)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path.Join("/v3/projects", projectName, "timeSeries")
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := dsInfo.services[cloudMonitor].client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := unmarshalResponse(slog, res)
+	if err != nil {
+		return nil, err
+	}
+	return d.TimeSeries, nil
+}
+
 func getResources(rw http.ResponseWriter, req *http.Request, cli *http.Client, responseFn processResponse) http.ResponseWriter {
 	if responseFn == nil {
 		writeResponse(rw, http.StatusInternalServerError, "responseFn should not be nil")
@@ -110,6 +471,27 @@ func processMetricDescriptors(body []byte) ([]json.RawMessage, string, error) {
 	return results, resp.Token, nil
 }
 
+func processMetricTypes(body []byte) ([]json.RawMessage, string, error) {
+	resp := metricDescriptorResponse{}
+	err := json.Unmarshal(body, &resp)
+	if err != nil {
+		return nil, "", err
+	}
+
+	results := []json.RawMessage{}
+	for _, descriptor := range resp.Descriptors {
+		marshaledValue, err := json.Marshal(metricFindValue{
+			Text:  descriptor.Type,
+			Value: descriptor.Type,
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		results = append(results, marshaledValue)
+	}
+	return results, resp.Token, nil
+}
+
 func processServices(body []byte) ([]json.RawMessage, string, error) {
 	resp := serviceResponse{}
 	err := json.Unmarshal(body, &resp)
@@ -165,6 +547,64 @@ func processSLOs(body []byte) ([]json.RawMessage, string, error) {
 	return results, resp.Token, nil
 }
 
+func processServiceValues(body []byte) ([]json.RawMessage, string, error) {
+	resp := serviceResponse{}
+	err := json.Unmarshal(body, &resp)
+	if err != nil {
+		return nil, "", err
+	}
+
+	results := []json.RawMessage{}
+	for _, service := range resp.Services {
+		name := nameExp.FindString(service.Name)
+		if name == "" {
+			return nil, "", fmt.Errorf("unexpected service name: %v", service.Name)
+		}
+		text := service.DisplayName
+		if text == "" {
+			text = name
+		}
+		marshaledValue, err := json.Marshal(metricFindValue{
+			Text:  text,
+			Value: name,
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		results = append(results, marshaledValue)
+	}
+	return results, resp.Token, nil
+}
+
+func processSLOValues(body []byte) ([]json.RawMessage, string, error) {
+	resp := sloResponse{}
+	err := json.Unmarshal(body, &resp)
+	if err != nil {
+		return nil, "", err
+	}
+
+	results := []json.RawMessage{}
+	for _, slo := range resp.SLOs {
+		name := nameExp.FindString(slo.Name)
+		if name == "" {
+			return nil, "", fmt.Errorf("unexpected slo name: %v", slo.Name)
+		}
+		text := slo.DisplayName
+		if text == "" {
+			text = name
+		}
+		marshaledValue, err := json.Marshal(metricFindValue{
+			Text:  text,
+			Value: name,
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		results = append(results, marshaledValue)
+	}
+	return results, resp.Token, nil
+}
+
 func processProjects(body []byte) ([]json.RawMessage, string, error) {
 	resp := projectResponse{}
 	err := json.Unmarshal(body, &resp)
@@ -359,6 +799,27 @@ func (s *Service) setRequestVariables(req *http.Request, subDataSource string) (
 	return dsInfo.services[subDataSource].client, 0, nil
 }
 
+// setResourceRequestTarget points the request to the given path and query of the sub data source
+func (s *Service) setResourceRequestTarget(req *http.Request, subDataSource string, target string, params url.Values) (*http.Client, int, error) {
+	slog.Debug("Received resource call", "url", req.URL.String(), "method", req.Method)
+
+	dsInfo, err := s.getDataSourceFromHTTPReq(req)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	serviceURL, err := url.Parse(dsInfo.services[subDataSource].url)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	req.URL.Path = target
+	req.URL.RawQuery = params.Encode()
+	req.URL.Host = serviceURL.Host
+	req.URL.Scheme = serviceURL.Scheme
+
+	return dsInfo.services[subDataSource].client, 0, nil
+}
+
 func getTarget(original string) (target string, err error) {
 	if original == "/projects" {
 		return resourceManagerPath, nil
@@ -7,10 +7,13 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
+	"github.com/grafana/grafana/pkg/infra/localcache"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -92,12 +95,14 @@ func Test_doRequest(t *testing.T) {
 }
 
 type fakeInstance struct {
-	services map[string]datasourceService
+	services       map[string]datasourceService
+	labelKeysCache *localcache.CacheService
 }
 
 func (f *fakeInstance) Get(pluginContext backend.PluginContext) (instancemgmt.Instance, error) {
 	return &datasourceInfo{
-		services: f.services,
+		services:       f.services,
+		labelKeysCache: f.labelKeysCache,
 	}, nil
 }
 
@@ -308,3 +313,372 @@ func Test_getGCEDefaultProject(t *testing.T) {
 	assert.HTTPSuccess(t, s.getGCEDefaultProject, "GET", "/gceDefaultProject", nil)
 	assert.HTTPBodyContains(t, s.getGCEDefaultProject, "GET", "/gceDefaultProject", nil, fmt.Sprintf("\"%v\"", project))
 }
+
+func Test_handleMetricTypes(t *testing.T) {
+	var requestedURL *url.URL
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestedURL = r.URL
+		_, err := w.Write([]byte(`{"metricDescriptors": [
+			{"type": "compute.googleapis.com/instance/cpu/usage_time"},
+			{"type": "compute.googleapis.com/instance/cpu/utilization"}
+		]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}))
+	defer srv.Close()
+	s := Service{
+		im: &fakeInstance{
+			services: map[string]datasourceService{
+				cloudMonitor: {
+					url:    srv.URL,
+					client: srv.Client(),
+				},
+			},
+		},
+	}
+
+	t.Run("lists metric types as template variable values", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "/metricTypes?projectName=test-proj&filter="+url.QueryEscape(`metric.type = starts_with("compute")`), nil)
+		require.NoError(t, err)
+		rw := httptest.NewRecorder()
+		s.handleMetricTypes(rw, req)
+
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, "/v3/projects/test-proj/metricDescriptors", requestedURL.Path)
+		assert.Equal(t, `metric.type = starts_with("compute")`, requestedURL.Query().Get("filter"))
+		assert.JSONEq(t, `[
+			{"text": "compute.googleapis.com/instance/cpu/usage_time", "value": "compute.googleapis.com/instance/cpu/usage_time"},
+			{"text": "compute.googleapis.com/instance/cpu/utilization", "value": "compute.googleapis.com/instance/cpu/utilization"}
+		]`, rw.Body.String())
+	})
+
+	t.Run("filters metric types by service", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "/metricTypes?projectName=test-proj&serviceName=compute", nil)
+		require.NoError(t, err)
+		rw := httptest.NewRecorder()
+		s.handleMetricTypes(rw, req)
+
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, `metric.type = starts_with("compute.googleapis.com")`, requestedURL.Query().Get("filter"))
+	})
+
+	t.Run("combines the service with the filter", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "/metricTypes?projectName=test-proj&serviceName=compute&filter="+url.QueryEscape(`metric.type = has_substring("cpu")`), nil)
+		require.NoError(t, err)
+		rw := httptest.NewRecorder()
+		s.handleMetricTypes(rw, req)
+
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, `metric.type = has_substring("cpu") AND metric.type = starts_with("compute.googleapis.com")`, requestedURL.Query().Get("filter"))
+	})
+
+	t.Run("requires a project name", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "/metricTypes", nil)
+		require.NoError(t, err)
+		rw := httptest.NewRecorder()
+		s.handleMetricTypes(rw, req)
+
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+	})
+
+	t.Run("rejects a project name that isn't a single path segment", func(t *testing.T) {
+		for _, projectName := range []string{"test-proj/services", "..", "test-proj/../other-proj"} {
+			requestedURL = nil
+			req, err := http.NewRequest(http.MethodGet, "/metricTypes?projectName="+url.QueryEscape(projectName), nil)
+			require.NoError(t, err)
+			rw := httptest.NewRecorder()
+			s.handleMetricTypes(rw, req)
+
+			assert.Equal(t, http.StatusBadRequest, rw.Code, projectName)
+			assert.Nil(t, requestedURL, projectName)
+		}
+	})
+}
+
+func Test_handleMetricLabels(t *testing.T) {
+	calls := 0
+	var requestedURL *url.URL
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		requestedURL = r.URL
+		_, err := w.Write([]byte(`{"timeSeries": [
+			{"metric": {"labels": {"instance_name": "a"}}, "resource": {"labels": {"zone": "us-central1-a"}}},
+			{"metric": {"labels": {"instance_name": "b", "state": "used"}}, "resource": {"labels": {"zone": "us-central1-b"}}}
+		]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}))
+	defer srv.Close()
+	s := Service{
+		im: &fakeInstance{
+			services: map[string]datasourceService{
+				cloudMonitor: {
+					url:    srv.URL,
+					client: srv.Client(),
+				},
+			},
+			labelKeysCache: localcache.New(labelKeysCacheTTL, labelKeysCacheTTL),
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest(http.MethodGet, "/metricLabels?projectName=test-proj&metricType=a/metric/type", nil)
+		require.NoError(t, err)
+		rw := httptest.NewRecorder()
+		s.handleMetricLabels(rw, req)
+
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.JSONEq(t, `[
+			{"text": "metric.label.instance_name", "value": "metric.label.instance_name"},
+			{"text": "metric.label.state", "value": "metric.label.state"},
+			{"text": "resource.label.zone", "value": "resource.label.zone"}
+		]`, rw.Body.String())
+	}
+
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, "/v3/projects/test-proj/timeSeries", requestedURL.Path)
+	assert.Equal(t, "HEADERS", requestedURL.Query().Get("view"))
+	assert.Equal(t, `metric.type="a/metric/type"`, requestedURL.Query().Get("filter"))
+
+	for _, projectName := range []string{"test-proj/services", "..", "test-proj/../other-proj"} {
+		requestedURL = nil
+		req, err := http.NewRequest(http.MethodGet, "/metricLabels?projectName="+url.QueryEscape(projectName)+"&metricType=a/metric/type", nil)
+		require.NoError(t, err)
+		rw := httptest.NewRecorder()
+		s.handleMetricLabels(rw, req)
+
+		assert.Equal(t, http.StatusBadRequest, rw.Code, projectName)
+		assert.Nil(t, requestedURL, projectName)
+	}
+}
+
+func Test_handleMetricLabelValues(t *testing.T) {
+	var requestedURL *url.URL
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestedURL = r.URL
+		_, err := w.Write([]byte(`{"timeSeries": [
+			{"metric": {"labels": {"instance_name": "b"}}, "resource": {"labels": {"zone": "us-central1-b"}}},
+			{"metric": {"labels": {"instance_name": "a"}}, "resource": {"labels": {"zone": "us-central1-a"}}},
+			{"metric": {"labels": {"instance_name": "c"}}, "resource": {"labels": {"zone": "us-central1-b"}}},
+			{"metric": {"labels": {}}, "resource": {"labels": {}}}
+		]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}))
+	defer srv.Close()
+	s := Service{
+		im: &fakeInstance{
+			services: map[string]datasourceService{
+				cloudMonitor: {
+					url:    srv.URL,
+					client: srv.Client(),
+				},
+			},
+		},
+	}
+
+	t.Run("lists the distinct values of a resource label", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "/metricLabelValues?projectName=test-proj&metricType=a/metric/type&labelKey=resource.label.zone", nil)
+		require.NoError(t, err)
+		rw := httptest.NewRecorder()
+		s.handleMetricLabelValues(rw, req)
+
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.JSONEq(t, `[
+			{"text": "us-central1-a", "value": "us-central1-a"},
+			{"text": "us-central1-b", "value": "us-central1-b"}
+		]`, rw.Body.String())
+		assert.Equal(t, "/v3/projects/test-proj/timeSeries", requestedURL.Path)
+		assert.Equal(t, "HEADERS", requestedURL.Query().Get("view"))
+		assert.Equal(t, `metric.type="a/metric/type"`, requestedURL.Query().Get("filter"))
+	})
+
+	t.Run("caps the number of values", func(t *testing.T) {
+		origMax := maxLabelValues
+		t.Cleanup(func() {
+			maxLabelValues = origMax
+		})
+		maxLabelValues = 2
+
+		req, err := http.NewRequest(http.MethodGet, "/metricLabelValues?projectName=test-proj&metricType=a/metric/type&labelKey=metric.label.instance_name", nil)
+		require.NoError(t, err)
+		rw := httptest.NewRecorder()
+		s.handleMetricLabelValues(rw, req)
+
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.JSONEq(t, `[
+			{"text": "a", "value": "a"},
+			{"text": "b", "value": "b"}
+		]`, rw.Body.String())
+	})
+
+	t.Run("requires a label key", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "/metricLabelValues?projectName=test-proj&metricType=a/metric/type", nil)
+		require.NoError(t, err)
+		rw := httptest.NewRecorder()
+		s.handleMetricLabelValues(rw, req)
+
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+	})
+
+	t.Run("rejects a project name that isn't a single path segment", func(t *testing.T) {
+		for _, projectName := range []string{"test-proj/services", "..", "test-proj/../other-proj"} {
+			requestedURL = nil
+			req, err := http.NewRequest(http.MethodGet, "/metricLabelValues?projectName="+url.QueryEscape(projectName)+"&metricType=a/metric/type&labelKey=resource.label.zone", nil)
+			require.NoError(t, err)
+			rw := httptest.NewRecorder()
+			s.handleMetricLabelValues(rw, req)
+
+			assert.Equal(t, http.StatusBadRequest, rw.Code, projectName)
+			assert.Nil(t, requestedURL, projectName)
+		}
+	})
+}
+
+func Test_handleSLOResources(t *testing.T) {
+	var requestedURL *url.URL
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestedURL = r.URL
+		var err error
+		if strings.HasSuffix(r.URL.Path, "/serviceLevelObjectives") {
+			_, err = w.Write([]byte(`{"serviceLevelObjectives": [
+				{"name": "projects/123/services/test-service/serviceLevelObjectives/test-slo", "displayName": "Test SLO"},
+				{"name": "projects/123/services/test-service/serviceLevelObjectives/other-slo"}
+			]}`))
+		} else {
+			_, err = w.Write([]byte(`{"services": [
+				{"name": "projects/123/services/test-service", "displayName": "Test Service"},
+				{"name": "projects/123/services/other-service"}
+			]}`))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}))
+	defer srv.Close()
+	s := Service{
+		im: &fakeInstance{
+			services: map[string]datasourceService{
+				cloudMonitor: {
+					url:    srv.URL,
+					client: srv.Client(),
+				},
+			},
+		},
+	}
+
+	t.Run("lists services without their project prefix", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "/sloServices?projectName=test-proj", nil)
+		require.NoError(t, err)
+		rw := httptest.NewRecorder()
+		s.handleSLOServices(rw, req)
+
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, "/v3/projects/test-proj/services", requestedURL.Path)
+		assert.JSONEq(t, `[
+			{"text": "Test Service", "value": "test-service"},
+			{"text": "other-service", "value": "other-service"}
+		]`, rw.Body.String())
+	})
+
+	t.Run("lists slos without their service prefix", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "/slos?projectName=test-proj&serviceId=test-service", nil)
+		require.NoError(t, err)
+		rw := httptest.NewRecorder()
+		s.handleSLOs(rw, req)
+
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, "/v3/projects/test-proj/services/test-service/serviceLevelObjectives", requestedURL.Path)
+		assert.JSONEq(t, `[
+			{"text": "Test SLO", "value": "test-slo"},
+			{"text": "other-slo", "value": "other-slo"}
+		]`, rw.Body.String())
+	})
+
+	t.Run("requires a service id when listing slos", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "/slos?projectName=test-proj", nil)
+		require.NoError(t, err)
+		rw := httptest.NewRecorder()
+		s.handleSLOs(rw, req)
+
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+	})
+
+	t.Run("rejects project names and service ids that aren't a single path segment", func(t *testing.T) {
+		tests := []struct {
+			target  string
+			handler http.HandlerFunc
+		}{
+			{target: "/sloServices?projectName=" + url.QueryEscape("test-proj/../other-proj"), handler: s.handleSLOServices},
+			{target: "/slos?projectName=..&serviceId=test-service", handler: s.handleSLOs},
+			{target: "/slos?projectName=test-proj&serviceId=" + url.QueryEscape("test-service/../other-service"), handler: s.handleSLOs},
+		}
+		for _, tt := range tests {
+			requestedURL = nil
+			req, err := http.NewRequest(http.MethodGet, tt.target, nil)
+			require.NoError(t, err)
+			rw := httptest.NewRecorder()
+			tt.handler(rw, req)
+
+			assert.Equal(t, http.StatusBadRequest, rw.Code, tt.target)
+			assert.Nil(t, requestedURL, tt.target)
+		}
+	})
+}
+
+func Test_handleInspectQuery(t *testing.T) {
+	s := Service{
+		im: &fakeInstance{
+			services: map[string]datasourceService{
+				cloudMonitor: {
+					url:    routes[cloudMonitor].url,
+					client: &http.Client{},
+				},
+			},
+		},
+	}
+
+	t.Run("returns the target of a metrics query without executing it", func(t *testing.T) {
+		body := `{
+			"from": "1521118800000",
+			"to": "1521120840000",
+			"queries": [{
+				"refId": "A",
+				"queryType": "metrics",
+				"metricQuery": {
+					"projectName": "test-proj",
+					"metricType": "a/metric/type",
+					"crossSeriesReducer": "REDUCE_MEAN",
+					"perSeriesAligner": "ALIGN_MEAN",
+					"alignmentPeriod": "+60s",
+					"filters": ["zone", "=", "us-central1-a"]
+				}
+			}]
+		}`
+		req, err := http.NewRequest(http.MethodPost, "/inspectQuery", strings.NewReader(body))
+		require.NoError(t, err)
+		rw := httptest.NewRecorder()
+		s.handleInspectQuery(rw, req)
+
+		require.Equal(t, http.StatusOK, rw.Code, rw.Body.String())
+		var results []inspectedQuery
+		require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &results))
+		require.Len(t, results, 1)
+		assert.Equal(t, "A", results[0].RefID)
+		assert.Equal(t, "/v3/projects/test-proj/timeSeries", results[0].Path)
+		assert.Equal(t, "aggregation.alignmentPeriod=%2B60s&aggregation.crossSeriesReducer=REDUCE_MEAN&aggregation.perSeriesAligner=ALIGN_MEAN&filter=metric.type%3D%22a%2Fmetric%2Ftype%22+zone%3D%22us-central1-a%22&interval.endTime=2018-03-15T13%3A34%3A00Z&interval.startTime=2018-03-15T13%3A00%3A00Z&view=FULL", results[0].Target)
+		assert.Equal(t, `metric.type="a/metric/type" zone="us-central1-a"`, results[0].Params.Get("filter"))
+	})
+
+	t.Run("rejects an invalid time range", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPost, "/inspectQuery", strings.NewReader(`{"from": "now-1h", "to": "now", "queries": [{}]}`))
+		require.NoError(t, err)
+		rw := httptest.NewRecorder()
+		s.handleInspectQuery(rw, req)
+
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+	})
+}
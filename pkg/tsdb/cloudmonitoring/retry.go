@@ -0,0 +1,81 @@
+package cloudmonitoring
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	maxRequestAttempts = 3
+	maxRetryDelay      = 10 * time.Second
+)
+
+// retryBaseDelay is the backoff before the first retry, it doubles on every subsequent attempt.
+// It's a variable so tests don't have to wait for real backoffs.
+var retryBaseDelay = time.Second
+
+// doRequestWithRetry sends the request and retries it with a jittered exponential backoff when
+// the Cloud Monitoring API responds with 429 or 503. A Retry-After header takes precedence over
+// the computed backoff. body is resent on every attempt and should be nil for requests without one.
+func doRequestWithRetry(client *http.Client, r *http.Request, body []byte) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		if body != nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+		}
+
+		res, err := client.Do(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if attempt == maxRequestAttempts || !isRetryableStatus(res.StatusCode) {
+			return res, nil
+		}
+
+		delay := retryDelay(res.Header.Get("Retry-After"), attempt)
+		_, _ = io.Copy(io.Discard, res.Body)
+		if err := res.Body.Close(); err != nil {
+			slog.Warn("Failed to close response body", "err", err)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-r.Context().Done():
+			timer.Stop()
+			return nil, r.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func isRetryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable
+}
+
+func retryDelay(retryAfter string, attempt int) time.Duration {
+	if retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+			return minDuration(time.Duration(seconds)*time.Second, maxRetryDelay)
+		}
+		if t, err := http.ParseTime(retryAfter); err == nil {
+			return minDuration(time.Until(t), maxRetryDelay)
+		}
+	}
+
+	backoff := minDuration(retryBaseDelay*time.Duration(1<<(attempt-1)), maxRetryDelay)
+	// wait somewhere between half and the full backoff so concurrent queries don't retry in lockstep
+	//nolint:gosec
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
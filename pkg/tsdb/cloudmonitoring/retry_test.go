@@ -0,0 +1,109 @@
+package cloudmonitoring
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func statusResponse(statusCode int, header http.Header) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		StatusCode: statusCode,
+		Header:     header,
+		Body:       io.NopCloser(strings.NewReader(`{}`)),
+	}
+}
+
+func TestDoRequestWithRetry(t *testing.T) {
+	retryBaseDelay = time.Millisecond
+	t.Cleanup(func() { retryBaseDelay = time.Second })
+
+	t.Run("retries on 429 until the request succeeds", func(t *testing.T) {
+		var bodies []string
+		client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			b, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+			bodies = append(bodies, string(b))
+			if len(bodies) < 3 {
+				return statusResponse(http.StatusTooManyRequests, nil), nil
+			}
+			return statusResponse(http.StatusOK, nil), nil
+		})}
+
+		req, err := http.NewRequest(http.MethodPost, "http://example.com", nil)
+		require.NoError(t, err)
+		res, err := doRequestWithRetry(client, req, []byte(`{"query":"fetch"}`))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, []string{`{"query":"fetch"}`, `{"query":"fetch"}`, `{"query":"fetch"}`}, bodies)
+	})
+
+	t.Run("gives up after the maximum number of attempts", func(t *testing.T) {
+		attempts := 0
+		client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			attempts++
+			return statusResponse(http.StatusServiceUnavailable, http.Header{"Retry-After": []string{"0"}}), nil
+		})}
+
+		req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+		require.NoError(t, err)
+		res, err := doRequestWithRetry(client, req, nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+		assert.Equal(t, maxRequestAttempts, attempts)
+	})
+
+	t.Run("does not retry other errors", func(t *testing.T) {
+		attempts := 0
+		client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			attempts++
+			return statusResponse(http.StatusBadRequest, nil), nil
+		})}
+
+		req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+		require.NoError(t, err)
+		res, err := doRequestWithRetry(client, req, nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+		assert.Equal(t, 1, attempts)
+	})
+
+	t.Run("stops retrying when the context is cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		attempts := 0
+		client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			attempts++
+			cancel()
+			return statusResponse(http.StatusTooManyRequests, http.Header{"Retry-After": []string{"5"}}), nil
+		})}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com", nil)
+		require.NoError(t, err)
+		_, err = doRequestWithRetry(client, req, nil)
+		require.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, 1, attempts)
+	})
+
+	t.Run("honors the Retry-After header", func(t *testing.T) {
+		assert.Equal(t, 2*time.Second, retryDelay("2", 1))
+		assert.Equal(t, maxRetryDelay, retryDelay("3600", 1))
+		delay := retryDelay("", 2)
+		assert.GreaterOrEqual(t, delay, time.Millisecond)
+		assert.LessOrEqual(t, delay, 2*time.Millisecond)
+	})
+}
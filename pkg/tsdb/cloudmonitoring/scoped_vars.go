@@ -0,0 +1,91 @@
+package cloudmonitoring
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// templateVariableRe matches $var and ${var} style template variable references
+var templateVariableRe = regexp.MustCompile(`\$\{(\w+)\}|\$(\w+)`)
+
+// scopedVar is a template variable value as sent by the frontend in the query's scopedVars
+type scopedVar struct {
+	Text  interface{} `json:"text"`
+	Value interface{} `json:"value"`
+}
+
+type scopedVars map[string]scopedVar
+
+// values returns the variable's value(s) as strings. Multi-value variables
+// are sent as arrays, single value variables as a plain value.
+func (v scopedVar) values() []string {
+	switch value := v.Value.(type) {
+	case nil:
+		return []string{}
+	case string:
+		return []string{value}
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, item := range value {
+			values = append(values, fmt.Sprint(item))
+		}
+		return values
+	default:
+		return []string{fmt.Sprint(value)}
+	}
+}
+
+// interpolate replaces template variable references in value with their scoped values.
+// Global variables such as $__interval are left untouched, any other variable that
+// can't be resolved results in an error.
+func (vars scopedVars) interpolate(value string) (string, error) {
+	var unresolved []string
+	result := templateVariableRe.ReplaceAllStringFunc(value, func(match string) string {
+		name := templateVariableName(match)
+		if strings.HasPrefix(name, "__") {
+			return match
+		}
+
+		v, ok := vars[name]
+		if !ok {
+			unresolved = append(unresolved, match)
+			return match
+		}
+
+		return strings.Join(v.values(), ",")
+	})
+
+	if len(unresolved) > 0 {
+		return "", fmt.Errorf("unable to resolve template variable(s) %s in %q", strings.Join(unresolved, ", "), value)
+	}
+
+	return result, nil
+}
+
+// multiValues returns the values of the multi-value variable that value consists of, e.g. $zone.
+// It returns false when value isn't a single variable reference or the variable has only one value.
+func (vars scopedVars) multiValues(value string) ([]string, bool) {
+	if templateVariableRe.FindString(value) != value {
+		return nil, false
+	}
+
+	v, ok := vars[templateVariableName(value)]
+	if !ok {
+		return nil, false
+	}
+	values := v.values()
+	if len(values) < 2 {
+		return nil, false
+	}
+
+	return values, true
+}
+
+func templateVariableName(match string) string {
+	submatches := templateVariableRe.FindStringSubmatch(match)
+	if submatches[1] != "" {
+		return submatches[1]
+	}
+	return submatches[2]
+}
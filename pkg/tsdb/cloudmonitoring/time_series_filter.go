@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -16,12 +17,13 @@ import (
 	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/grafana/grafana/pkg/infra/tracing"
+	"github.com/grafana/grafana/pkg/tsdb/intervalv2"
 )
 
 func (timeSeriesFilter *cloudMonitoringTimeSeriesFilter) doRequestFilterPage(ctx context.Context, r *http.Request, dsInfo datasourceInfo) (cloudMonitoringResponse, error) {
 	r.URL.RawQuery = timeSeriesFilter.Params.Encode()
 	r = r.WithContext(ctx)
-	res, err := dsInfo.services[cloudMonitor].client.Do(r)
+	res, err := doRequestWithRetry(dsInfo.services[cloudMonitor].client, r, nil)
 	if err != nil {
 		return cloudMonitoringResponse{}, err
 	}
@@ -47,6 +49,14 @@ func (timeSeriesFilter *cloudMonitoringTimeSeriesFilter) run(ctx context.Context
 		}
 		timeSeriesFilter.logger.Info("No project name set on query, using project name from datasource", "projectName", projectName)
 	}
+
+	descriptor := timeSeriesFilter.getMetricDescriptor(ctx, dsInfo, projectName)
+	timeSeriesFilter.applyCumulativeAlignerDefault(descriptor)
+	if err := validateAligner(timeSeriesFilter.Params.Get("aggregation.perSeriesAligner"), descriptor); err != nil {
+		dr.Error = err
+		return dr, cloudMonitoringResponse{}, "", nil
+	}
+
 	r, err := s.createRequest(timeSeriesFilter.logger, &dsInfo, path.Join("/v3/projects", projectName, "timeSeries"), nil)
 	if err != nil {
 		dr.Error = err
@@ -93,20 +103,113 @@ func (timeSeriesFilter *cloudMonitoringTimeSeriesFilter) run(ctx context.Context
 			return dr, cloudMonitoringResponse{}, "", nil
 		}
 		d.TimeSeries = append(d.TimeSeries, nextPage.TimeSeries...)
+		d.ExecutionErrors = append(d.ExecutionErrors, nextPage.ExecutionErrors...)
 		nextPageToken = nextPage.NextPageToken
 	}
 
+	if d.Unit == "" {
+		d.Unit = descriptor.Unit
+	}
+	d.MetricDescription = descriptor.Description
+	d.MetricKind = descriptor.MetricKind
+	d.MetricValueType = descriptor.ValueType
+
 	return dr, d, r.URL.RawQuery, nil
 }
 
+// getMetricDescriptor returns the descriptor of the queried metric, which is used to validate the
+// query and to enrich the response. Queries are never blocked when the descriptor can't be fetched,
+// an empty descriptor is returned instead.
+func (timeSeriesFilter *cloudMonitoringTimeSeriesFilter) getMetricDescriptor(ctx context.Context, dsInfo datasourceInfo, projectName string) metricDescriptor {
+	if timeSeriesFilter.MetricType == "" {
+		return metricDescriptor{}
+	}
+
+	descriptor, err := getMetricDescriptor(ctx, dsInfo, projectName, timeSeriesFilter.MetricType)
+	if err != nil {
+		timeSeriesFilter.logger.Debug("Failed to get metric descriptor", "metricType", timeSeriesFilter.MetricType, "error", err)
+		return metricDescriptor{}
+	}
+
+	return descriptor
+}
+
+// applyCumulativeAlignerDefault aligns CUMULATIVE metrics with ALIGN_RATE instead of the
+// ALIGN_MEAN default when the query didn't specify an aligner, as the mean of a monotonic
+// counter isn't meaningful. Queries with a preprocessor already align with a rate or delta.
+func (timeSeriesFilter *cloudMonitoringTimeSeriesFilter) applyCumulativeAlignerDefault(descriptor metricDescriptor) {
+	if !timeSeriesFilter.defaultAligner || descriptor.MetricKind != "CUMULATIVE" {
+		return
+	}
+	if timeSeriesFilter.Params.Get("aggregation.perSeriesAligner") != perSeriesAlignerDefault || validateAligner(alignRate, descriptor) != nil {
+		return
+	}
+
+	timeSeriesFilter.Params.Set("aggregation.perSeriesAligner", alignRate)
+	timeSeriesFilter.Target = timeSeriesFilter.Params.Encode()
+	timeSeriesFilter.rateAlignerDefaulted = true
+}
+
+// buildSLOBurnRateDeepLink links to the SLO in the services monitoring page, with the burn rate
+// alerting view for the lookback period of the query
+func (timeSeriesFilter *cloudMonitoringTimeSeriesFilter) buildSLOBurnRateDeepLink() string {
+	u, err := url.Parse("https://console.cloud.google.com/monitoring/services")
+	if err != nil {
+		slog.Error("Failed to generate deep link: unable to parse services URL", "ProjectName",
+			timeSeriesFilter.ProjectName, "query", timeSeriesFilter.RefID)
+		return ""
+	}
+	u.Path = path.Join(u.Path, timeSeriesFilter.Service)
+
+	rawQuery := u.Query()
+	rawQuery.Set("project", timeSeriesFilter.ProjectName)
+	rawQuery.Set("Grafana_deeplink", "true")
+
+	pageState := map[string]interface{}{
+		"slo": map[string]string{
+			"name":           fmt.Sprintf("projects/%s/services/%s/serviceLevelObjectives/%s", timeSeriesFilter.ProjectName, timeSeriesFilter.Service, timeSeriesFilter.Slo),
+			"view":           "burnRate",
+			"lookbackPeriod": timeSeriesFilter.Lookback,
+		},
+		"timeSelection": map[string]string{
+			"timeRange": "custom",
+			"start":     timeSeriesFilter.Params.Get("interval.startTime"),
+			"end":       timeSeriesFilter.Params.Get("interval.endTime"),
+		},
+	}
+
+	blob, err := json.Marshal(pageState)
+	if err != nil {
+		slog.Error("Failed to generate deep link", "pageState", pageState, "ProjectName", timeSeriesFilter.ProjectName,
+			"query", timeSeriesFilter.RefID)
+		return ""
+	}
+
+	rawQuery.Set("pageState", string(blob))
+	u.RawQuery = rawQuery.Encode()
+
+	accountChooserURL, err := url.Parse("https://accounts.google.com/AccountChooser")
+	if err != nil {
+		slog.Error("Failed to generate deep link: unable to parse account chooser URL", "ProjectName",
+			timeSeriesFilter.ProjectName, "query", timeSeriesFilter.RefID)
+		return ""
+	}
+	accountChooserQuery := accountChooserURL.Query()
+	accountChooserQuery.Set("continue", u.String())
+	accountChooserURL.RawQuery = accountChooserQuery.Encode()
+
+	return accountChooserURL.String()
+}
+
 //nolint:gocyclo
 func (timeSeriesFilter *cloudMonitoringTimeSeriesFilter) parseResponse(queryRes *backend.DataResponse,
 	response cloudMonitoringResponse, executedQueryString string) error {
 	frames := data.Frames{}
 
-	for _, series := range response.TimeSeries {
+	seriesNames := defaultSeriesNames(response.TimeSeries, timeSeriesFilter.GroupBys)
+	for seriesIndex, series := range response.TimeSeries {
 		seriesLabels := data.Labels{}
-		defaultMetricName := series.Metric.Type
+		defaultMetricName := seriesNames[seriesIndex]
 		labels := make(map[string]string)
 		labels["resource.type"] = series.Resource.Type
 		seriesLabels["resource.type"] = series.Resource.Type
@@ -120,19 +223,15 @@ func (timeSeriesFilter *cloudMonitoringTimeSeriesFilter) parseResponse(queryRes
 		for key, value := range series.Metric.Labels {
 			labels["metric.label."+key] = value
 			seriesLabels["metric.label."+key] = value
-
-			if len(timeSeriesFilter.GroupBys) == 0 || containsLabel(timeSeriesFilter.GroupBys, "metric.label."+key) {
-				defaultMetricName += " " + value
-			}
 		}
 
 		for key, value := range series.Resource.Labels {
 			labels["resource.label."+key] = value
 			seriesLabels["resource.label."+key] = value
+		}
 
-			if containsLabel(timeSeriesFilter.GroupBys, "resource.label."+key) {
-				defaultMetricName += " " + value
-			}
+		if timeSeriesFilter.includeMetricTypeLabel {
+			seriesLabels["metricType"] = series.Metric.Type
 		}
 
 		for labelType, labelTypeValues := range series.MetaData {
@@ -165,15 +264,29 @@ func (timeSeriesFilter *cloudMonitoringTimeSeriesFilter) parseResponse(queryRes
 		customFrameMeta["perSeriesAligner"] = timeSeriesFilter.Params.Get("aggregation.perSeriesAligner")
 		customFrameMeta["labels"] = labels
 		customFrameMeta["groupBys"] = timeSeriesFilter.GroupBys
+		if response.MetricKind != "" {
+			customFrameMeta["metricKind"] = response.MetricKind
+			customFrameMeta["valueType"] = response.MetricValueType
+		}
 		if frame.Meta != nil {
 			frame.Meta.Custom = customFrameMeta
 		} else {
 			frame.SetMeta(&data.FrameMeta{Custom: customFrameMeta})
 		}
 
+		// headers only responses don't contain points, the frame just carries the series labels
+		if timeSeriesFilter.Params.Get("view") == "HEADERS" {
+			frame.Name = formatLegendKeys(series.Metric.Type, defaultMetricName, seriesLabels, nil, timeSeriesFilter)
+			frame.Fields = []*data.Field{}
+			frames = append(frames, frame)
+			continue
+		}
+
 		// reverse the order to be ascending
 		if series.ValueType != "DISTRIBUTION" {
-			timeSeriesFilter.handleNonDistributionSeries(series, defaultMetricName, seriesLabels, frame)
+			if err := timeSeriesFilter.handleNonDistributionSeries(series, defaultMetricName, seriesLabels, frame); err != nil {
+				return err
+			}
 			frames = append(frames, frame)
 			continue
 		}
@@ -210,7 +323,8 @@ func (timeSeriesFilter *cloudMonitoringTimeSeriesFilter) parseResponse(queryRes
 						},
 						RefID: timeSeriesFilter.RefID,
 						Meta: &data.FrameMeta{
-							ExecutedQueryString: executedQueryString,
+							ExecutedQueryString:    executedQueryString,
+							PreferredVisualization: visTypeHeatmap,
 						},
 					}
 				}
@@ -225,9 +339,52 @@ func (timeSeriesFilter *cloudMonitoringTimeSeriesFilter) parseResponse(queryRes
 			frames = append(frames, frame)
 		}
 	}
-	if len(response.TimeSeries) > 0 {
+	// a query that matches nothing still returns a typed frame, so the panel shows no data
+	// instead of failing to find the query's fields
+	if len(response.TimeSeries) == 0 {
+		frame := data.NewFrameOfFieldTypes("", 0, data.FieldTypeTime, data.FieldTypeFloat64)
+		frame.RefID = timeSeriesFilter.RefID
+		frame.Meta = &data.FrameMeta{
+			ExecutedQueryString: executedQueryString,
+		}
+		frames = append(frames, frame)
+	}
+	if len(response.TimeSeries) > 0 && timeSeriesFilter.Params.Get("view") != "HEADERS" {
 		dl := timeSeriesFilter.buildDeepLink()
 		frames = addConfigData(frames, dl, response.Unit, timeSeriesFilter.Params.Get("aggregation.alignmentPeriod"))
+		addFieldDescription(frames, response.MetricDescription)
+	}
+	renameFrameLabels(frames, timeSeriesFilter.labelRenames)
+	if timeSeriesFilter.fillMissing != "" && timeSeriesFilter.Params.Get("view") != "HEADERS" {
+		alignmentPeriod, err := intervalv2.ParseIntervalStringToTimeDuration(strings.TrimPrefix(timeSeriesFilter.Params.Get("aggregation.alignmentPeriod"), "+"))
+		if err == nil {
+			frames = fillMissingPoints(frames, timeSeriesFilter.fillMissing, alignmentPeriod)
+		}
+	}
+	if timeSeriesFilter.downsample {
+		frames = downsampleFrames(frames, timeSeriesFilter.maxDataPoints)
+	}
+	addTruncationNotice(frames, response.ExecutionErrors)
+	if timeSeriesFilter.alignmentPeriodClamped && len(frames) > 0 {
+		if frames[0].Meta == nil {
+			frames[0].Meta = &data.FrameMeta{}
+		}
+		frames[0].Meta.Notices = append(frames[0].Meta.Notices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("The alignment period was limited to the maximum of %ds allowed by the Cloud Monitoring API. Narrow down the time range to get a finer alignment.", maxAlignmentPeriodSeconds),
+		})
+	}
+	if timeSeriesFilter.rateAlignerDefaulted && len(frames) > 0 {
+		if frames[0].Meta == nil {
+			frames[0].Meta = &data.FrameMeta{}
+		}
+		frames[0].Meta.Notices = append(frames[0].Meta.Notices, data.Notice{
+			Severity: data.NoticeSeverityInfo,
+			Text:     fmt.Sprintf("%s is a cumulative metric, so it was aligned with %s instead of %s. Select an aligner to override this.", timeSeriesFilter.MetricType, alignRate, perSeriesAlignerDefault),
+		})
+	}
+	if timeSeriesFilter.debugRawResponse {
+		addRawResponse(frames, response.RawResponse)
 	}
 
 	queryRes.Frames = frames
@@ -235,26 +392,112 @@ func (timeSeriesFilter *cloudMonitoringTimeSeriesFilter) parseResponse(queryRes
 	return nil
 }
 
-func (timeSeriesFilter *cloudMonitoringTimeSeriesFilter) handleNonDistributionSeries(series timeSeries,
-	defaultMetricName string, seriesLabels map[string]string, frame *data.Frame) {
-	for i := 0; i < len(series.Points); i++ {
-		point := series.Points[i]
-		value := point.Value.DoubleValue
+// defaultSeriesNames returns the names of the series used when the query has no alias. Series are
+// named by their metric type followed by the values of their metric labels, or of the labels they
+// are grouped by. Only when these names collide are the series named by the labels that vary.
+func defaultSeriesNames(series []timeSeries, groupBys []string) []string {
+	names := make([]string, len(series))
+	seen := make(map[string]bool, len(series))
+	collision := false
+	for i, ts := range series {
+		names[i] = groupBySeriesName(ts, groupBys)
+		if seen[names[i]] {
+			collision = true
+		}
+		seen[names[i]] = true
+	}
+	if !collision {
+		return names
+	}
 
-		if series.ValueType == "INT64" {
-			parsedValue, err := strconv.ParseFloat(point.Value.IntValue, 64)
-			if err == nil {
-				value = parsedValue
-			}
+	labelKeys := distinguishingLabelKeys(series, groupBys)
+	for i, ts := range series {
+		names[i] = defaultSeriesName(ts, labelKeys)
+	}
+	return names
+}
+
+// groupBySeriesName names a series by its metric type followed by the values of its metric labels,
+// or of its metric and resource labels in the group bys when the query has any
+func groupBySeriesName(series timeSeries, groupBys []string) string {
+	name := series.Metric.Type
+	for key, value := range series.Metric.Labels {
+		if len(groupBys) == 0 || containsLabel(groupBys, "metric.label."+key) {
+			name += " " + value
+		}
+	}
+	for key, value := range series.Resource.Labels {
+		if containsLabel(groupBys, "resource.label."+key) {
+			name += " " + value
+		}
+	}
+	return name
+}
+
+// distinguishingLabelKeys returns the metric and resource label keys whose values vary across the
+// series, which tell the series apart when the query has no alias. When the query has group bys,
+// only those are considered. Keys are sorted, so metric labels come before resource labels.
+func distinguishingLabelKeys(series []timeSeries, groupBys []string) []string {
+	if len(series) < 2 {
+		return nil
+	}
+
+	candidates := map[string]struct{}{}
+	for _, ts := range series {
+		for key := range ts.Metric.Labels {
+			candidates["metric.label."+key] = struct{}{}
 		}
+		for key := range ts.Resource.Labels {
+			candidates["resource.label."+key] = struct{}{}
+		}
+	}
 
-		if series.ValueType == "BOOL" {
-			if point.Value.BoolValue {
-				value = 1
-			} else {
-				value = 0
+	var keys []string
+	for key := range candidates {
+		if len(groupBys) > 0 && !containsLabel(groupBys, key) {
+			continue
+		}
+		first := seriesLabelValue(series[0], key)
+		for _, ts := range series[1:] {
+			if seriesLabelValue(ts, key) != first {
+				keys = append(keys, key)
+				break
 			}
 		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// defaultSeriesName names a series by its metric type followed by the values of the given labels
+func defaultSeriesName(series timeSeries, labelKeys []string) string {
+	name := series.Metric.Type
+	for _, key := range labelKeys {
+		if value := seriesLabelValue(series, key); value != "" {
+			name += " " + value
+		}
+	}
+	return name
+}
+
+// seriesLabelValue returns the value of a metric.label. or resource.label. key of the series
+func seriesLabelValue(series timeSeries, key string) string {
+	if strings.HasPrefix(key, "metric.label.") {
+		return series.Metric.Labels[strings.TrimPrefix(key, "metric.label.")]
+	}
+	return series.Resource.Labels[strings.TrimPrefix(key, "resource.label.")]
+}
+
+func (timeSeriesFilter *cloudMonitoringTimeSeriesFilter) handleNonDistributionSeries(series timeSeries,
+	defaultMetricName string, seriesLabels map[string]string, frame *data.Frame) error {
+	frame.Fields[1] = newPointValueField(series.ValueType, len(series.Points))
+	for i := 0; i < len(series.Points); i++ {
+		point := series.Points[i]
+		value, err := pointValue(series.ValueType, point.Value.DoubleValue, point.Value.IntValue, point.Value.BoolValue, point.Value.StringValue)
+		if err != nil {
+			return err
+		}
 		frame.SetRow(len(series.Points)-1-i, point.Interval.EndTime, value)
 	}
 
@@ -263,10 +506,14 @@ func (timeSeriesFilter *cloudMonitoringTimeSeriesFilter) handleNonDistributionSe
 	dataField.Name = metricName
 	dataField.Labels = seriesLabels
 	setDisplayNameAsFieldName(dataField)
+	return nil
 }
 
 func (timeSeriesFilter *cloudMonitoringTimeSeriesFilter) buildDeepLink() string {
 	if timeSeriesFilter.Slo != "" {
+		if timeSeriesFilter.Selector == "select_slo_burn_rate" {
+			return timeSeriesFilter.buildSLOBurnRateDeepLink()
+		}
 		return ""
 	}
 
@@ -289,6 +536,12 @@ func (timeSeriesFilter *cloudMonitoringTimeSeriesFilter) buildDeepLink() string
 	rawQuery.Set("project", timeSeriesFilter.ProjectName)
 	rawQuery.Set("Grafana_deeplink", "true")
 
+	// group bys are applied in the secondary aggregation as well when a preprocessor is used
+	secondaryGroupByFields := []string{}
+	if groupByFields, ok := timeSeriesFilter.Params["secondaryAggregation.groupByFields"]; ok {
+		secondaryGroupByFields = groupByFields
+	}
+
 	pageState := map[string]interface{}{
 		"xyChart": map[string]interface{}{
 			"constantLines": []string{},
@@ -299,9 +552,9 @@ func (timeSeriesFilter *cloudMonitoringTimeSeriesFilter) buildDeepLink() string
 						"crossSeriesReducer":     timeSeriesFilter.Params.Get("aggregation.crossSeriesReducer"),
 						"filter":                 filter,
 						"groupByFields":          timeSeriesFilter.Params["aggregation.groupByFields"],
-						"minAlignmentPeriod":     strings.TrimPrefix(timeSeriesFilter.Params.Get("aggregation.alignmentPeriod"), "+"), // get rid of leading +
+						"minAlignmentPeriod":     toDeepLinkAlignmentPeriod(timeSeriesFilter.Params.Get("aggregation.alignmentPeriod")),
 						"perSeriesAligner":       timeSeriesFilter.Params.Get("aggregation.perSeriesAligner"),
-						"secondaryGroupByFields": []string{},
+						"secondaryGroupByFields": secondaryGroupByFields,
 						"unitOverride":           "1",
 					},
 				},
@@ -352,3 +605,17 @@ func setDisplayNameAsFieldName(f *data.Field) {
 func (timeSeriesFilter *cloudMonitoringTimeSeriesFilter) getRefID() string {
 	return timeSeriesFilter.RefID
 }
+
+func (timeSeriesFilter *cloudMonitoringTimeSeriesFilter) getCorrelationID() string {
+	return timeSeriesFilter.correlationID
+}
+
+// CacheKey identifies the query as it was built, run changes the params while executing it
+func (timeSeriesFilter *cloudMonitoringTimeSeriesFilter) CacheKey() string {
+	return timeSeriesFilter.cacheKey
+}
+
+// computeCacheKey hashes the project and encoded params, which include the time range
+func (timeSeriesFilter *cloudMonitoringTimeSeriesFilter) computeCacheKey() string {
+	return buildCacheKey(timeSeriesFilter.ProjectName, timeSeriesFilter.Params.Encode())
+}
@@ -7,6 +7,7 @@ import (
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -82,6 +83,40 @@ func TestTimeSeriesFilter(t *testing.T) {
 		assert.Equal(t, "grafana-prod", field.Labels["resource.label.project_id"])
 	})
 
+	t.Run("when there's no alias by", func(t *testing.T) {
+		t.Run("series are named by their metric labels", func(t *testing.T) {
+			var response cloudMonitoringResponse
+			require.NoError(t, json.Unmarshal([]byte(`{"timeSeries": [
+				{"metric": {"type": "a/metric/type", "labels": {"response_code": "200"}}, "resource": {"type": "global", "labels": {"instance_id": "1"}}, "valueType": "DOUBLE", "points": []},
+				{"metric": {"type": "a/metric/type", "labels": {"response_code": "500"}}, "resource": {"type": "global", "labels": {"instance_id": "2"}}, "valueType": "DOUBLE", "points": []}
+			]}`), &response))
+
+			res := &backend.DataResponse{}
+			query := &cloudMonitoringTimeSeriesFilter{Params: url.Values{}}
+			require.NoError(t, query.parseResponse(res, response, ""))
+
+			require.Len(t, res.Frames, 2)
+			assert.Equal(t, "a/metric/type 200", res.Frames[0].Fields[1].Name)
+			assert.Equal(t, "a/metric/type 500", res.Frames[1].Fields[1].Name)
+		})
+
+		t.Run("series with colliding names are named by the labels that vary across them", func(t *testing.T) {
+			var response cloudMonitoringResponse
+			require.NoError(t, json.Unmarshal([]byte(`{"timeSeries": [
+				{"metric": {"type": "a/metric/type", "labels": {"method": "GET"}}, "resource": {"type": "global", "labels": {"project_id": "test-proj", "instance_id": "1"}}, "valueType": "DOUBLE", "points": []},
+				{"metric": {"type": "a/metric/type", "labels": {"method": "GET"}}, "resource": {"type": "global", "labels": {"project_id": "test-proj", "instance_id": "2"}}, "valueType": "DOUBLE", "points": []}
+			]}`), &response))
+
+			res := &backend.DataResponse{}
+			query := &cloudMonitoringTimeSeriesFilter{Params: url.Values{}}
+			require.NoError(t, query.parseResponse(res, response, ""))
+
+			require.Len(t, res.Frames, 2)
+			assert.Equal(t, "a/metric/type 1", res.Frames[0].Fields[1].Name)
+			assert.Equal(t, "a/metric/type 2", res.Frames[1].Fields[1].Name)
+		})
+	})
+
 	t.Run("when data from query with no aggregation and group bys", func(t *testing.T) {
 		data, err := loadTestFile("./test-data/2-series-response-no-agg.json")
 		require.NoError(t, err)
@@ -132,6 +167,28 @@ func TestTimeSeriesFilter(t *testing.T) {
 			assert.Equal(t, "metric instance/cpu/usage_time service compute", frames[1].Fields[1].Name)
 			assert.Equal(t, "metric instance/cpu/usage_time service compute", frames[2].Fields[1].Name)
 		})
+
+		t.Run("and the alias pattern mixes present and absent labels", func(t *testing.T) {
+			query := &cloudMonitoringTimeSeriesFilter{Params: url.Values{}, AliasBy: "{{metric.label.instance_name}} {{metric.label.missing}}- {{resource.label.zone}}{{resource.label.missing}}", GroupBys: []string{"metric.label.instance_name", "resource.label.zone"}}
+			err = query.parseResponse(res, data, "")
+			require.NoError(t, err)
+			frames := res.Frames
+
+			assert.Equal(t, 3, len(frames))
+			assert.Equal(t, "collector-asia-east-1 - asia-east1-a", frames[0].Fields[1].Name)
+			assert.Equal(t, "collector-europe-west-1 - europe-west1-b", frames[1].Fields[1].Name)
+			assert.Equal(t, "collector-us-east-1 - us-east1-b", frames[2].Fields[1].Name)
+		})
+
+		t.Run("and the alias pattern only has absent labels", func(t *testing.T) {
+			query := &cloudMonitoringTimeSeriesFilter{Params: url.Values{}, AliasBy: "cpu{{metric.label.missing}}", GroupBys: []string{"metric.label.instance_name", "resource.label.zone"}}
+			err = query.parseResponse(res, data, "")
+			require.NoError(t, err)
+			frames := res.Frames
+
+			assert.Equal(t, 3, len(frames))
+			assert.Equal(t, "cpu", frames[0].Fields[1].Name)
+		})
 	})
 
 	t.Run("when data from query is distribution with exponential bounds", func(t *testing.T) {
@@ -152,6 +209,7 @@ func TestTimeSeriesFilter(t *testing.T) {
 				assert.Equal(t, strconv.FormatInt(int64(math.Pow(float64(2), float64(i-1))), 10), frames[i].Fields[1].Name)
 			}
 			assert.Equal(t, 3, frames[i].Fields[0].Len())
+			assert.Equal(t, visTypeHeatmap, frames[i].Meta.PreferredVisualization)
 		}
 
 		assert.Equal(t, time.Unix(int64(1536668940000/1000), 0).UTC(), frames[0].Fields[0].At(0))
@@ -209,6 +267,37 @@ func TestTimeSeriesFilter(t *testing.T) {
 		assert.Equal(t, float64(56), frames[10].Fields[1].At(1))
 	})
 
+	t.Run("when data from query is distribution with linear bounds", func(t *testing.T) {
+		var data cloudMonitoringResponse
+		err := json.Unmarshal([]byte(`{
+			"timeSeries": [{
+				"metric": {"type": "loadbalancing.googleapis.com/https/backend_latencies"},
+				"metricKind": "DELTA",
+				"valueType": "DISTRIBUTION",
+				"points": [{
+					"interval": {"startTime": "2018-09-11T12:29:00Z", "endTime": "2018-09-11T12:30:00Z"},
+					"value": {"distributionValue": {
+						"count": "10",
+						"bucketOptions": {"linearBuckets": {"numFiniteBuckets": 2, "width": 0.5, "offset": 1}},
+						"bucketCounts": ["1", "2", "3", "4"]
+					}}
+				}]
+			}]
+		}`), &data)
+		require.NoError(t, err)
+
+		res := &backend.DataResponse{}
+		query := &cloudMonitoringTimeSeriesFilter{Params: url.Values{}, AliasBy: "{{bucket}}"}
+		err = query.parseResponse(res, data, "")
+		require.NoError(t, err)
+
+		require.Len(t, res.Frames, 4)
+		for i, bound := range []string{"0", "1", "1.5", "2"} {
+			assert.Equal(t, bound, res.Frames[i].Fields[1].Name)
+			assert.Equal(t, float64(i+1), res.Frames[i].Fields[1].At(0))
+		}
+	})
+
 	t.Run("when data from query returns metadata system labels", func(t *testing.T) {
 		data, err := loadTestFile("./test-data/5-series-response-meta-data.json")
 		require.NoError(t, err)
@@ -295,6 +384,28 @@ func TestTimeSeriesFilter(t *testing.T) {
 			require.NoError(t, err)
 			assert.Equal(t, "test-proj - test-service - test-slo - select_slo_compliance", frames[0].Fields[1].Name)
 		})
+
+		t.Run("and alias by is taken from the query", func(t *testing.T) {
+			req := baseReq()
+			req.Queries[0].JSON = json.RawMessage(`{
+				"queryType": "slo",
+				"sloQuery": {
+					"projectName":  "test-proj",
+					"selectorName": "select_slo_health",
+					"serviceId":    "test-service",
+					"sloId":        "test-slo",
+					"aliasBy":      "{{slo}} ({{selector}})"
+				}
+			}`)
+			qes, err := (&Service{}).buildQueryExecutors(slog, req, datasourceInfo{})
+			require.NoError(t, err)
+			query, ok := qes[0].(*cloudMonitoringTimeSeriesFilter)
+			require.True(t, ok)
+
+			res := &backend.DataResponse{}
+			require.NoError(t, query.parseResponse(res, data, ""))
+			assert.Equal(t, "test-slo (select_slo_health)", res.Frames[0].Fields[1].Name)
+		})
 	})
 
 	t.Run("when data from query returns slo and alias by is not defined", func(t *testing.T) {
@@ -415,7 +526,8 @@ func TestTimeSeriesFilter(t *testing.T) {
 
 			require.NotNil(t, res.Frames[0].Meta)
 			assert.Equal(t, sdkdata.FrameMeta{
-				ExecutedQueryString: "test_query",
+				ExecutedQueryString:    "test_query",
+				PreferredVisualization: visTypeHeatmap,
 				Custom: map[string]interface{}{
 					"groupBys":        []string{"test_group_by"},
 					"alignmentPeriod": "",
@@ -438,7 +550,8 @@ func TestTimeSeriesFilter(t *testing.T) {
 
 			require.NotNil(t, res.Frames[0].Meta)
 			assert.Equal(t, sdkdata.FrameMeta{
-				ExecutedQueryString: "test_query",
+				ExecutedQueryString:    "test_query",
+				PreferredVisualization: visTypeHeatmap,
 				Custom: map[string]interface{}{
 					"groupBys":        []string{"test_group_by"},
 					"alignmentPeriod": "",
@@ -461,7 +574,8 @@ func TestTimeSeriesFilter(t *testing.T) {
 
 			require.NotNil(t, res.Frames[0].Meta)
 			assert.Equal(t, sdkdata.FrameMeta{
-				ExecutedQueryString: "test_query",
+				ExecutedQueryString:    "test_query",
+				PreferredVisualization: visTypeHeatmap,
 				Custom: map[string]interface{}{
 					"groupBys":        []string{"test_group_by"},
 					"alignmentPeriod": "",
@@ -475,6 +589,366 @@ func TestTimeSeriesFilter(t *testing.T) {
 		})
 	})
 
+	t.Run("when the API reports execution errors", func(t *testing.T) {
+		data, err := loadTestFile("./test-data/2-series-response-no-agg.json")
+		require.NoError(t, err)
+		data.ExecutionErrors = []apiStatus{{Code: 4, Message: "Deadline exceeded reading the series"}}
+
+		res := &backend.DataResponse{}
+		query := &cloudMonitoringTimeSeriesFilter{Params: url.Values{}}
+		require.NoError(t, query.parseResponse(res, data, ""))
+		require.Len(t, res.Frames, 3)
+		require.Len(t, res.Frames[0].Meta.Notices, 1)
+		assert.Equal(t, sdkdata.NoticeSeverityWarning, res.Frames[0].Meta.Notices[0].Severity)
+		assert.Contains(t, res.Frames[0].Meta.Notices[0].Text, "Deadline exceeded reading the series")
+		assert.Empty(t, res.Frames[1].Meta.Notices)
+	})
+
+	t.Run("when the response is complete", func(t *testing.T) {
+		data, err := loadTestFile("./test-data/2-series-response-no-agg.json")
+		require.NoError(t, err)
+
+		res := &backend.DataResponse{}
+		query := &cloudMonitoringTimeSeriesFilter{Params: url.Values{}}
+		require.NoError(t, query.parseResponse(res, data, ""))
+		require.Len(t, res.Frames, 3)
+		assert.Empty(t, res.Frames[0].Meta.Notices)
+	})
+
+	t.Run("when the response has more points than max data points", func(t *testing.T) {
+		var points []string
+		for i := 9; i >= 0; i-- {
+			points = append(points, fmt.Sprintf(`{"interval": {"endTime": "2018-03-15T13:%02d:00Z"}, "value": {"doubleValue": %d}}`, i, i))
+		}
+		var response cloudMonitoringResponse
+		require.NoError(t, json.Unmarshal([]byte(fmt.Sprintf(`{"timeSeries": [{
+			"metric": {"type": "a/metric/type"},
+			"resource": {"type": "global"},
+			"valueType": "DOUBLE",
+			"points": [%s]
+		}]}`, strings.Join(points, ","))), &response))
+
+		t.Run("the series is downsampled when enabled", func(t *testing.T) {
+			res := &backend.DataResponse{}
+			query := &cloudMonitoringTimeSeriesFilter{Params: url.Values{}, downsample: true, maxDataPoints: 4}
+			require.NoError(t, query.parseResponse(res, response, ""))
+
+			require.Len(t, res.Frames, 1)
+			frame := res.Frames[0]
+			assert.Equal(t, 4, frame.Rows())
+			values := make([]float64, 0, frame.Rows())
+			for i := 0; i < frame.Rows(); i++ {
+				values = append(values, frame.Fields[1].At(i).(float64))
+			}
+			assert.Equal(t, []float64{2, 5, 8, 9}, values)
+			require.Len(t, frame.Meta.Notices, 1)
+			assert.Contains(t, frame.Meta.Notices[0].Text, "downsampled from up to 10 to at most 4 points")
+		})
+
+		t.Run("the series is kept as is by default", func(t *testing.T) {
+			res := &backend.DataResponse{}
+			query := &cloudMonitoringTimeSeriesFilter{Params: url.Values{}, maxDataPoints: 4}
+			require.NoError(t, query.parseResponse(res, response, ""))
+
+			require.Len(t, res.Frames, 1)
+			assert.Equal(t, 10, res.Frames[0].Rows())
+			assert.Empty(t, res.Frames[0].Meta.Notices)
+		})
+	})
+
+	t.Run("when the series has INT64 values", func(t *testing.T) {
+		var response cloudMonitoringResponse
+		require.NoError(t, json.Unmarshal([]byte(`{"timeSeries": [{
+			"metric": {"type": "a/metric/type"},
+			"resource": {"type": "global"},
+			"valueType": "INT64",
+			"points": [
+				{"interval": {"endTime": "2018-03-15T13:01:00Z"}, "value": {"int64Value": "9007199254740993"}},
+				{"interval": {"endTime": "2018-03-15T13:00:00Z"}, "value": {"int64Value": "42"}}
+			]
+		}]}`), &response))
+
+		res := &backend.DataResponse{}
+		query := &cloudMonitoringTimeSeriesFilter{Params: url.Values{}}
+		require.NoError(t, query.parseResponse(res, response, ""))
+
+		require.Len(t, res.Frames, 1)
+		field := res.Frames[0].Fields[1]
+		assert.Equal(t, sdkdata.FieldTypeInt64, field.Type())
+		assert.Equal(t, int64(42), field.At(0))
+		assert.Equal(t, int64(9007199254740993), field.At(1))
+	})
+
+	t.Run("when the series has an INT64 value that can't be parsed", func(t *testing.T) {
+		var response cloudMonitoringResponse
+		require.NoError(t, json.Unmarshal([]byte(`{"timeSeries": [{
+			"metric": {"type": "a/metric/type"},
+			"resource": {"type": "global"},
+			"valueType": "INT64",
+			"points": [
+				{"interval": {"endTime": "2018-03-15T13:00:00Z"}, "value": {"int64Value": "4.2"}}
+			]
+		}]}`), &response))
+
+		res := &backend.DataResponse{}
+		query := &cloudMonitoringTimeSeriesFilter{Params: url.Values{}}
+		err := query.parseResponse(res, response, "")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `invalid INT64 point value "4.2"`)
+	})
+
+	t.Run("when the series has BOOL values", func(t *testing.T) {
+		var response cloudMonitoringResponse
+		require.NoError(t, json.Unmarshal([]byte(`{"timeSeries": [{
+			"metric": {"type": "a/metric/type"},
+			"resource": {"type": "global"},
+			"valueType": "BOOL",
+			"points": [
+				{"interval": {"endTime": "2018-03-15T13:02:00Z"}, "value": {"boolValue": true}},
+				{"interval": {"endTime": "2018-03-15T13:01:00Z"}, "value": {"boolValue": false}},
+				{"interval": {"endTime": "2018-03-15T13:00:00Z"}, "value": {"boolValue": true}}
+			]
+		}]}`), &response))
+
+		res := &backend.DataResponse{}
+		query := &cloudMonitoringTimeSeriesFilter{Params: url.Values{}}
+		require.NoError(t, query.parseResponse(res, response, ""))
+
+		require.Len(t, res.Frames, 1)
+		field := res.Frames[0].Fields[1]
+		assert.Equal(t, sdkdata.FieldTypeFloat64, field.Type())
+		values := make([]float64, 0, field.Len())
+		for i := 0; i < field.Len(); i++ {
+			values = append(values, field.At(i).(float64))
+		}
+		assert.Equal(t, []float64{1, 0, 1}, values)
+
+		require.NotNil(t, field.Config)
+		assert.Equal(t, sdkdata.ConfFloat64(0), *field.Config.Min)
+		assert.Equal(t, sdkdata.ConfFloat64(1), *field.Config.Max)
+		require.Len(t, field.Config.Mappings, 1)
+		assert.Equal(t, sdkdata.ValueMapper{
+			"0": sdkdata.ValueMappingResult{Text: "false"},
+			"1": sdkdata.ValueMappingResult{Text: "true"},
+		}, field.Config.Mappings[0])
+	})
+
+	t.Run("when the series has STRING values", func(t *testing.T) {
+		var response cloudMonitoringResponse
+		require.NoError(t, json.Unmarshal([]byte(`{"timeSeries": [{
+			"metric": {"type": "custom.googleapis.com/app/version", "labels": {"service": "api"}},
+			"resource": {"type": "global"},
+			"valueType": "STRING",
+			"points": [
+				{"interval": {"endTime": "2018-03-15T13:01:00Z"}, "value": {"stringValue": "v1.3.0"}},
+				{"interval": {"endTime": "2018-03-15T13:00:00Z"}, "value": {"stringValue": "v1.2.1"}}
+			]
+		}]}`), &response))
+
+		res := &backend.DataResponse{}
+		query := &cloudMonitoringTimeSeriesFilter{Params: url.Values{}}
+		require.NoError(t, query.parseResponse(res, response, ""))
+
+		require.Len(t, res.Frames, 1)
+		field := res.Frames[0].Fields[1]
+		assert.Equal(t, sdkdata.FieldTypeString, field.Type())
+		assert.Equal(t, "v1.2.1", field.At(0))
+		assert.Equal(t, "v1.3.0", field.At(1))
+		assert.Equal(t, "api", field.Labels["metric.label.service"])
+	})
+
+	t.Run("when the series has a gap", func(t *testing.T) {
+		var response cloudMonitoringResponse
+		require.NoError(t, json.Unmarshal([]byte(`{"timeSeries": [{
+			"metric": {"type": "a/metric/type"},
+			"resource": {"type": "global"},
+			"valueType": "DOUBLE",
+			"points": [
+				{"interval": {"endTime": "2018-03-15T13:04:00Z"}, "value": {"doubleValue": 4}},
+				{"interval": {"endTime": "2018-03-15T13:01:00Z"}, "value": {"doubleValue": 1}},
+				{"interval": {"endTime": "2018-03-15T13:00:00Z"}, "value": {"doubleValue": 0}}
+			]
+		}]}`), &response))
+		params := url.Values{}
+		params.Set("aggregation.alignmentPeriod", "+60s")
+
+		t.Run("nulls are inserted in the null mode", func(t *testing.T) {
+			res := &backend.DataResponse{}
+			query := &cloudMonitoringTimeSeriesFilter{Params: params, fillMissing: fillMissingNull}
+			require.NoError(t, query.parseResponse(res, response, ""))
+
+			require.Len(t, res.Frames, 1)
+			frame := res.Frames[0]
+			require.Equal(t, 5, frame.Rows())
+			start := time.Date(2018, 3, 15, 13, 0, 0, 0, time.UTC)
+			for i := 0; i < 5; i++ {
+				assert.Equal(t, start.Add(time.Duration(i)*time.Minute), frame.Fields[0].At(i))
+			}
+			assert.Equal(t, sdkdata.FieldTypeNullableFloat64, frame.Fields[1].Type())
+			values := make([]*float64, 0, frame.Rows())
+			for i := 0; i < frame.Rows(); i++ {
+				values = append(values, frame.Fields[1].At(i).(*float64))
+			}
+			ptr := func(v float64) *float64 { return &v }
+			assert.Equal(t, []*float64{ptr(0), ptr(1), nil, nil, ptr(4)}, values)
+		})
+
+		t.Run("zeros are inserted in the zero mode", func(t *testing.T) {
+			res := &backend.DataResponse{}
+			query := &cloudMonitoringTimeSeriesFilter{Params: params, fillMissing: fillMissingZero}
+			require.NoError(t, query.parseResponse(res, response, ""))
+
+			frame := res.Frames[0]
+			require.Equal(t, 5, frame.Rows())
+			values := make([]float64, 0, frame.Rows())
+			for i := 0; i < frame.Rows(); i++ {
+				values = append(values, frame.Fields[1].At(i).(float64))
+			}
+			assert.Equal(t, []float64{0, 1, 0, 0, 4}, values)
+		})
+
+		t.Run("the gap is kept in the connected mode", func(t *testing.T) {
+			res := &backend.DataResponse{}
+			query := &cloudMonitoringTimeSeriesFilter{Params: params, fillMissing: fillMissingConnected}
+			require.NoError(t, query.parseResponse(res, response, ""))
+
+			assert.Equal(t, 3, res.Frames[0].Rows())
+			assert.Equal(t, sdkdata.FieldTypeFloat64, res.Frames[0].Fields[1].Type())
+		})
+	})
+
+	t.Run("when the raw response is requested for debugging", func(t *testing.T) {
+		raw, err := os.ReadFile("./test-data/1-series-response-agg-one-metric.json")
+		require.NoError(t, err)
+		data, err := loadTestFile("./test-data/1-series-response-agg-one-metric.json")
+		require.NoError(t, err)
+		data.RawResponse = raw
+
+		t.Run("the raw body is attached to the frame meta", func(t *testing.T) {
+			res := &backend.DataResponse{}
+			query := &cloudMonitoringTimeSeriesFilter{Params: url.Values{}, debugRawResponse: true}
+			require.NoError(t, query.parseResponse(res, data, ""))
+
+			custom, ok := res.Frames[0].Meta.Custom.(map[string]interface{})
+			require.True(t, ok)
+			assert.Equal(t, string(raw), custom["rawResponse"])
+		})
+
+		t.Run("the raw body is cut off at the maximum length", func(t *testing.T) {
+			res := &backend.DataResponse{}
+			query := &cloudMonitoringTimeSeriesFilter{Params: url.Values{}, debugRawResponse: true}
+			large := data
+			large.RawResponse = []byte(strings.Repeat("x", maxRawResponseLength+1))
+			require.NoError(t, query.parseResponse(res, large, ""))
+
+			custom := res.Frames[0].Meta.Custom.(map[string]interface{})
+			assert.Len(t, custom["rawResponse"], maxRawResponseLength)
+		})
+
+		t.Run("the raw body is omitted by default", func(t *testing.T) {
+			res := &backend.DataResponse{}
+			query := &cloudMonitoringTimeSeriesFilter{Params: url.Values{}}
+			require.NoError(t, query.parseResponse(res, data, ""))
+
+			custom := res.Frames[0].Meta.Custom.(map[string]interface{})
+			assert.NotContains(t, custom, "rawResponse")
+		})
+	})
+
+	t.Run("when the metric type label is requested", func(t *testing.T) {
+		data, err := loadTestFile("./test-data/2-series-response-no-agg.json")
+		require.NoError(t, err)
+
+		t.Run("every series is labeled with the metric type", func(t *testing.T) {
+			res := &backend.DataResponse{}
+			query := &cloudMonitoringTimeSeriesFilter{Params: url.Values{}, includeMetricTypeLabel: true}
+			require.NoError(t, query.parseResponse(res, data, ""))
+
+			require.Len(t, res.Frames, 3)
+			for _, frame := range res.Frames {
+				assert.Equal(t, "compute.googleapis.com/instance/cpu/usage_time", frame.Fields[1].Labels["metricType"])
+			}
+			assert.Equal(t, "compute.googleapis.com/instance/cpu/usage_time collector-asia-east-1", res.Frames[0].Fields[1].Name)
+		})
+
+		t.Run("the label is omitted by default", func(t *testing.T) {
+			res := &backend.DataResponse{}
+			query := &cloudMonitoringTimeSeriesFilter{Params: url.Values{}}
+			require.NoError(t, query.parseResponse(res, data, ""))
+
+			require.Len(t, res.Frames, 3)
+			for _, frame := range res.Frames {
+				assert.NotContains(t, frame.Fields[1].Labels, "metricType")
+			}
+		})
+	})
+
+	t.Run("when label renames are set", func(t *testing.T) {
+		data, err := loadTestFile("./test-data/2-series-response-no-agg.json")
+		require.NoError(t, err)
+
+		res := &backend.DataResponse{}
+		query := &cloudMonitoringTimeSeriesFilter{Params: url.Values{}, labelRenames: map[string]string{
+			"metric.label.instance_name": "instance",
+		}}
+		require.NoError(t, query.parseResponse(res, data, ""))
+
+		require.Len(t, res.Frames, 3)
+		labels := res.Frames[0].Fields[1].Labels
+		assert.Equal(t, "collector-asia-east-1", labels["instance"])
+		assert.NotContains(t, labels, "metric.label.instance_name")
+		assert.Equal(t, "asia-east1-a", labels["resource.label.zone"])
+		assert.Equal(t, "compute.googleapis.com/instance/cpu/usage_time collector-asia-east-1", res.Frames[0].Fields[1].Name)
+	})
+
+	t.Run("when the response has no time series", func(t *testing.T) {
+		res := &backend.DataResponse{}
+		query := &cloudMonitoringTimeSeriesFilter{RefID: "A", Params: url.Values{}}
+		require.NoError(t, query.parseResponse(res, cloudMonitoringResponse{}, "metric.type=\"a/metric/type\""))
+
+		require.Len(t, res.Frames, 1)
+		frame := res.Frames[0]
+		assert.Equal(t, "A", frame.RefID)
+		assert.Equal(t, 0, frame.Rows())
+		require.Len(t, frame.Fields, 2)
+		assert.Equal(t, sdkdata.FieldTypeTime, frame.Fields[0].Type())
+		assert.Equal(t, sdkdata.FieldTypeFloat64, frame.Fields[1].Type())
+		assert.Equal(t, "metric.type=\"a/metric/type\"", frame.Meta.ExecutedQueryString)
+	})
+
+	t.Run("when the query only requests headers", func(t *testing.T) {
+		req := baseReq()
+		req.Queries[0].JSON = json.RawMessage(`{
+			"queryType": "metrics",
+			"metricQuery": {
+				"metricType": "compute.googleapis.com/instance/cpu/usage_time",
+				"view":       "HEADERS"
+			}
+		}`)
+		qes, err := (&Service{}).buildQueryExecutors(slog, req, datasourceInfo{})
+		require.NoError(t, err)
+		query, ok := qes[0].(*cloudMonitoringTimeSeriesFilter)
+		require.True(t, ok)
+		assert.Equal(t, "HEADERS", query.Params.Get("view"))
+
+		data, err := loadTestFile("./test-data/2-series-response-no-agg.json")
+		require.NoError(t, err)
+		for i := range data.TimeSeries {
+			data.TimeSeries[i].Points = nil
+		}
+
+		res := &backend.DataResponse{}
+		require.NoError(t, query.parseResponse(res, data, ""))
+		require.Len(t, res.Frames, 3)
+		for _, frame := range res.Frames {
+			assert.Empty(t, frame.Fields)
+		}
+		assert.Equal(t, "compute.googleapis.com/instance/cpu/usage_time collector-asia-east-1", res.Frames[0].Name)
+		custom, ok := res.Frames[0].Meta.Custom.(map[string]interface{})
+		require.True(t, ok)
+		assert.Equal(t, "collector-asia-east-1", custom["labels"].(map[string]string)["metric.label.instance_name"])
+	})
+
 	t.Run("when data comes from a slo query, it should skip the link", func(t *testing.T) {
 		data, err := loadTestFile("./test-data/3-series-response-distribution-exponential.json")
 		require.NoError(t, err)
@@ -5,10 +5,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"net/url"
 	"path"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -36,13 +36,26 @@ func (timeSeriesQuery *cloudMonitoringTimeSeriesQuery) appendGraphPeriod(req *ba
 	return ""
 }
 
+// withinClauseRe matches a within table operation, up to the next table operation
+var withinClauseRe = regexp.MustCompile(`\|\s*within\b[^|]*`)
+
+// removeWithinClauses strips time ranges hardcoded in the query, the panel time range is
+// always appended to the query and would otherwise conflict with them
+func (timeSeriesQuery *cloudMonitoringTimeSeriesQuery) removeWithinClauses() {
+	if !withinClauseRe.MatchString(timeSeriesQuery.Query) {
+		return
+	}
+
+	timeSeriesQuery.Query = strings.TrimSpace(withinClauseRe.ReplaceAllString(timeSeriesQuery.Query, ""))
+	timeSeriesQuery.withinClauseRemoved = true
+}
+
 func doRequestQueryPage(log log.Logger, requestBody map[string]interface{}, r *http.Request, dsInfo datasourceInfo) (cloudMonitoringResponse, error) {
 	buf, err := json.Marshal(requestBody)
 	if err != nil {
 		return cloudMonitoringResponse{}, err
 	}
-	r.Body = io.NopCloser(bytes.NewBuffer(buf))
-	res, err := dsInfo.services[cloudMonitor].client.Do(r)
+	res, err := doRequestWithRetry(dsInfo.services[cloudMonitor].client, r, buf)
 	if err != nil {
 		return cloudMonitoringResponse{}, err
 	}
@@ -69,6 +82,7 @@ func (timeSeriesQuery *cloudMonitoringTimeSeriesQuery) run(ctx context.Context,
 		timeSeriesQuery.logger.Info("No project name set on query, using project name from datasource", "projectName", projectName)
 	}
 
+	timeSeriesQuery.removeWithinClauses()
 	timeSeriesQuery.Query += timeSeriesQuery.appendGraphPeriod(req)
 	from := req.Queries[0].TimeRange.From
 	to := req.Queries[0].TimeRange.To
@@ -109,6 +123,7 @@ func (timeSeriesQuery *cloudMonitoringTimeSeriesQuery) run(ctx context.Context,
 			return dr, cloudMonitoringResponse{}, "", nil
 		}
 		d.TimeSeriesData = append(d.TimeSeriesData, nextPage.TimeSeriesData...)
+		d.PartialErrors = append(d.PartialErrors, nextPage.PartialErrors...)
 		d.NextPageToken = nextPage.NextPageToken
 	}
 
@@ -162,22 +177,13 @@ func (timeSeriesQuery *cloudMonitoringTimeSeriesQuery) parseResponse(queryRes *b
 
 			// process non-distribution series
 			if d.ValueType != "DISTRIBUTION" {
+				frame.Fields[1] = newPointValueField(d.ValueType, len(series.PointData))
 				// reverse the order to be ascending
 				for i := len(series.PointData) - 1; i >= 0; i-- {
 					point := series.PointData[i]
-					value := point.Values[n].DoubleValue
-
-					if d.ValueType == "INT64" {
-						parsedValue, err := strconv.ParseFloat(point.Values[n].Int64Value, 64)
-						if err == nil {
-							value = parsedValue
-						}
-					} else if d.ValueType == "BOOL" {
-						if point.Values[n].BoolValue {
-							value = 1
-						} else {
-							value = 0
-						}
+					value, err := pointValue(d.ValueType, point.Values[n].DoubleValue, point.Values[n].Int64Value, point.Values[n].BoolValue, point.Values[n].StringValue)
+					if err != nil {
+						return err
 					}
 
 					frame.SetRow(len(series.PointData)-1-i, series.PointData[i].TimeInterval.EndTime, value)
@@ -231,6 +237,9 @@ func (timeSeriesQuery *cloudMonitoringTimeSeriesQuery) parseResponse(queryRes *b
 								valueField,
 							},
 							RefID: timeSeriesQuery.RefID,
+							Meta: &data.FrameMeta{
+								PreferredVisualization: visTypeHeatmap,
+							},
 						}
 
 						if maxKey < i {
@@ -259,6 +268,9 @@ func (timeSeriesQuery *cloudMonitoringTimeSeriesQuery) parseResponse(queryRes *b
 								valueField,
 							},
 							RefID: timeSeriesQuery.RefID,
+							Meta: &data.FrameMeta{
+								PreferredVisualization: visTypeHeatmap,
+							},
 						}
 					}
 				}
@@ -280,6 +292,20 @@ func (timeSeriesQuery *cloudMonitoringTimeSeriesQuery) parseResponse(queryRes *b
 		dl := timeSeriesQuery.buildDeepLink()
 		frames = addConfigData(frames, dl, response.Unit, timeSeriesQuery.GraphPeriod)
 	}
+	renameFrameLabels(frames, timeSeriesQuery.labelRenames)
+	addTruncationNotice(frames, response.PartialErrors)
+	if timeSeriesQuery.withinClauseRemoved && len(frames) > 0 {
+		if frames[0].Meta == nil {
+			frames[0].Meta = &data.FrameMeta{}
+		}
+		frames[0].Meta.Notices = append(frames[0].Meta.Notices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     "The within clause of the query was ignored, the panel time range is used instead.",
+		})
+	}
+	if timeSeriesQuery.debugRawResponse {
+		addRawResponse(frames, response.RawResponse)
+	}
 
 	queryRes.Frames = frames
 
@@ -344,3 +370,24 @@ func (timeSeriesQuery *cloudMonitoringTimeSeriesQuery) buildDeepLink() string {
 func (timeSeriesQuery *cloudMonitoringTimeSeriesQuery) getRefID() string {
 	return timeSeriesQuery.RefID
 }
+
+func (timeSeriesQuery *cloudMonitoringTimeSeriesQuery) getCorrelationID() string {
+	return timeSeriesQuery.correlationID
+}
+
+// CacheKey identifies the query as it was built, run changes the query while executing it
+func (timeSeriesQuery *cloudMonitoringTimeSeriesQuery) CacheKey() string {
+	return timeSeriesQuery.cacheKey
+}
+
+// computeCacheKey hashes the project, MQL query, graph period and time range
+func (timeSeriesQuery *cloudMonitoringTimeSeriesQuery) computeCacheKey() string {
+	return buildCacheKey(
+		timeSeriesQuery.ProjectName,
+		timeSeriesQuery.Query,
+		timeSeriesQuery.GraphPeriod,
+		strconv.FormatInt(timeSeriesQuery.IntervalMS, 10),
+		timeSeriesQuery.timeRange.From.UTC().Format(time.RFC3339),
+		timeSeriesQuery.timeRange.To.UTC().Format(time.RFC3339),
+	)
+}
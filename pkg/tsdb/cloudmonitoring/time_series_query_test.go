@@ -1,12 +1,23 @@
 package cloudmonitoring
 
 import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
 	"testing"
 	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/infra/tracing"
 )
 
 func TestTimeSeriesQuery(t *testing.T) {
@@ -76,6 +87,16 @@ func TestTimeSeriesQuery(t *testing.T) {
 			assert.Equal(t, 1, len(res.Frames))
 			assert.Equal(t, "test-proj - asia-northeast1-c - 6724404429462225363 - 200", frames[0].Fields[1].Name)
 		})
+
+		t.Run("and INT64 points are read into an int64 field", func(t *testing.T) {
+			res := &backend.DataResponse{}
+			query := &cloudMonitoringTimeSeriesQuery{ProjectName: "test-proj", Query: "test-query"}
+			require.NoError(t, query.parseResponse(res, data, ""))
+
+			require.Len(t, res.Frames, 1)
+			assert.IsType(t, int64(0), res.Frames[0].Fields[1].At(0))
+			assert.Equal(t, int64(0), res.Frames[0].Fields[1].At(0))
+		})
 	})
 
 	t.Run("Parse labels", func(t *testing.T) {
@@ -102,6 +123,43 @@ func TestTimeSeriesQuery(t *testing.T) {
 		assert.Equal(t, "6724404429462225363", labels["resource.label.instance_id"])
 	})
 
+	t.Run("with a within clause", func(t *testing.T) {
+		response, err := loadTestFile("./test-data/7-series-response-mql.json")
+		require.NoError(t, err)
+
+		fromStart := time.Date(2018, 3, 15, 13, 0, 0, 0, time.UTC).In(time.Local)
+		res := &backend.DataResponse{}
+		query := &cloudMonitoringTimeSeriesQuery{
+			ProjectName: "test-proj",
+			Query:       "fetch gce_instance::compute.googleapis.com/instance/cpu/utilization | within 1h | align mean(1m)",
+			timeRange: backend.TimeRange{
+				From: fromStart,
+				To:   fromStart.Add(34 * time.Minute),
+			},
+		}
+		query.removeWithinClauses()
+		assert.Equal(t, "fetch gce_instance::compute.googleapis.com/instance/cpu/utilization | align mean(1m)", query.Query)
+
+		err = query.parseResponse(res, response, "")
+		require.NoError(t, err)
+		require.Len(t, res.Frames[0].Meta.Notices, 1)
+		assert.Equal(t, data.NoticeSeverityWarning, res.Frames[0].Meta.Notices[0].Severity)
+		assert.Contains(t, res.Frames[0].Meta.Notices[0].Text, "within clause")
+	})
+
+	t.Run("when the API reports partial errors", func(t *testing.T) {
+		response, err := loadTestFile("./test-data/7-series-response-mql.json")
+		require.NoError(t, err)
+		response.PartialErrors = []apiStatus{{Code: 4, Message: "Deadline exceeded reading the series"}}
+
+		res := &backend.DataResponse{}
+		query := &cloudMonitoringTimeSeriesQuery{ProjectName: "test-proj"}
+		require.NoError(t, query.parseResponse(res, response, ""))
+		require.Len(t, res.Frames[0].Meta.Notices, 1)
+		assert.Equal(t, data.NoticeSeverityWarning, res.Frames[0].Meta.Notices[0].Severity)
+		assert.Contains(t, res.Frames[0].Meta.Notices[0].Text, "Deadline exceeded reading the series")
+	})
+
 	t.Run("includes time interval", func(t *testing.T) {
 		data, err := loadTestFile("./test-data/7-series-response-mql.json")
 		require.NoError(t, err)
@@ -124,6 +182,91 @@ func TestTimeSeriesQuery(t *testing.T) {
 		assert.Equal(t, float64(60*1000), timeField.Config.Interval)
 	})
 
+	t.Run("generates a deep link for the MQL query", func(t *testing.T) {
+		fromStart := time.Date(2018, 3, 15, 13, 0, 0, 0, time.UTC)
+		query := &cloudMonitoringTimeSeriesQuery{
+			ProjectName: "test-proj",
+			Query:       "fetch gce_instance | metric 'compute.googleapis.com/instance/cpu/utilization'",
+			timeRange: backend.TimeRange{
+				From: fromStart,
+				To:   fromStart.Add(34 * time.Minute),
+			},
+		}
+		dl := query.buildDeepLink()
+		require.NotEmpty(t, dl)
+
+		u, err := url.Parse(dl)
+		require.NoError(t, err)
+		assert.Equal(t, "accounts.google.com", u.Host)
+		assert.Equal(t, "/AccountChooser", u.Path)
+
+		u, err = url.Parse(u.Query().Get("continue"))
+		require.NoError(t, err)
+		assert.Equal(t, "test-proj", u.Query().Get("project"))
+
+		var pageState struct {
+			XyChart struct {
+				DataSets []map[string]interface{} `json:"dataSets"`
+			} `json:"xyChart"`
+			TimeSelection map[string]string `json:"timeSelection"`
+		}
+		err = json.Unmarshal([]byte(u.Query().Get("pageState")), &pageState)
+		require.NoError(t, err)
+		require.Len(t, pageState.XyChart.DataSets, 1)
+		assert.Equal(t, query.Query, pageState.XyChart.DataSets[0]["timeSeriesQuery"])
+		assert.Equal(t, "2018-03-15T13:00:00Z", pageState.TimeSelection["start"])
+		assert.Equal(t, "2018-03-15T13:34:00Z", pageState.TimeSelection["end"])
+	})
+
+	t.Run("posts the query to the timeSeries:query endpoint", func(t *testing.T) {
+		response, err := os.ReadFile("./test-data/7-series-response-mql.json")
+		require.NoError(t, err)
+
+		var method, path, contentType string
+		var contentLength int64
+		var body []byte
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			method, path, contentType, contentLength = r.Method, r.URL.Path, r.Header.Get("Content-Type"), r.ContentLength
+			body, _ = io.ReadAll(r.Body)
+			_, _ = w.Write(response)
+		}))
+		defer srv.Close()
+
+		fromStart := time.Date(2018, 3, 15, 13, 0, 0, 0, time.UTC)
+		req := &backend.QueryDataRequest{Queries: []backend.DataQuery{{
+			TimeRange: backend.TimeRange{From: fromStart, To: fromStart.Add(34 * time.Minute)},
+		}}}
+		query := &cloudMonitoringTimeSeriesQuery{
+			RefID:       "A",
+			ProjectName: "test-proj",
+			Query:       "fetch gce_instance::compute.googleapis.com/instance/disk/read_bytes_count",
+			GraphPeriod: "disabled",
+			timeRange:   req.Queries[0].TimeRange,
+			logger:      log.NewNopLogger(),
+		}
+		s := &Service{tracer: tracing.InitializeTracerForTest()}
+		dsInfo := datasourceInfo{
+			services: map[string]datasourceService{
+				cloudMonitor: {url: srv.URL, client: srv.Client()},
+			},
+		}
+
+		dr, d, executedQuery, err := query.run(context.Background(), req, s, dsInfo, s.tracer)
+		require.NoError(t, err)
+		require.NoError(t, dr.Error)
+		assert.Equal(t, http.MethodPost, method)
+		assert.Equal(t, "/v3/projects/test-proj/timeSeries:query", path)
+		assert.Equal(t, "application/json", contentType)
+		assert.Equal(t, int64(len(body)), contentLength)
+		assert.JSONEq(t, `{"query": "fetch gce_instance::compute.googleapis.com/instance/disk/read_bytes_count | within d'2018/03/15-13:00:00', d'2018/03/15-13:34:00'"}`, string(body))
+
+		err = query.parseResponse(dr, d, executedQuery)
+		require.NoError(t, err)
+		require.Len(t, dr.Frames, 1)
+		assert.Equal(t, "A", dr.Frames[0].RefID)
+		assert.Equal(t, 2, dr.Frames[0].Rows())
+	})
+
 	t.Run("appends graph_period to the query", func(t *testing.T) {
 		query := &cloudMonitoringTimeSeriesQuery{}
 		assert.Equal(t, query.appendGraphPeriod(&backend.QueryDataRequest{Queries: []backend.DataQuery{{}}}), " | graph_period 1ms")
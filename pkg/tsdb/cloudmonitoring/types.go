@@ -2,6 +2,7 @@ package cloudmonitoring
 
 import (
 	"context"
+	"encoding/json"
 	"net/url"
 	"time"
 
@@ -18,6 +19,8 @@ type (
 		parseResponse(dr *backend.DataResponse, data cloudMonitoringResponse, executedQueryString string) error
 		buildDeepLink() string
 		getRefID() string
+		getCorrelationID() string
+		CacheKey() string
 	}
 
 	// Used to build time series filters
@@ -28,10 +31,32 @@ type (
 		GroupBys    []string
 		AliasBy     string
 		ProjectName string
+		MetricType  string
 		Selector    string
 		Service     string
 		Slo         string
+		Lookback    string
 		logger      log.Logger
+		// when set, series with more points than maxDataPoints are downsampled after the query
+		downsample    bool
+		maxDataPoints int64
+		// set when the query didn't specify a per series aligner, so it can be chosen by metric kind
+		defaultAligner       bool
+		rateAlignerDefaulted bool
+		// set when the auto alignment period exceeded the API maximum and was clamped to it
+		alignmentPeriodClamped bool
+		// when set, the metric type is added as a label to the fields of every series
+		includeMetricTypeLabel bool
+		// how alignment periods without data are filled, one of the fillMissing modes
+		fillMissing string
+		// when set, the raw API response is attached to the frame meta
+		debugRawResponse bool
+		// renames the labels of the output fields, labels without a rename are kept as they are
+		labelRenames map[string]string
+		// identifies the query as it was built, see CacheKey
+		cacheKey string
+
+		correlationID string
 	}
 
 	// Used to build MQL queries
@@ -44,16 +69,29 @@ type (
 		timeRange   backend.TimeRange
 		GraphPeriod string
 		logger      log.Logger
+		// set when within clauses of the query were replaced by the panel time range
+		withinClauseRemoved bool
+		// when set, the raw API response is attached to the frame meta
+		debugRawResponse bool
+		// renames the labels of the output fields, labels without a rename are kept as they are
+		labelRenames map[string]string
+		// identifies the query as it was built, see CacheKey
+		cacheKey string
+
+		correlationID string
 	}
 
 	metricQuery struct {
 		ProjectName        string
+		ProjectNames       []string
 		MetricType         string
 		CrossSeriesReducer string
 		AlignmentPeriod    string
 		PerSeriesAligner   string
 		GroupBys           []string
+		SecondaryGroupBys  []string
 		Filters            []string
+		CaseInsensitive    bool
 		AliasBy            string
 		View               string
 		EditorMode         string
@@ -61,6 +99,22 @@ type (
 		Preprocessor       string
 		PreprocessorType   preprocessorType
 		GraphPeriod        string
+
+		// PrimaryCrossSeriesReducer overrides the reducer of the primary aggregation when a preprocessor is used
+		PrimaryCrossSeriesReducer string
+		// SecondaryAlignmentPeriod overrides the alignment period of the secondary aggregation when a preprocessor is used
+		SecondaryAlignmentPeriod string
+		// Downsample reduces series that exceed the query's max data points after the query
+		Downsample bool
+		// IncludeMetricTypeLabel adds a metricType label to the output series, it's opt-in so
+		// existing legends don't change
+		IncludeMetricTypeLabel bool
+		// FillMissing is null, connected or zero, connected leaves gaps in the series as they are
+		FillMissing string
+		// DebugRawResponse attaches the raw API response to the frame meta
+		DebugRawResponse bool
+		// LabelRenames renames output labels, e.g. metric.label.instance_name to instance
+		LabelRenames map[string]string
 	}
 
 	sloQuery struct {
@@ -72,6 +126,9 @@ type (
 		ServiceId        string
 		SloId            string
 		LookbackPeriod   string
+		Preprocessor     string
+		// LookbackPeriods fans a burn rate query out into one query per lookback period
+		LookbackPeriods []string
 	}
 
 	grafanaQuery struct {
@@ -80,13 +137,14 @@ type (
 		QueryType    string
 		MetricQuery  metricQuery
 		SloQuery     sloQuery
+		ScopedVars   scopedVars
 	}
 
 	cloudMonitoringBucketOptions struct {
 		LinearBuckets *struct {
-			NumFiniteBuckets int64 `json:"numFiniteBuckets"`
-			Width            int64 `json:"width"`
-			Offset           int64 `json:"offset"`
+			NumFiniteBuckets int64   `json:"numFiniteBuckets"`
+			Width            float64 `json:"width"`
+			Offset           float64 `json:"offset"`
 		} `json:"linearBuckets"`
 		ExponentialBuckets *struct {
 			NumFiniteBuckets int64   `json:"numFiniteBuckets"`
@@ -104,6 +162,17 @@ type (
 		TimeSeriesData       timeSeriesData       `json:"timeSeriesData"`
 		Unit                 string               `json:"unit"`
 		NextPageToken        string               `json:"nextPageToken"`
+		// ExecutionErrors (time series filters) and PartialErrors (MQL queries) are set when
+		// the API could only read part of the series
+		ExecutionErrors []apiStatus `json:"executionErrors"`
+		PartialErrors   []apiStatus `json:"partialErrors"`
+		// MetricDescription, MetricKind and MetricValueType are taken from the metric descriptor,
+		// they're not part of the API response
+		MetricDescription string `json:"-"`
+		MetricKind        string `json:"-"`
+		MetricValueType   string `json:"-"`
+		// RawResponse is the body of the first page of the response, kept for debugging
+		RawResponse []byte `json:"-"`
 	}
 )
 
@@ -248,3 +317,39 @@ type selectableValue struct {
 	Label string  `json:"label"`
 	Goal  float64 `json:"goal,omitempty"`
 }
+
+type metricFindValue struct {
+	Text  string `json:"text"`
+	Value string `json:"value"`
+}
+
+// inspectQueryRequest is the body of an /inspectQuery resource request
+type inspectQueryRequest struct {
+	From    string            `json:"from"`
+	To      string            `json:"to"`
+	Queries []json.RawMessage `json:"queries"`
+}
+
+// inspectedQuery describes the Cloud Monitoring API request a query is built into. Target and
+// Params are set for time series filters, Query for MQL queries.
+type inspectedQuery struct {
+	RefID  string     `json:"refId"`
+	Path   string     `json:"path"`
+	Target string     `json:"target,omitempty"`
+	Params url.Values `json:"params,omitempty"`
+	Query  string     `json:"query,omitempty"`
+}
+
+// apiStatus is an error the API reports next to a partial response
+type apiStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type apiErrorResponse struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+	} `json:"error"`
+}
@@ -1,7 +1,10 @@
 package cloudmonitoring
 
 import (
+	"math"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/data"
 	"github.com/grafana/grafana/pkg/tsdb/intervalv2"
@@ -45,3 +48,14 @@ func addInterval(period string, field *data.Field) error {
 	}
 	return nil
 }
+
+// toDeepLinkAlignmentPeriod normalizes an alignment period to the format expected by the
+// Metrics Explorer deep link: no leading +, whole seconds and a trailing s, e.g. +0.5s -> 1s
+func toDeepLinkAlignmentPeriod(alignmentPeriod string) string {
+	period := strings.TrimPrefix(alignmentPeriod, "+")
+	d, err := time.ParseDuration(period)
+	if err != nil {
+		return period
+	}
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10) + "s"
+}